@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// redactParams are the lower-cased names of query parameters redacted from logged URLs.
+var redactParams = parseRedactParams("key,token,access_token")
+
+// accessLog records one line per request. It shares stderr with the
+// application log unless -access-log-file is set.
+var accessLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// reopenableFile is an append-only log file that can be reopened in place,
+// allowing external tools to rotate it.
+type reopenableFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// openReopenableFile opens path for appending, creating it if necessary.
+func openReopenableFile(path string) (*reopenableFile, error) {
+	f := &reopenableFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write appends p to the current file.
+func (f *reopenableFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Write(p)
+}
+
+// Reopen closes the current file, if any, and opens path again.
+func (f *reopenableFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+
+	return nil
+}
+
+// Close closes the current file.
+func (f *reopenableFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// reopenOnSIGHUP reopens f each time the process receives SIGHUP, until ctx is done.
+func reopenOnSIGHUP(ctx context.Context, f *reopenableFile) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			if err := f.Reopen(); err != nil {
+				log.Printf("Error reopening access log: %v\n", err)
+				continue
+			}
+			log.Printf("reopened access log %s\n", f.path)
+		}
+	}
+}
+
+// redactedURI returns the request URI of u with the values of any query
+// parameters named in -redact-params replaced by REDACTED.
+func redactedURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+
+	query := u.Query()
+	for name, values := range query {
+		if !redactParams[strings.ToLower(name)] {
+			continue
+		}
+
+		for i := range values {
+			values[i] = "REDACTED"
+		}
+	}
+
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// parseRedactParams parses a comma-separated list of query parameter names.
+func parseRedactParams(s string) map[string]bool {
+	params := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			params[strings.ToLower(name)] = true
+		}
+	}
+
+	return params
+}
+
+// accessRecorder captures the status code and body size written by a handler.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessRecorder) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// logAccess wraps next, writing an access log line for every request it serves.
+func logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		responsesTotal.WithLabelValues(strconv.Itoa(rec.status)).Inc()
+		accessLog.Printf("%s %s %s %s %d %d %s\n", getClientIP(r), r.Method, redactedURI(r.URL), r.Proto, rec.status, rec.bytes, time.Since(start))
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFile(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openReopenableFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	accessLog.SetOutput(f)
+	t.Cleanup(func() {
+		log.SetOutput(io.Discard)
+		accessLog.SetOutput(io.Discard)
+	})
+
+	// access log lines go to the file, application logs stay on stderr
+	get(logAccess(handler), "/owner/repo/file.txt")
+	log.Printf("application message\n")
+
+	if got := readFile(t, path); !strings.Contains(got, "GET /owner/repo/file.txt HTTP/1.1 200 7") || strings.Contains(got, "application message") {
+		t.Errorf("access log file = %q, want only the access log line", got)
+	}
+	if got := logged.String(); strings.Contains(got, "HTTP/1.1 200") || !strings.Contains(got, "application message") {
+		t.Errorf("application log = %q, want the application message without the access log line", got)
+	}
+
+	// SIGHUP reopens the file once it has been rotated away. Keep SIGHUP from
+	// ending the test process until reopenOnSIGHUP has its own handler.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reopenOnSIGHUP(ctx, f)
+		close(done)
+	}()
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("access log file not reopened after SIGHUP")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	get(logAccess(handler), "/owner/repo/file.txt?after=rotation")
+	if got := readFile(t, path); !strings.Contains(got, "after=rotation") {
+		t.Errorf("reopened access log file = %q, want the request after rotation", got)
+	}
+	if got := readFile(t, path+".1"); strings.Contains(got, "after=rotation") {
+		t.Errorf("rotated access log file = %q, want no requests after rotation", got)
+	}
+}
+
+func TestRedactedURI(t *testing.T) {
+	tests := []struct {
+		params string
+		uri    string
+		want   string
+	}{
+		{"key,token,access_token", "/owner/repo/file.txt", "/owner/repo/file.txt"},
+		{"key,token,access_token", "/owner/repo/file.txt?ref=main", "/owner/repo/file.txt?ref=main"},
+		{"key,token,access_token", "/owner/repo/file.txt?key=secret&ref=main", "/owner/repo/file.txt?key=REDACTED&ref=main"},
+		{"key,token,access_token", "/f?token=a&token=b&access_token=c", "/f?access_token=REDACTED&token=REDACTED&token=REDACTED"},
+		{"key,token,access_token", "/f?KEY=secret", "/f?KEY=REDACTED"},
+		{"Key, Signature", "/f?key=secret&signature=sig&token=kept", "/f?key=REDACTED&signature=REDACTED&token=kept"},
+		{"", "/f?key=kept", "/f?key=kept"},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, &redactParams, parseRedactParams(tt.params))
+
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactedURI(u); got != tt.want {
+			t.Errorf("redact %q from %s: got %s, want %s", tt.params, tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestRequestLogsAreRedacted(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	accessLog.SetOutput(&logged)
+	t.Cleanup(func() {
+		log.SetOutput(io.Discard)
+		accessLog.SetOutput(io.Discard)
+	})
+
+	get(logAccess(handler), "/owner/repo/file.txt?access_token=s3cret&ref=main")
+	if got := logged.String(); strings.Contains(got, "s3cret") || strings.Count(got, "access_token=REDACTED") != 2 {
+		t.Errorf("log = %q, want the token redacted from the request and access log lines", got)
+	}
+}
+
+// readFile returns the contents of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
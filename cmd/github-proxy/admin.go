@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/time/rate"
+)
+
+// adminRefreshInterval is the minimum time between admin token refreshes, so
+// that the endpoint can't be used to hammer GitHub's token endpoint.
+const adminRefreshInterval = time.Minute
+
+// adminRefreshLimiter allows one admin token refresh per adminRefreshInterval.
+var adminRefreshLimiter = rate.NewLimiter(rate.Every(adminRefreshInterval), 1)
+
+// authorizeAdmin checks that an admin request is enabled, presents the
+// -admin-token and uses method, responding with an error and returning false
+// if not. Client credentials don't grant admin access.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, method string) bool {
+	if *adminToken == "" {
+		httpError(w, http.StatusNotFound, "Not Found", errors.New("admin endpoints require an admin token to be configured"))
+		return false
+	}
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(*adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(w, http.StatusUnauthorized, "Unauthorized", errors.New("missing or invalid admin token"))
+		return false
+	}
+
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		httpError(w, http.StatusMethodNotAllowed, "Method Not Allowed", errors.New("invalid request method"))
+		return false
+	}
+
+	return true
+}
+
+// tokenRefreshHandler replaces the cached installation tokens of every app,
+// responding with the new tokens' expiries. Refreshes are limited to one per
+// adminRefreshInterval; others are rejected with 429.
+func tokenRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, http.MethodPost) {
+		return
+	}
+
+	reservation := adminRefreshLimiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		httpError(w, http.StatusTooManyRequests, "Too Many Requests", errors.New("installation tokens were refreshed recently"))
+		return
+	}
+
+	expiries := make(map[string]time.Time)
+	for _, name := range appNames() {
+		expiry, err := apps[name].refreshInstallationToken()
+		if err != nil {
+			httpError(w, http.StatusBadGateway, "Bad Gateway", err)
+			return
+		}
+		expiries[name] = expiry
+	}
+
+	log.Printf("installation tokens refreshed by admin request\n")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ExpiresAt time.Time            `json:"expires_at"`
+		Apps      map[string]time.Time `json:"apps"`
+	}{expiries[defaultApp.name], expiries})
+}
+
+// startTime is when the proxy started, for reporting uptime.
+var startTime = time.Now()
+
+// subsystemHealth is the health of one subsystem in the health summary.
+type subsystemHealth struct {
+	Status string `json:"status"` // "ok" or "degraded"
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthHandler responds with a JSON summary of the health of each subsystem,
+// and an overall status that is degraded if any subsystem is.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, http.MethodGet) {
+		return
+	}
+
+	subsystems := map[string]subsystemHealth{
+		"tokens":     tokensHealth(),
+		"rate_limit": rateLimitHealth(),
+		"cache":      cacheHealth(),
+	}
+	if usedVault {
+		subsystems["vault"] = vaultHealth(r.Context())
+	}
+
+	status := "ok"
+	for _, health := range subsystems {
+		if health.Status != "ok" {
+			status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status     string                     `json:"status"`
+		Uptime     string                     `json:"uptime"`
+		Subsystems map[string]subsystemHealth `json:"subsystems"`
+	}{status, time.Since(startTime).Round(time.Second).String(), subsystems})
+}
+
+// tokensHealth is degraded if any app lacks an unexpired installation token.
+func tokensHealth() subsystemHealth {
+	var invalid []string
+	for _, name := range appNames() {
+		if !apps[name].hasValidToken() {
+			invalid = append(invalid, name)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return subsystemHealth{"degraded", "no valid installation token for " + strings.Join(invalid, ", ")}
+	}
+
+	return subsystemHealth{"ok", fmt.Sprintf("%d apps with valid installation tokens", len(apps))}
+}
+
+// rateLimitHealth is degraded if GitHub's rate limit is unknown or exhausted
+// for any installation.
+func rateLimitHealth() subsystemHealth {
+	var exceeded []string
+	for _, name := range appNames() {
+		installation := apps[name].installationID
+		if resume, paused := upstreamPausedUntil(installation); paused {
+			exceeded = append(exceeded, fmt.Sprintf("installation %s until %s", installation, resume.Format(time.RFC3339)))
+		}
+	}
+	if len(exceeded) > 0 {
+		return subsystemHealth{"degraded", "GitHub rate limit exceeded for " + strings.Join(exceeded, ", ")}
+	}
+
+	limiter := globalLimiter.Load()
+	if limiter == nil {
+		return subsystemHealth{"degraded", "GitHub rate limit unknown"}
+	}
+
+	return subsystemHealth{"ok", fmt.Sprintf("%.0f requests available", limiter.Tokens())}
+}
+
+// cacheHealth reports the occupancy of the in-memory file cache, which is always available.
+func cacheHealth() subsystemHealth {
+	fileCacheMutex.Lock()
+	entries, blobs, size := len(fileCache), len(blobCache), fileCacheBytes
+	fileCacheMutex.Unlock()
+
+	detail := fmt.Sprintf("%d of %d entries, %d distinct blobs, %d bytes", entries, fileCacheMaxEntries, blobs, size)
+	if *cacheMaxBytes > 0 {
+		detail += fmt.Sprintf(" of %d", *cacheMaxBytes)
+	}
+
+	return subsystemHealth{"ok", detail}
+}
+
+// vaultHealth is degraded if Vault can't be reached or is sealed.
+func vaultHealth(ctx context.Context) subsystemHealth {
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return subsystemHealth{"degraded", err.Error()}
+	}
+
+	health, err := client.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return subsystemHealth{"degraded", err.Error()}
+	}
+
+	if health.Sealed {
+		return subsystemHealth{"degraded", "vault is sealed"}
+	}
+
+	return subsystemHealth{"ok", ""}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// adminRequest returns a request for target presenting token as a Bearer
+// token, or no credential if it is empty.
+func adminRequest(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestAdminEndpointsRequireAdminToken(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, &authenticator, Authenticator(&staticAuthenticator{token: []byte("client-token")}))
+
+	// disabled without an admin token
+	setForTest(t, adminToken, "")
+	if resp := serve(http.HandlerFunc(healthHandler), adminRequest(http.MethodGet, "/_admin/health", "client-token")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("no admin token configured: status = %d, want 404", resp.StatusCode)
+	}
+
+	setForTest(t, adminToken, "admin-token")
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		token   string
+		status  int
+	}{
+		{"health without credentials", healthHandler, http.MethodGet, "", http.StatusUnauthorized},
+		{"health with client token", healthHandler, http.MethodGet, "client-token", http.StatusUnauthorized},
+		{"health with wrong token", healthHandler, http.MethodGet, "admin-tokenx", http.StatusUnauthorized},
+		{"health with admin token", healthHandler, http.MethodGet, "admin-token", http.StatusOK},
+		{"health with wrong method", healthHandler, http.MethodPost, "admin-token", http.StatusMethodNotAllowed},
+		{"refresh without credentials", tokenRefreshHandler, http.MethodPost, "", http.StatusUnauthorized},
+		{"refresh with client token", tokenRefreshHandler, http.MethodPost, "client-token", http.StatusUnauthorized},
+		{"refresh with wrong method", tokenRefreshHandler, http.MethodGet, "admin-token", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		if resp := serve(tt.handler, adminRequest(tt.method, "/_admin", tt.token)); resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestAdminTokenRefresh(t *testing.T) {
+	gh, _ := newTestProxy(t)
+	setForTest(t, adminToken, "admin-token")
+	setForTest(t, &adminRefreshLimiter, rate.NewLimiter(rate.Every(adminRefreshInterval), 1))
+
+	old, err := defaultApp.getInstallationToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serve(http.HandlerFunc(tokenRefreshHandler), adminRequest(http.MethodPost, "/_admin/token/refresh", "admin-token"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	token, err := defaultApp.getInstallationToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == old {
+		t.Errorf("cached token %q not replaced", old)
+	}
+
+	// a second refresh straight away is rejected without asking GitHub
+	n := gh.count("/app/")
+	resp = serve(http.HandlerFunc(tokenRefreshHandler), adminRequest(http.MethodPost, "/_admin/token/refresh", "admin-token"))
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second refresh: status = %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("second refresh: no Retry-After")
+	}
+	if got := gh.count("/app/"); got != n {
+		t.Errorf("second refresh sent %d token requests to GitHub", got-n)
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, adminToken, "admin-token")
+
+	health := func() (status string, subsystems map[string]subsystemHealth) {
+		t.Helper()
+
+		resp := serve(http.HandlerFunc(healthHandler), adminRequest(http.MethodGet, "/_admin/health", "admin-token"))
+		if got := resp.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+
+		var summary struct {
+			Status     string                     `json:"status"`
+			Uptime     string                     `json:"uptime"`
+			Subsystems map[string]subsystemHealth `json:"subsystems"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := time.ParseDuration(summary.Uptime); err != nil {
+			t.Errorf("uptime %q: %v", summary.Uptime, err)
+		}
+		return summary.Status, summary.Subsystems
+	}
+
+	// no installation token has been obtained yet
+	status, subsystems := health()
+	if status != "degraded" || subsystems["tokens"].Status != "degraded" || subsystems["rate_limit"].Status != "ok" || subsystems["cache"].Status != "ok" {
+		t.Errorf("without a token: status %s with %+v, want only tokens degraded", status, subsystems)
+	}
+
+	if _, err := defaultApp.getInstallationToken(); err != nil {
+		t.Fatal(err)
+	}
+	if status, subsystems := health(); status != "ok" || subsystems["tokens"].Status != "ok" {
+		t.Errorf("with a token: status %s with %+v, want ok", status, subsystems)
+	}
+
+	// GitHub's rate limit is exceeded for the installation
+	pauseUpstream(defaultApp.installationID, time.Now().Add(time.Minute))
+	status, subsystems = health()
+	if status != "degraded" || subsystems["rate_limit"].Status != "degraded" || !strings.Contains(subsystems["rate_limit"].Detail, "installation 1") {
+		t.Errorf("rate limit exceeded: status %s with %+v, want rate_limit degraded for installation 1", status, subsystems)
+	}
+	upstreamPauses.Clear()
+
+	// or isn't yet known
+	oldLimiter := globalLimiter.Swap(nil)
+	t.Cleanup(func() { globalLimiter.Store(oldLimiter) })
+	if status, subsystems := health(); status != "degraded" || subsystems["rate_limit"].Detail != "GitHub rate limit unknown" {
+		t.Errorf("rate limit unknown: status %s with %+v, want rate_limit degraded", status, subsystems)
+	}
+}
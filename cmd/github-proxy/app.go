@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// defaultApp is the GitHub App configured by -client-id, -installation-id
+	// and the private key flags. It serves owners not routed to another app.
+	defaultApp *githubApp
+
+	apps        = make(map[string]*githubApp)
+	appsByOwner = make(map[string]*githubApp)
+
+	// tokenRefreshes is a semaphore limiting concurrent installation token
+	// requests, across all apps, to -max-token-refreshes.
+	tokenRefreshes chan struct{}
+)
+
+// githubApp is a GitHub App identity the proxy authenticates as, with its own
+// installation token cache.
+type githubApp struct {
+	name           string
+	clientID       string
+	installationID string
+	privateKey     crypto.Signer
+	owners         []string
+
+	tokenMutex   sync.Mutex
+	token        string
+	tokenExpiry  time.Time // when the token actually expires
+	tokenRenewAt time.Time // when the token is renewed, ahead of its expiry
+}
+
+// tokenRenewalLead is how long before an installation token expires that it is renewed.
+const tokenRenewalLead = 3 * time.Minute
+
+// tokenRenewalRetryDelay is how long after a failed renewal it is retried,
+// while the cached token remains valid.
+const tokenRenewalRetryDelay = 30 * time.Second
+
+// getInstallationToken returns a valid installation token for the default app.
+func getInstallationToken() (string, error) {
+	return defaultApp.getInstallationToken()
+}
+
+// registerApp adds app to the registry, routing its owners to it.
+func registerApp(app *githubApp) error {
+	if _, ok := apps[app.name]; ok {
+		return fmt.Errorf("duplicate GitHub App name: %s", app.name)
+	}
+
+	for _, owner := range app.owners {
+		owner = strings.ToLower(owner)
+		if other, ok := appsByOwner[owner]; ok {
+			return fmt.Errorf("owner %s is routed to both %s and %s", owner, other.name, app.name)
+		}
+		appsByOwner[owner] = app
+	}
+
+	apps[app.name] = app
+	return nil
+}
+
+// appNames returns the names of all registered apps, sorted.
+func appNames() []string {
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// appForRequest selects the app to serve a request for owner: the app named by
+// the -app-header request header if enabled and present, then the app the
+// owner is routed to, then the default app.
+func appForRequest(r *http.Request, owner string) (*githubApp, error) {
+	if *appHeader != "" {
+		if name := r.Header.Get(*appHeader); name != "" {
+			app, ok := apps[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown GitHub App: %s", name)
+			}
+			return app, nil
+		}
+	}
+
+	if app, ok := appsByOwner[strings.ToLower(owner)]; ok {
+		return app, nil
+	}
+
+	return defaultApp, nil
+}
+
+// getInstallationToken returns a valid installation token, renewing it if necessary.
+func (a *githubApp) getInstallationToken() (string, error) {
+	a.tokenMutex.Lock()
+	defer a.tokenMutex.Unlock()
+
+	if time.Now().Before(a.tokenRenewAt) {
+		log.Printf("using %s installation token from cache; expires at %s\n", a.name, a.tokenExpiry)
+		return a.token, nil
+	}
+
+	if _, err := a.acquireInstallationToken(); err != nil {
+		// renewal starts early, so the cached token may still be usable; keep
+		// using it without retrying the renewal on every request
+		if a.token != "" && time.Now().Before(a.tokenExpiry) {
+			a.tokenRenewAt = time.Now().Add(tokenRenewalRetryDelay)
+			if a.tokenRenewAt.After(a.tokenExpiry) {
+				a.tokenRenewAt = a.tokenExpiry
+			}
+			log.Printf("failed to renew %s installation token; using cached token, retrying renewal at %s: %v\n", a.name, a.tokenRenewAt, err)
+			return a.token, nil
+		}
+
+		return "", err
+	}
+
+	return a.token, nil
+}
+
+// hasValidToken reports whether the app has a cached installation token that
+// hasn't expired.
+func (a *githubApp) hasValidToken() bool {
+	a.tokenMutex.Lock()
+	defer a.tokenMutex.Unlock()
+
+	return a.token != "" && time.Now().Before(a.tokenExpiry)
+}
+
+// refreshInstallationToken replaces the cached installation token with a newly
+// acquired one, returning its expiry. If that fails the cached token is kept.
+func (a *githubApp) refreshInstallationToken() (time.Time, error) {
+	a.tokenMutex.Lock()
+	defer a.tokenMutex.Unlock()
+
+	return a.acquireInstallationToken()
+}
+
+// acquireInstallationToken requests a new installation token and caches it,
+// returning its expiry. The caller must hold tokenMutex.
+func (a *githubApp) acquireInstallationToken() (time.Time, error) {
+	tokenRefreshes <- struct{}{}
+	defer func() { <-tokenRefreshes }()
+
+	log.Printf("acquiring new %s installation token\n", a.name)
+
+	token, expiry, err := a.requestInstallationToken(0)
+	retries.record(errors.Is(err, errJWTClockSkew))
+	if errors.Is(err, errJWTClockSkew) {
+		if retries.allow() {
+			log.Printf("JWT rejected due to clock skew; retrying with claims backdated by %s\n", jwtClockSkew)
+			token, expiry, err = a.requestInstallationToken(jwtClockSkew)
+		} else {
+			log.Printf("JWT rejected due to clock skew; retry budget exhausted, not retrying\n")
+		}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	tokenInstallations.Delete(a.token)
+	tokenInstallations.Store(token, a.installationID)
+
+	a.token = token
+	a.tokenExpiry = expiry
+	a.tokenRenewAt = renewalTime(expiry)
+	tokenRenewals.WithLabelValues(a.name).Inc()
+
+	log.Printf("%s installation token expires at %s\n", a.name, expiry)
+
+	return expiry, nil
+}
+
+// renewalTime returns when a token expiring at expiry is renewed:
+// tokenRenewalLead before it expires, or halfway to its expiry if it expires
+// sooner than that.
+func renewalTime(expiry time.Time) time.Time {
+	renewAt := expiry.Add(-tokenRenewalLead)
+	if halfway := time.Now().Add(time.Until(expiry) / 2); renewAt.Before(halfway) {
+		return halfway
+	}
+
+	return renewAt
+}
+
+// requestInstallationToken generates a JWT with its claims backdated by skew and exchanges it for an installation token.
+func (a *githubApp) requestInstallationToken(skew time.Duration) (string, time.Time, error) {
+	jwt, err := GenerateJWT(a.clientID, a.privateKey, skew)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate JWT: %w", err)
+	}
+
+	// the token is shared by every request, so isn't tied to any one of them
+	token, expiry, err := GetInstallationToken(context.Background(), jwt, a.installationID, tokenPermissions)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get installation token: %w", err)
+	}
+
+	return token, expiry, nil
+}
+
+// parseInstallations parses comma-separated owner=installation-id pairs.
+func parseInstallations(s string) (map[string]string, error) {
+	installations := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		owner, id, ok := strings.Cut(pair, "=")
+		if !ok || owner == "" || id == "" || strings.Contains(owner, "/") {
+			return nil, fmt.Errorf("invalid installation: %s", pair)
+		}
+
+		installations[owner] = id
+	}
+
+	return installations, nil
+}
+
+// appFlag collects the -app flags.
+type appFlag []string
+
+// newAppFlag defines a repeatable flag with the given name and usage,
+// returning the values it collects.
+func newAppFlag(name, usage string) *appFlag {
+	f := new(appFlag)
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *appFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *appFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
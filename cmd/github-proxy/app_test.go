@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestTokenRefreshesAreLimited(t *testing.T) {
+	for _, limit := range []int{1, 2} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			newTestProxy(t)
+			setForTest(t, &tokenRefreshes, make(chan struct{}, limit))
+
+			var c concurrency
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer c.enter()()
+				time.Sleep(20 * time.Millisecond)
+
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"token":"ghs_token"}`)
+			}))
+			defer server.Close()
+			setForTest(t, &githubAPIURL, server.URL)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 6; i++ {
+				app := newTestApp(t, fmt.Sprint("app", i), fmt.Sprint(100+i))
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					if _, err := app.getInstallationToken(); err != nil {
+						t.Errorf("%s: %v", app.name, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := c.peak.Load(); got != int32(limit) {
+				t.Errorf("peak concurrent token requests = %d, want %d", got, limit)
+			}
+		})
+	}
+}
+
+func TestFailedRenewalIsRetriedLater(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		expires time.Duration // from now, of the cached token
+		retry   time.Duration // from now, of the renewal retry
+	}{
+		{"long before expiry", 2 * time.Minute, tokenRenewalRetryDelay},
+		{"close to expiry", 10 * time.Second, 10 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gh, _ := newTestProxy(t)
+			setForTest(t, maxRetries, 0)
+
+			app := newTestApp(t, "app", "7")
+			app.token = "ghs_cached"
+			app.tokenExpiry = time.Now().Add(tt.expires)
+			app.tokenRenewAt = time.Now().Add(-time.Second)
+
+			gh.setStatus(http.StatusInternalServerError)
+			for i := 0; i < 3; i++ {
+				token, err := app.getInstallationToken()
+				if err != nil || token != "ghs_cached" {
+					t.Fatalf("request %d: token %q, %v; want the cached token", i, token, err)
+				}
+			}
+
+			if n := gh.count("/app/installations/"); n != 1 {
+				t.Errorf("%d renewal attempts, want 1", n)
+			}
+			if want := time.Now().Add(tt.retry); app.tokenRenewAt.After(want) || app.tokenRenewAt.Before(want.Add(-time.Second)) {
+				t.Errorf("renewal retried at %s, want %s", app.tokenRenewAt, want)
+			}
+			if app.tokenRenewAt.After(app.tokenExpiry) {
+				t.Errorf("renewal retried at %s, after the token expires at %s", app.tokenRenewAt, app.tokenExpiry)
+			}
+
+			// once the retry is due, renewal is attempted again
+			gh.setStatus(0)
+			app.tokenRenewAt = time.Now().Add(-time.Second)
+			if token, err := app.getInstallationToken(); err != nil || token == "ghs_cached" {
+				t.Errorf("after retry: token %q, %v; want a new token", token, err)
+			}
+		})
+	}
+}
+
+func TestTokenExpiryIsReportedByGitHub(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		ttl     time.Duration
+		renewIn time.Duration // from now, roughly
+	}{
+		{"an hour", time.Hour, time.Hour - tokenRenewalLead},
+		{"early", 2 * time.Minute, time.Minute},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gh, _ := newTestProxy(t)
+			gh.tokenTTL = tt.ttl
+
+			app := newTestApp(t, "app", "7")
+			token, err := app.getInstallationToken()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := time.Now().Add(tt.ttl); app.tokenExpiry.After(want) || app.tokenExpiry.Before(want.Add(-2*time.Second)) {
+				t.Errorf("token expires at %s, want %s", app.tokenExpiry, want)
+			}
+			if want := time.Now().Add(tt.renewIn); app.tokenRenewAt.After(want.Add(time.Second)) || app.tokenRenewAt.Before(want.Add(-2*time.Second)) {
+				t.Errorf("token renewed at %s, want %s", app.tokenRenewAt, want)
+			}
+
+			// the token is used until it is due for renewal
+			if again, err := app.getInstallationToken(); err != nil || again != token {
+				t.Errorf("second request: token %q, %v; want the cached %q", again, err, token)
+			}
+			if n := gh.count("/app/installations/"); n != 1 {
+				t.Errorf("%d token requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRequestsAreServedWithTheirApp(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	setForTest(t, appHeader, "X-GitHub-App")
+	for _, app := range []*githubApp{newTestApp(t, "acme", "2", "acme"), newTestApp(t, "other", "3")} {
+		if err := registerApp(app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, owner := range []string{"owner", "acme", "Acme"} {
+		gh.setFile(owner, "repo", "file.txt", "content")
+	}
+
+	tests := []struct {
+		target       string
+		app          string
+		installation string
+	}{
+		{"/owner/repo/file.txt", "", "1"},
+		{"/acme/repo/file.txt", "", "2"},
+		{"/Acme/repo/file.txt", "", "2"},
+		{"/acme/repo/file.txt", "other", "3"},
+		{"/owner/repo/file.txt", "default", "1"},
+	}
+
+	// the second round is served from each app's own cached token
+	for round := 0; round < 2; round++ {
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.app != "" {
+				req.Header.Set("X-GitHub-App", tt.app)
+			}
+
+			if resp := serve(handler, req); resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s with app %q: status = %d, want 200", tt.target, tt.app, resp.StatusCode)
+			}
+
+			auth := gh.lastRequest("/repos/").Header.Get("Authorization")
+			if want := "Bearer ghs_" + tt.installation + "_"; !strings.HasPrefix(auth, want) {
+				t.Errorf("GET %s with app %q: GitHub request authorized with %q, want a token of installation %s", tt.target, tt.app, auth, tt.installation)
+			}
+		}
+	}
+
+	if n := gh.count("/app/installations/"); n != 3 {
+		t.Errorf("%d token requests, want one for each app", n)
+	}
+	for _, name := range appNames() {
+		app := apps[name]
+		if want := "ghs_" + app.installationID + "_"; !strings.HasPrefix(app.token, want) {
+			t.Errorf("%s app caches token %q, want one of installation %s", name, app.token, app.installationID)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("X-GitHub-App", "unknown")
+	if resp := serve(handler, req); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown app: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestClockSkewRejectionIsRetried(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		attempts int
+	}{
+		{"iat rejected", `'Issued at' claim ('iat') must be an Integer representing the time that the assertion was issued`, 2},
+		{"exp rejected", `'Expiration time' claim ('exp') is too far in the future`, 2},
+		{"other 401", `A JSON web token could not be decoded`, 1},
+	}
+
+	for _, tt := range tests {
+		newTestProxy(t)
+
+		var mu sync.Mutex
+		var issued []int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), claims); err != nil {
+				t.Error(err)
+			}
+
+			mu.Lock()
+			issued = append(issued, int64(claims["iat"].(float64)))
+			first := len(issued) == 1
+			mu.Unlock()
+
+			if first {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"message": tt.message})
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"token":"ghs_token"}`)
+		}))
+		setForTest(t, &githubAPIURL, server.URL)
+
+		_, err := newTestApp(t, "skewed", "7").getInstallationToken()
+		server.Close()
+
+		if len(issued) != tt.attempts {
+			t.Errorf("%s: %d token requests, want %d", tt.name, len(issued), tt.attempts)
+			continue
+		}
+		if tt.attempts == 1 {
+			if err == nil {
+				t.Errorf("%s: token acquired", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if backdated := issued[0] - issued[1]; backdated < int64(jwtClockSkew/time.Second) || backdated > int64(jwtClockSkew/time.Second)+1 {
+			t.Errorf("%s: retry's iat backdated by %ds, want %s", tt.name, backdated, jwtClockSkew)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var errUnauthorized = fmt.Errorf("missing or invalid auth token")
+
+// authenticator is the Authenticator selected by the -auth-mode flag.
+var authenticator Authenticator = noopAuthenticator{}
+
+// Authenticator decides whether a request may use the proxy.
+type Authenticator interface {
+	// Authenticate returns nil if the request is allowed, or an error explaining why not.
+	Authenticate(r *http.Request) error
+}
+
+// newAuthenticator returns the Authenticator for the given mode: "none", "static" or "jwt".
+// An empty mode selects "static" if an auth token is configured, otherwise "none".
+func newAuthenticator(mode string) (Authenticator, error) {
+	if mode == "" {
+		mode = "none"
+		if *authToken != "" {
+			mode = "static"
+		}
+	}
+
+	switch mode {
+	case "none":
+		return noopAuthenticator{}, nil
+
+	case "static":
+		if *authToken == "" {
+			return nil, fmt.Errorf("static auth requires an auth token")
+		}
+		return &staticAuthenticator{token: []byte(*authToken)}, nil
+
+	case "jwt":
+		if *authJWKSURL == "" {
+			return nil, fmt.Errorf("jwt auth requires a JWKS URL")
+		}
+		return &jwksAuthenticator{
+			url:      *authJWKSURL,
+			issuer:   *authJWTIssuer,
+			audience: *authJWTAud,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth mode: %s", mode)
+}
+
+// requestCredentials returns the bearer token from the Authorization header and,
+// if enabled, the 'key' query parameter. The key is stripped from the request so
+// it never reaches the logs or GitHub.
+func requestCredentials(r *http.Request) []string {
+	var creds []string
+
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if token = strings.TrimSpace(token); token != "" {
+			creds = append(creds, token)
+		}
+	}
+
+	if *allowQueryKey {
+		query := r.URL.Query()
+		if key := query.Get("key"); key != "" {
+			creds = append(creds, key)
+		}
+
+		query.Del("key")
+		r.URL.RawQuery = query.Encode()
+	}
+
+	return creds
+}
+
+// noopAuthenticator allows every request.
+type noopAuthenticator struct{}
+
+func (noopAuthenticator) Authenticate(r *http.Request) error {
+	return nil
+}
+
+// staticAuthenticator allows requests presenting a fixed shared token.
+type staticAuthenticator struct {
+	token []byte
+}
+
+func (a *staticAuthenticator) Authenticate(r *http.Request) error {
+	for _, cred := range requestCredentials(r) {
+		if subtle.ConstantTimeCompare([]byte(cred), a.token) == 1 {
+			return nil
+		}
+	}
+
+	return errUnauthorized
+}
+
+// jwksRefreshInterval is how long JWKS keys are cached before being fetched again.
+const jwksRefreshInterval = time.Hour
+
+// jwksAuthenticator allows requests presenting a JWT signed by a key in a JWKS,
+// optionally checking the issuer and audience claims.
+type jwksAuthenticator struct {
+	url      string
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func (a *jwksAuthenticator) Authenticate(r *http.Request) error {
+	var err error = errUnauthorized
+	for _, cred := range requestCredentials(r) {
+		if err = a.validate(cred); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// validate parses and verifies a JWT, including its expiry, issuer and audience.
+func (a *jwksAuthenticator) validate(tokenString string) error {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, a.keyFunc, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return fmt.Errorf("%w: unexpected issuer", errUnauthorized)
+	}
+
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return fmt.Errorf("%w: unexpected audience", errUnauthorized)
+	}
+
+	return nil
+}
+
+// keyFunc returns the JWKS key matching the token's kid, refreshing the key set
+// when it is stale or the kid is unknown.
+func (a *jwksAuthenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetched) > jwksRefreshInterval
+	if ok && !stale {
+		return key, nil
+	}
+
+	// don't let unknown kids trigger a fetch more than once a minute
+	if !stale && time.Since(a.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+
+	keys, err := a.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+	a.fetched = time.Now()
+
+	if key, ok = a.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+
+	return key, nil
+}
+
+// fetchKeys downloads the JWKS and returns its RSA keys by key ID.
+func (a *jwksAuthenticator) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := a.client.Get(a.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWKS key %s: %w", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWKS key %s: %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// setForTest sets a variable, such as a flag value, for the duration of a test.
+func setForTest[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// testJWKS serves a JWKS holding the public halves of its keys, counting fetches.
+type testJWKS struct {
+	keys    atomic.Value // map[string]*rsa.PrivateKey
+	fetches atomic.Int32
+}
+
+func newTestJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) (*testJWKS, *httptest.Server) {
+	t.Helper()
+
+	j := &testJWKS{}
+	j.keys.Store(keys)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.fetches.Add(1)
+
+		type jwk struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range j.keys.Load().(map[string]*rsa.PrivateKey) {
+			set.Keys = append(set.Keys, jwk{
+				Kty: "RSA",
+				Kid: kid,
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(server.Close)
+
+	return j, server
+}
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signTestJWT(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/owner/repo/file", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	tests := []struct {
+		mode    string
+		token   string
+		jwksURL string
+		want    Authenticator
+		wantErr bool
+	}{
+		{mode: "", want: noopAuthenticator{}},
+		{mode: "", token: "secret", want: &staticAuthenticator{}},
+		{mode: "none", token: "secret", want: noopAuthenticator{}},
+		{mode: "static", wantErr: true},
+		{mode: "jwt", wantErr: true},
+		{mode: "jwt", jwksURL: "https://example.com/jwks", want: &jwksAuthenticator{}},
+		{mode: "basic", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, authToken, tt.token)
+		setForTest(t, authJWKSURL, tt.jwksURL)
+
+		got, err := newAuthenticator(tt.mode)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newAuthenticator(%q) with token %q: expected an error", tt.mode, tt.token)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newAuthenticator(%q): %v", tt.mode, err)
+			continue
+		}
+
+		switch tt.want.(type) {
+		case noopAuthenticator:
+			if _, ok := got.(noopAuthenticator); !ok {
+				t.Errorf("newAuthenticator(%q) with token %q = %T, want noopAuthenticator", tt.mode, tt.token, got)
+			}
+		case *staticAuthenticator:
+			if _, ok := got.(*staticAuthenticator); !ok {
+				t.Errorf("newAuthenticator(%q) with token %q = %T, want *staticAuthenticator", tt.mode, tt.token, got)
+			}
+		case *jwksAuthenticator:
+			if _, ok := got.(*jwksAuthenticator); !ok {
+				t.Errorf("newAuthenticator(%q) = %T, want *jwksAuthenticator", tt.mode, got)
+			}
+		}
+	}
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	setForTest(t, allowQueryKey, true)
+	a := &staticAuthenticator{token: []byte("secret")}
+
+	tests := []struct {
+		name   string
+		header string
+		target string
+		ok     bool
+	}{
+		{name: "bearer", header: "Bearer secret", target: "/o/r/f", ok: true},
+		{name: "lowercase scheme", header: "bearer secret", target: "/o/r/f", ok: true},
+		{name: "query key", target: "/o/r/f?key=secret", ok: true},
+		{name: "wrong token", header: "Bearer wrong", target: "/o/r/f"},
+		{name: "prefix of token", header: "Bearer secre", target: "/o/r/f"},
+		{name: "basic scheme", header: "Basic secret", target: "/o/r/f"},
+		{name: "missing", target: "/o/r/f"},
+		{name: "wrong query key", target: "/o/r/f?key=wrong"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+
+		err := a.Authenticate(r)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, errUnauthorized) {
+			t.Errorf("%s: got %v, want errUnauthorized", tt.name, err)
+		}
+		if r.URL.Query().Has("key") {
+			t.Errorf("%s: key query parameter was not stripped", tt.name)
+		}
+	}
+}
+
+func TestStaticAuthenticatorIgnoresQueryKeyWhenDisabled(t *testing.T) {
+	setForTest(t, allowQueryKey, false)
+	a := &staticAuthenticator{token: []byte("secret")}
+
+	r := httptest.NewRequest(http.MethodGet, "/o/r/f?key=secret", nil)
+	if err := a.Authenticate(r); !errors.Is(err, errUnauthorized) {
+		t.Errorf("got %v, want errUnauthorized", err)
+	}
+}
+
+func TestJWKSAuthenticator(t *testing.T) {
+	key := newTestRSAKey(t)
+	other := newTestRSAKey(t)
+	_, server := newTestJWKS(t, map[string]*rsa.PrivateKey{"k1": key})
+
+	a := &jwksAuthenticator{url: server.URL, issuer: "issuer", audience: "proxy", client: server.Client()}
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "issuer",
+			"aud": "proxy",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := valid()
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{name: "valid", token: signTestJWT(t, jwt.SigningMethodRS256, "k1", key, valid()), ok: true},
+		{name: "RS512", token: signTestJWT(t, jwt.SigningMethodRS512, "k1", key, valid()), ok: true},
+		{name: "expired", token: signTestJWT(t, jwt.SigningMethodRS256, "k1", key, with("exp", time.Now().Add(-time.Minute).Unix()))},
+		{name: "not yet valid", token: signTestJWT(t, jwt.SigningMethodRS256, "k1", key, with("nbf", time.Now().Add(time.Hour).Unix()))},
+		{name: "wrong issuer", token: signTestJWT(t, jwt.SigningMethodRS256, "k1", key, with("iss", "someone-else"))},
+		{name: "wrong audience", token: signTestJWT(t, jwt.SigningMethodRS256, "k1", key, with("aud", "another-service"))},
+		{name: "wrong key", token: signTestJWT(t, jwt.SigningMethodRS256, "k1", other, valid())},
+		{name: "unknown kid", token: signTestJWT(t, jwt.SigningMethodRS256, "k2", key, valid())},
+		{name: "HMAC with public key", token: signTestJWT(t, jwt.SigningMethodHS256, "k1", key.N.Bytes(), valid())},
+		{name: "garbage", token: "not.a.jwt"},
+	}
+
+	for _, tt := range tests {
+		err := a.Authenticate(bearerRequest(tt.token))
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, errUnauthorized) {
+			t.Errorf("%s: got %v, want errUnauthorized", tt.name, err)
+		}
+	}
+
+	if err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/o/r/f", nil)); !errors.Is(err, errUnauthorized) {
+		t.Errorf("no token: got %v, want errUnauthorized", err)
+	}
+}
+
+func TestJWKSAuthenticatorKeyRotation(t *testing.T) {
+	oldKey := newTestRSAKey(t)
+	newKey := newTestRSAKey(t)
+	jwks, server := newTestJWKS(t, map[string]*rsa.PrivateKey{"old": oldKey})
+
+	a := &jwksAuthenticator{url: server.URL, client: server.Client()}
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+
+	if err := a.Authenticate(bearerRequest(signTestJWT(t, jwt.SigningMethodRS256, "old", oldKey, claims))); err != nil {
+		t.Fatalf("old key: %v", err)
+	}
+
+	// the issuer rotates to a new key
+	jwks.keys.Store(map[string]*rsa.PrivateKey{"new": newKey})
+	rotated := signTestJWT(t, jwt.SigningMethodRS256, "new", newKey, claims)
+
+	// unknown kids don't refetch the key set more than once a minute
+	if err := a.Authenticate(bearerRequest(rotated)); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("new key right after fetch: got %v, want errUnauthorized", err)
+	}
+	if got := jwks.fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1", got)
+	}
+
+	a.mu.Lock()
+	a.fetched = time.Now().Add(-2 * time.Minute)
+	a.mu.Unlock()
+
+	if err := a.Authenticate(bearerRequest(rotated)); err != nil {
+		t.Fatalf("new key after rotation: %v", err)
+	}
+	if got := jwks.fetches.Load(); got != 2 {
+		t.Fatalf("fetches = %d, want 2", got)
+	}
+
+	// the old key is no longer in the set
+	if err := a.Authenticate(bearerRequest(signTestJWT(t, jwt.SigningMethodRS256, "old", oldKey, claims))); !errors.Is(err, errUnauthorized) {
+		t.Errorf("old key after rotation: got %v, want errUnauthorized", err)
+	}
+}
+
+func TestJWKSAuthenticatorRefreshesStaleKeys(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks, server := newTestJWKS(t, map[string]*rsa.PrivateKey{"k1": key})
+
+	a := &jwksAuthenticator{url: server.URL, client: server.Client()}
+	token := signTestJWT(t, jwt.SigningMethodRS256, "k1", key, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+
+	for i := 0; i < 3; i++ {
+		if err := a.Authenticate(bearerRequest(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := jwks.fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1", got)
+	}
+
+	a.mu.Lock()
+	a.fetched = time.Now().Add(-jwksRefreshInterval - time.Minute)
+	a.mu.Unlock()
+
+	if err := a.Authenticate(bearerRequest(token)); err != nil {
+		t.Fatal(err)
+	}
+	if got := jwks.fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+}
+
+func TestJWKSAuthenticatorUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	key := newTestRSAKey(t)
+	a := &jwksAuthenticator{url: server.URL, client: server.Client()}
+	token := signTestJWT(t, jwt.SigningMethodRS256, "k1", key, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+
+	if err := a.Authenticate(bearerRequest(token)); !errors.Is(err, errUnauthorized) {
+		t.Errorf("got %v, want errUnauthorized", err)
+	}
+}
+
+func TestQueryKeyAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowQueryKey bool
+		target        string
+		header        string
+		want          int
+	}{
+		{name: "enabled, valid key", allowQueryKey: true, target: "/owner/repo/file.txt?key=secret", want: http.StatusOK},
+		{name: "enabled, wrong key", allowQueryKey: true, target: "/owner/repo/file.txt?key=wrong", want: http.StatusUnauthorized},
+		{name: "enabled, no key", allowQueryKey: true, target: "/owner/repo/file.txt", want: http.StatusUnauthorized},
+		{name: "enabled, header", allowQueryKey: true, target: "/owner/repo/file.txt", header: "Bearer secret", want: http.StatusOK},
+		{name: "disabled, valid key", target: "/owner/repo/file.txt?key=secret", want: http.StatusUnauthorized},
+		{name: "disabled, header", target: "/owner/repo/file.txt", header: "Bearer secret", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh, handler := newTestProxy(t)
+			gh.setFile("owner", "repo", "file.txt", "content")
+			setForTest(t, allowQueryKey, tt.allowQueryKey)
+			setForTest(t, &authenticator, Authenticator(&staticAuthenticator{token: []byte("secret")}))
+
+			setForTest(t, &redactParams, parseRedactParams(*redactFlag))
+
+			// the key must appear in neither the log nor the access log
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			accessLog.SetOutput(&logged)
+			t.Cleanup(func() {
+				log.SetOutput(io.Discard)
+				accessLog.SetOutput(io.Discard)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			resp := serve(logAccess(handler), req)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+
+			if tt.want == http.StatusUnauthorized {
+				if got := resp.Header.Get("WWW-Authenticate"); got != "Bearer" {
+					t.Errorf("WWW-Authenticate = %q, want Bearer", got)
+				}
+				if n := gh.count("/repos/"); n != 0 {
+					t.Errorf("%d requests sent to GitHub for an unauthorized request", n)
+				}
+			} else if upstream := gh.lastRequest("/repos/owner/repo/contents/"); upstream.URL.Query().Has("key") {
+				t.Errorf("key sent to GitHub: %s", upstream.URL)
+			}
+
+			if strings.Contains(logged.String(), "secret") {
+				t.Errorf("key logged:\n%s", logged.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// runCheck obtains an installation token for each registered app, printing
+// whether each succeeded, and reports whether all did. It backs -check, which
+// verifies the configuration and credentials without starting the server.
+func runCheck() bool {
+	ok := true
+	for _, name := range appNames() {
+		if _, err := apps[name].getInstallationToken(); err != nil {
+			fmt.Printf("app %s: FAILED: %v\n", name, err)
+			ok = false
+			continue
+		}
+
+		fmt.Printf("app %s: ok\n", name)
+	}
+
+	if !ok {
+		fmt.Println("check failed")
+		return false
+	}
+
+	fmt.Println("check passed")
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunCheck(t *testing.T) {
+	gh, _ := newTestProxy(t)
+	setForTest(t, maxRetries, 0)
+
+	other := newTestApp(t, "other", "2", "other")
+	if err := registerApp(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// GitHub refuses tokens for the other app's installation
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/app/installations/2/") {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	var ok bool
+	output := captureStdout(t, func() { ok = runCheck() })
+	if ok {
+		t.Error("runCheck passed with an app that can't obtain a token")
+	}
+	for _, want := range []string{"app default: ok\n", "app other: FAILED: ", "check failed\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output = %q, want %q", output, want)
+		}
+	}
+
+	// once every app obtains a token, the check passes
+	setForTest(t, &githubAPIURL, gh.URL)
+	output = captureStdout(t, func() { ok = runCheck() })
+	if !ok {
+		t.Error("runCheck failed with every app obtaining a token")
+	}
+	if want := "app default: ok\napp other: ok\ncheck passed\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+// captureStdout returns what f writes to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressEncodings are the supported content codings, most preferred first.
+var compressEncodings = []string{"br", "gzip"}
+
+// compress wraps next, compressing compressible responses with the best
+// encoding the client accepts: brotli, then gzip, otherwise identity.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+		}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the preferred supported encoding allowed by an
+// Accept-Encoding header, or "" for identity.
+func negotiateEncoding(header string) string {
+	for _, encoding := range compressEncodings {
+		if acceptsEncoding(header, encoding) {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding,
+// either by name or through a "*" wildcard.
+func acceptsEncoding(header, encoding string) bool {
+	accepted := parseAcceptEncoding(header)
+
+	q, ok := accepted[encoding]
+	if !ok {
+		q, ok = accepted["*"]
+	}
+
+	return ok && q > 0
+}
+
+// parseAcceptEncoding returns the quality value of each encoding named in an
+// Accept-Encoding header.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			} else {
+				q = 0
+			}
+		}
+		accepted[name] = q
+	}
+
+	return accepted
+}
+
+// gunzip decompresses gzipped content, failing rather than decompressing more
+// than limit bytes so that a small decompression bomb can't exhaust memory.
+func gunzip(content []byte, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	defer zr.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	if int64(len(decompressed)) > limit {
+		return nil, fmt.Errorf("decompressed content exceeds %d bytes", limit)
+	}
+
+	return decompressed, nil
+}
+
+// isCompressible reports whether responses of contentType benefit from compression.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm":
+		return true
+	}
+
+	return false
+}
+
+// compressWriter compresses the response body once the response headers show
+// it to be a successful, compressible and not already encoded response.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	encoder  io.WriteCloser
+	decided  bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.decided {
+		c.decide(status)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.encoder != nil {
+		return c.encoder.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Close flushes and closes the encoder, if one was used.
+func (c *compressWriter) Close() error {
+	if c.encoder == nil {
+		return nil
+	}
+
+	return c.encoder.Close()
+}
+
+// decide chooses whether to compress the response and sets its headers to match.
+func (c *compressWriter) decide(status int) {
+	c.decided = true
+
+	h := c.Header()
+
+	// a 304 no longer shows whether the response would be compressed, so its
+	// ETag is weakened whenever it might have been, to match the 200
+	if status == http.StatusNotModified && c.encoding != "" {
+		weakenETag(h)
+	}
+
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || !isCompressible(h.Get("Content-Type")) {
+		return
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+	if c.encoding == "" {
+		return
+	}
+
+	h.Set("Content-Encoding", c.encoding)
+	h.Del("Content-Length")
+
+	// a strong ETag identifies the identity bytes, not the compressed ones
+	weakenETag(h)
+
+	switch c.encoding {
+	case "br":
+		c.encoder = brotli.NewWriter(c.ResponseWriter)
+	case "gzip":
+		c.encoder = gzip.NewWriter(c.ResponseWriter)
+	}
+}
+
+// weakenETag makes a strong ETag in h weak, so that it still matches the
+// identity response in If-None-Match but never identifies different bytes.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
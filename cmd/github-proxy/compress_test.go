@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressedResponseHeaders(t *testing.T) {
+	content := strings.Repeat("hello, world\n", 100)
+	handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(content))
+	}))
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		etag           string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"br", "br", `W/"abc"`, func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+		{"gzip", "gzip", `W/"abc"`, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"", "", `"abc"`, func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		resp := serve(handler, req)
+
+		if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", tt.acceptEncoding, got, tt.encoding)
+		}
+		if got := resp.Header.Get("ETag"); got != tt.etag {
+			t.Errorf("Accept-Encoding %q: ETag = %q, want %q", tt.acceptEncoding, got, tt.etag)
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q, want Accept-Encoding", tt.acceptEncoding, got)
+		}
+		if got := resp.Header.Get("Content-Length"); (got != "") != (tt.encoding == "") {
+			t.Errorf("Accept-Encoding %q: Content-Length = %q", tt.acceptEncoding, got)
+		}
+
+		r, err := tt.decode(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, []byte(content)) {
+			t.Errorf("Accept-Encoding %q: body doesn't decode to the content: %v", tt.acceptEncoding, err)
+		}
+
+		// the ETag served revalidates the same representation
+		req.Header.Set("If-None-Match", tt.etag)
+		resp = serve(handler, req)
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("Accept-Encoding %q: revalidation status = %d, want 304", tt.acceptEncoding, resp.StatusCode)
+		}
+		if got := resp.Header.Get("ETag"); got != tt.etag {
+			t.Errorf("Accept-Encoding %q: 304 ETag = %q, want %q", tt.acceptEncoding, got, tt.etag)
+		}
+	}
+}
+
+func TestGunzipLimit(t *testing.T) {
+	compressed := func(n int) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zeros := make([]byte, 1<<20)
+		for ; n > 0; n -= len(zeros) {
+			zw.Write(zeros[:min(n, len(zeros))])
+		}
+		zw.Close()
+		return b.Bytes()
+	}
+
+	if content, err := gunzip(compressed(1000), 1000); err != nil || len(content) != 1000 {
+		t.Errorf("content at the limit: %d bytes, %v; want 1000 bytes", len(content), err)
+	}
+	if _, err := gunzip(compressed(1001), 1000); err == nil {
+		t.Error("content over the limit decompressed")
+	}
+
+	// a decompression bomb is abandoned once it passes the limit, rather than
+	// decompressed in full
+	bomb := compressed(256 << 20)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := gunzip(bomb, 1<<20); err == nil {
+		t.Error("decompression bomb decompressed")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("%d bytes allocated decompressing a bomb with a 1MiB limit", allocated)
+	}
+}
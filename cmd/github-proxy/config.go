@@ -1,21 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"os"
+	"path"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/api"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	privateKey *rsa.PrivateKey
+	repoRoots     map[string]string
+	allowedHosts  map[string]bool
+	allowedParams map[string]bool
+
+	// usedVault is set if any private key was retrieved from Vault.
+	usedVault bool
 )
 
 // validateBindAddr validates the bind address to ensure it's a valid TCP address.
@@ -41,6 +56,251 @@ func validateBindAddr(addr string) error {
 	return nil
 }
 
+// validateRepoRoot ensures a repo root is a plain relative directory.
+func validateRepoRoot(root string) error {
+	for _, elem := range strings.Split(root, "/") {
+		if elem == "." || elem == ".." {
+			return fmt.Errorf("invalid repo root: %s", root)
+		}
+	}
+
+	return nil
+}
+
+// parseRepoRoots parses a comma-separated list of owner/repo=dir pairs.
+func parseRepoRoots(s string) (map[string]string, error) {
+	roots := make(map[string]string)
+	if s == "" {
+		return roots, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		repo, root, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || strings.Count(repo, "/") != 1 {
+			return nil, fmt.Errorf("invalid repo root mapping: %s", pair)
+		}
+
+		if err := validateRepoRoot(root); err != nil {
+			return nil, err
+		}
+
+		roots[strings.ToLower(repo)] = root
+	}
+
+	return roots, nil
+}
+
+// parseAllowedHosts parses a comma-separated list of Host header values, which
+// are matched case-insensitively.
+func parseAllowedHosts(s string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+
+	return hosts
+}
+
+// parseAllowedParams parses a comma-separated list of query parameter names.
+// The auth token parameter is allowed whenever -allow-query-key is set.
+func parseAllowedParams(s string) map[string]bool {
+	params := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			params[name] = true
+		}
+	}
+
+	if len(params) > 0 && *allowQueryKey {
+		params["key"] = true
+	}
+
+	return params
+}
+
+// Config is the contents of a -config file, setting options by flag name.
+// YAML and JSON files are accepted, JSON being a subset of YAML. A nil field
+// leaves its flag at its default or command line value. String options are
+// kept exactly as written, rather than as YAML would type them: 2022-11-28
+// rather than a date, or 1e7 rather than a float.
+type Config struct {
+	AccessLogFile         *string        `yaml:"access-log-file" json:"access-log-file"`
+	AdminToken            *string        `yaml:"admin-token" json:"admin-token"`
+	AllowQueryKey         *bool          `yaml:"allow-query-key" json:"allow-query-key"`
+	AllowRepos            *string        `yaml:"allow-repos" json:"allow-repos"`
+	AllowedHosts          *string        `yaml:"allowed-hosts" json:"allowed-hosts"`
+	AllowedParams         *string        `yaml:"allowed-params" json:"allowed-params"`
+	AllowedRefs           *string        `yaml:"allowed-refs" json:"allowed-refs"`
+	App                   []string       `yaml:"app" json:"app"`
+	AppHeader             *string        `yaml:"app-header" json:"app-header"`
+	ArchivedBehavior      *string        `yaml:"archived-behavior" json:"archived-behavior"`
+	AuthJWKSURL           *string        `yaml:"auth-jwks-url" json:"auth-jwks-url"`
+	AuthJWTAudience       *string        `yaml:"auth-jwt-audience" json:"auth-jwt-audience"`
+	AuthJWTIssuer         *string        `yaml:"auth-jwt-issuer" json:"auth-jwt-issuer"`
+	AuthMode              *string        `yaml:"auth-mode" json:"auth-mode"`
+	AuthToken             *string        `yaml:"auth-token" json:"auth-token"`
+	Bind                  *string        `yaml:"bind" json:"bind"`
+	CacheMaxBytes         *int64         `yaml:"cache-max-bytes" json:"cache-max-bytes"`
+	CacheTTL              *time.Duration `yaml:"cache-ttl" json:"cache-ttl"`
+	CacheTTLs             *string        `yaml:"cache-ttls" json:"cache-ttls"`
+	Check                 *bool          `yaml:"check" json:"check"`
+	ClientBurst           *int           `yaml:"client-burst" json:"client-burst"`
+	ClientID              *string        `yaml:"client-id" json:"client-id"`
+	ClientIPHeader        *string        `yaml:"client-ip-header" json:"client-ip-header"`
+	ClientRate            *int           `yaml:"client-rate" json:"client-rate"`
+	ClockJumpThreshold    *time.Duration `yaml:"clock-jump-threshold" json:"clock-jump-threshold"`
+	Compress              *bool          `yaml:"compress" json:"compress"`
+	ContentTypeOverrides  *string        `yaml:"content-type-overrides" json:"content-type-overrides"`
+	ContentTypePrecedence *string        `yaml:"content-type-precedence" json:"content-type-precedence"`
+	DecompressGzip        *bool          `yaml:"decompress-gzip" json:"decompress-gzip"`
+	DefaultCacheControl   *string        `yaml:"default-cache-control" json:"default-cache-control"`
+	DetectCharset         *bool          `yaml:"detect-charset" json:"detect-charset"`
+	EchoGitHubRequestID   *bool          `yaml:"echo-github-request-id" json:"echo-github-request-id"`
+	EmptyPathBehavior     *string        `yaml:"empty-path-behavior" json:"empty-path-behavior"`
+	FailClosed            *bool          `yaml:"fail-closed" json:"fail-closed"`
+	ForwardConditional    *bool          `yaml:"forward-conditional" json:"forward-conditional"`
+	GitHubAPIURL          *string        `yaml:"github-api-url" json:"github-api-url"`
+	GitHubAPIVersion      *string        `yaml:"github-api-version" json:"github-api-version"`
+	GitHubTimeout         *time.Duration `yaml:"github-timeout" json:"github-timeout"`
+	InstallationID        *string        `yaml:"installation-id" json:"installation-id"`
+	Installations         *string        `yaml:"installations" json:"installations"`
+	LogRateLimits         *bool          `yaml:"log-rate-limits" json:"log-rate-limits"`
+	MaxConnsPerHost       *int           `yaml:"max-conns-per-host" json:"max-conns-per-host"`
+	MaxDecompressedSize   *int64         `yaml:"max-decompressed-size" json:"max-decompressed-size"`
+	MaxJSONSize           *int64         `yaml:"max-json-size" json:"max-json-size"`
+	MaxRetries            *int           `yaml:"max-retries" json:"max-retries"`
+	MaxTokenRefreshes     *int           `yaml:"max-token-refreshes" json:"max-token-refreshes"`
+	MaxTrackedRepos       *int           `yaml:"max-tracked-repos" json:"max-tracked-repos"`
+	MetricsBind           *string        `yaml:"metrics-bind" json:"metrics-bind"`
+	NoSniffRepos          *string        `yaml:"no-sniff-repos" json:"no-sniff-repos"`
+	PathRateLimits        *string        `yaml:"path-rate-limits" json:"path-rate-limits"`
+	PrivateKey            *string        `yaml:"private-key" json:"private-key"`
+	ReadinessGrace        *time.Duration `yaml:"readiness-grace" json:"readiness-grace"`
+	RedactParams          *string        `yaml:"redact-params" json:"redact-params"`
+	RedirectHTTP          *bool          `yaml:"redirect-http" json:"redirect-http"`
+	RejectGetBody         *bool          `yaml:"reject-get-body" json:"reject-get-body"`
+	RelayETag             *bool          `yaml:"relay-etag" json:"relay-etag"`
+	RepoBurst             *int           `yaml:"repo-burst" json:"repo-burst"`
+	RepoIndex             *bool          `yaml:"repo-index" json:"repo-index"`
+	RepoIndexFile         *string        `yaml:"repo-index-file" json:"repo-index-file"`
+	RepoInfoTTL           *time.Duration `yaml:"repo-info-ttl" json:"repo-info-ttl"`
+	RepoRate              *int           `yaml:"repo-rate" json:"repo-rate"`
+	RepoRoot              *string        `yaml:"repo-root" json:"repo-root"`
+	RepoRoots             *string        `yaml:"repo-roots" json:"repo-roots"`
+	RequestTimeout        *time.Duration `yaml:"request-timeout" json:"request-timeout"`
+	RetryBudget           *int           `yaml:"retry-budget" json:"retry-budget"`
+	RootBehavior          *string        `yaml:"root-behavior" json:"root-behavior"`
+	RootIndexFile         *string        `yaml:"root-index-file" json:"root-index-file"`
+	RootRedirectURL       *string        `yaml:"root-redirect-url" json:"root-redirect-url"`
+	ServeStaleOnError     *time.Duration `yaml:"serve-stale-on-error" json:"serve-stale-on-error"`
+	ServerTiming          *bool          `yaml:"server-timing" json:"server-timing"`
+	ShedBelow             *int           `yaml:"shed-below" json:"shed-below"`
+	ShutdownTimeout       *time.Duration `yaml:"shutdown-timeout" json:"shutdown-timeout"`
+	SigningKey            *string        `yaml:"signing-key" json:"signing-key"`
+	Sitemap               *bool          `yaml:"sitemap" json:"sitemap"`
+	SitemapTTL            *time.Duration `yaml:"sitemap-ttl" json:"sitemap-ttl"`
+	StreamThreshold       *int64         `yaml:"stream-threshold" json:"stream-threshold"`
+	StrictKeySource       *bool          `yaml:"strict-key-source" json:"strict-key-source"`
+	StrictPaths           *bool          `yaml:"strict-paths" json:"strict-paths"`
+	SymlinkBehavior       *string        `yaml:"symlink-behavior" json:"symlink-behavior"`
+	TLSCert               *string        `yaml:"tls-cert" json:"tls-cert"`
+	TLSKey                *string        `yaml:"tls-key" json:"tls-key"`
+	TLSMinVersion         *string        `yaml:"tls-min-version" json:"tls-min-version"`
+	TLSRedirect           *string        `yaml:"tls-redirect" json:"tls-redirect"`
+	TokenFailureBehavior  *string        `yaml:"token-failure-behavior" json:"token-failure-behavior"`
+	TokenPermissions      *string        `yaml:"token-permissions" json:"token-permissions"`
+	TrustedProxies        *string        `yaml:"trusted-proxies" json:"trusted-proxies"`
+	UnknownParams         *string        `yaml:"unknown-params" json:"unknown-params"`
+	UseVault              *bool          `yaml:"use-vault" json:"use-vault"`
+	VerboseErrors         *bool          `yaml:"verbose-errors" json:"verbose-errors"`
+	WebhookSecret         *string        `yaml:"webhook-secret" json:"webhook-secret"`
+}
+
+// loadConfig reads and parses the config file at path. Unknown options and
+// values of the wrong type are rejected.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// a null value would silently leave its option unset
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := checkConfigNulls(&doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// checkConfigNulls returns an error if any option in the config file document
+// doc, or item of a list option, is null.
+func checkConfigNulls(doc *yaml.Node) error {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+
+	options := doc.Content[0].Content
+	for i := 0; i+1 < len(options); i += 2 {
+		values := []*yaml.Node{options[i+1]}
+		if options[i+1].Kind == yaml.SequenceNode {
+			values = options[i+1].Content
+		}
+
+		for _, value := range values {
+			if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+				return fmt.Errorf("option %s on line %d has no value", options[i].Value, value.Line)
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply sets the flags of fs not set on the command line from the config file.
+func (c *Config) apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		if set[name] || v.Field(i).IsNil() {
+			continue
+		}
+
+		for _, value := range configValues(v.Field(i)) {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for option %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configValues returns the flag values of a Config field: the items of a
+// list, or else the value the field points to.
+func configValues(field reflect.Value) []string {
+	if field.Kind() == reflect.Slice {
+		return field.Interface().([]string)
+	}
+
+	return []string{fmt.Sprint(field.Elem().Interface())}
+}
+
 // parseFlags() parse startup flags and returns an error if any required flags are missing
 func parseFlags(ctx context.Context) error {
 	flag.Parse()
@@ -50,10 +310,245 @@ func parseFlags(ctx context.Context) error {
 		return versionCheckErr
 	}
 
+	// flags on the command line take precedence over the config file
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.apply(flag.CommandLine); err != nil {
+			return err
+		}
+	}
+
 	if err := validateBindAddr(*bindAddr); err != nil {
 		return fmt.Errorf("invalid bind address: %s", *bindAddr)
 	}
 
+	redactParams = parseRedactParams(*redactFlag)
+
+	auth, err := newAuthenticator(*authMode)
+	if err != nil {
+		return err
+	}
+	authenticator = auth
+
+	if contentTypePrecedence, err = parseContentTypePrecedence(*ctPrecedence); err != nil {
+		return err
+	}
+
+	if contentTypeOverrides, err = parseContentTypeOverrides(*ctOverrides); err != nil {
+		return err
+	}
+
+	if err := validateRepoRoot(*repoRoot); err != nil {
+		return err
+	}
+
+	roots, err := parseRepoRoots(*repoRootsFlag)
+	if err != nil {
+		return err
+	}
+	repoRoots = roots
+	allowedHosts = parseAllowedHosts(*allowedHostsFlag)
+	allowedParams = parseAllowedParams(*allowedParamsFlag)
+
+	switch *unknownParams {
+	case "reject", "strip":
+	default:
+		return fmt.Errorf("invalid unknown params behavior: %s", *unknownParams)
+	}
+
+	if allowedRefs, err = parseAllowedRefs(*allowedRefsFlag); err != nil {
+		return err
+	}
+
+	if allowedRepos, err = parseRepoPatterns(*allowReposFlag); err != nil {
+		return fmt.Errorf("invalid allowed repos: %w", err)
+	}
+
+	if noSniffRepos, err = parseRepoPatterns(*noSniffReposFlag); err != nil {
+		return fmt.Errorf("invalid no-sniff repos: %w", err)
+	}
+
+	if *cacheTTLFlag < 0 {
+		return fmt.Errorf("cache TTL must not be negative")
+	}
+	cacheTTL = *cacheTTLFlag
+
+	if cacheTTLs, err = parseCacheTTLs(*cacheTTLsFlag); err != nil {
+		return err
+	}
+
+	if *clientRate <= 0 || *clientBurst <= 0 {
+		return fmt.Errorf("client rate and burst must be positive")
+	}
+
+	if *repoRate < 0 || *repoBurst <= 0 {
+		return fmt.Errorf("repo rate must not be negative and repo burst must be positive")
+	}
+
+	if pathLimiters, err = parsePathRateLimits(*pathRateLimits); err != nil {
+		return err
+	}
+
+	if tokenPermissions, err = parseTokenPermissions(*tokenPermsFlag); err != nil {
+		return err
+	}
+
+	if *repoInfoTTL <= 0 {
+		return fmt.Errorf("repo info TTL must be positive")
+	}
+
+	if *clockJumpThreshold < 0 {
+		return fmt.Errorf("clock jump threshold must not be negative")
+	}
+
+	if *maxTrackedRepos <= 0 {
+		return fmt.Errorf("max tracked repos must be positive")
+	}
+	repoInfoCache = newLRUMap[repoInfoEntry](*maxTrackedRepos)
+	sitemapCache = newLRUMap[sitemapEntry](*maxTrackedRepos)
+	repoLimiters = newLRUMap[*clientLimiter](*maxTrackedRepos)
+
+	if *shutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive")
+	}
+
+	if *maxDecompressed <= 0 {
+		return fmt.Errorf("max decompressed size must be positive")
+	}
+
+	switch *archivedBehavior {
+	case "serve", "warn", "block":
+	default:
+		return fmt.Errorf("invalid archived behavior: %s", *archivedBehavior)
+	}
+
+	if trustedProxies, err = parseTrustedProxies(*trustedProxiesFlag); err != nil {
+		return err
+	}
+
+	switch *clientIPHeader {
+	case "x-real-ip", "x-forwarded-for":
+	default:
+		return fmt.Errorf("invalid client IP header: %s", *clientIPHeader)
+	}
+
+	// -repo-index predates -empty-path-behavior, and is shorthand for its repo-index
+	if *repoIndexEnabled {
+		if *emptyPathBehavior != "listing" && *emptyPathBehavior != "repo-index" {
+			return fmt.Errorf("repo index conflicts with empty path behavior: %s", *emptyPathBehavior)
+		}
+		*emptyPathBehavior = "repo-index"
+	}
+
+	switch *emptyPathBehavior {
+	case "listing", "index", "repo-index", "reject":
+	default:
+		return fmt.Errorf("invalid empty path behavior: %s", *emptyPathBehavior)
+	}
+
+	if *repoIndexFile == "" || path.IsAbs(*repoIndexFile) {
+		return fmt.Errorf("invalid repo index file: %s", *repoIndexFile)
+	}
+
+	switch *symlinkBehavior {
+	case "target", "follow":
+	default:
+		return fmt.Errorf("invalid symlink behavior: %s", *symlinkBehavior)
+	}
+
+	switch *tokenFailureBehavior {
+	case "error", "unavailable", "serve-stale":
+	default:
+		return fmt.Errorf("invalid token failure behavior: %s", *tokenFailureBehavior)
+	}
+
+	switch *rootBehavior {
+	case "404":
+	case "redirect":
+		if *rootRedirectURL == "" {
+			return fmt.Errorf("root redirect URL is required to redirect the root path")
+		}
+	case "index":
+		if *rootIndexFile == "" {
+			return fmt.Errorf("root index file is required to serve an index at the root path")
+		}
+	default:
+		return fmt.Errorf("invalid root behavior: %s", *rootBehavior)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("TLS certificate and key must be provided together")
+	}
+
+	if *tlsRedirect != "" {
+		if *tlsCert == "" {
+			return fmt.Errorf("TLS redirect requires a TLS certificate")
+		}
+
+		if err := validateBindAddr(*tlsRedirect); err != nil {
+			return fmt.Errorf("invalid TLS redirect address: %s", *tlsRedirect)
+		}
+	}
+
+	if _, ok := tlsVersions[*tlsMinVersion]; !ok {
+		return fmt.Errorf("unsupported TLS version: %s", *tlsMinVersion)
+	}
+
+	if err := setGitHubAPIURL(*githubAPIURLFlag); err != nil {
+		return err
+	}
+
+	if *shedBelow < 0 {
+		return fmt.Errorf("shed threshold must not be negative")
+	}
+
+	if *requestTimeout < 0 {
+		return fmt.Errorf("request timeout must not be negative")
+	}
+
+	if *streamThreshold < 0 {
+		return fmt.Errorf("stream threshold must not be negative")
+	}
+
+	if *maxJSONSize <= 0 {
+		return fmt.Errorf("max JSON size must be positive")
+	}
+
+	if *maxRetries < 0 {
+		return fmt.Errorf("max retries must not be negative")
+	}
+
+	if *maxConnsHost < 0 {
+		return fmt.Errorf("max conns per host must not be negative")
+	}
+	if *githubTimeout < 0 {
+		return fmt.Errorf("GitHub timeout must not be negative")
+	}
+
+	githubClient = newGitHubClient(*maxConnsHost, *githubTimeout)
+	streamClient = newStreamClient(*maxConnsHost, *githubTimeout)
+
+	if *cacheMaxBytes < 0 {
+		return fmt.Errorf("cache max bytes must not be negative")
+	}
+
+	if *maxTokenRefreshes <= 0 {
+		return fmt.Errorf("max token refreshes must be positive")
+	}
+	tokenRefreshes = make(chan struct{}, *maxTokenRefreshes)
+
+	if *retryBudgetFlag < 0 {
+		return fmt.Errorf("retry budget must not be negative")
+	}
+	retries = nil
+	if *retryBudgetFlag > 0 {
+		retries = newRetryBudget(*retryBudgetFlag)
+	}
+
 	if *clientID == "" {
 		return fmt.Errorf("client ID is required")
 	}
@@ -67,12 +562,105 @@ func parseFlags(ctx context.Context) error {
 		return err
 	}
 
-	privateKey = key
+	defaultApp = &githubApp{name: "default", clientID: *clientID, installationID: *installationID, privateKey: key}
+	if err := registerApp(defaultApp); err != nil {
+		return err
+	}
+
+	installations, err := parseInstallations(*installationsFlag)
+	if err != nil {
+		return err
+	}
+
+	for owner, id := range installations {
+		// other installations of the default app, each serving its own owner
+		app := &githubApp{name: owner, clientID: *clientID, installationID: id, privateKey: key, owners: []string{owner}}
+		if err := registerApp(app); err != nil {
+			return err
+		}
+	}
+
+	for _, spec := range *appSpecs {
+		app, err := parseAppSpec(ctx, spec)
+		if err != nil {
+			return err
+		}
+
+		if err := registerApp(app); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// parseAppSpec parses an -app flag value of comma-separated key=value fields
+// (name, client-id, installation-id, private-key and owners) and loads the
+// app's private key.
+func parseAppSpec(ctx context.Context, spec string) (*githubApp, error) {
+	app := &githubApp{}
+
+	var keySource string
+	for _, field := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid GitHub App field: %s", field)
+		}
+
+		switch name {
+		case "name":
+			app.name = value
+		case "client-id":
+			app.clientID = value
+		case "installation-id":
+			app.installationID = value
+		case "private-key":
+			keySource = value
+		case "owners":
+			for _, owner := range strings.Split(value, ";") {
+				if owner = strings.TrimSpace(owner); owner != "" {
+					app.owners = append(app.owners, owner)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown GitHub App field: %s", name)
+		}
+	}
+
+	if app.name == "" || app.clientID == "" || app.installationID == "" || keySource == "" {
+		return nil, fmt.Errorf("GitHub App %q requires a name, client-id, installation-id and private-key", app.name)
+	}
+
+	key, err := loadPrivateKey(ctx, keySource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key for GitHub App %s: %w", app.name, err)
+	}
+	app.privateKey = key
+
+	return app, nil
+}
+
+// loadPrivateKey loads a private key from source, which is either
+// vault:<mount-point>/<path>[:<field>], env:<variable> or a file path.
+func loadPrivateKey(ctx context.Context, source string) (crypto.Signer, error) {
+	if vaultPath, ok := strings.CutPrefix(source, "vault:"); ok {
+		path, key, _ := strings.Cut(vaultPath, ":")
+		return retrievePrivateKeyFromVault(ctx, path, key)
+	}
+
+	if varName, ok := strings.CutPrefix(source, "env:"); ok {
+		return getPrivateKeyFromEnv(varName)
+	}
+
+	return loadPrivateKeyFromFile(source)
+}
+
 // RetrieveGithubPrivateKey() returns the private key for the GitHub App.
-func RetrieveGithubPrivateKey(ctx context.Context) (*rsa.PrivateKey, error) {
+func RetrieveGithubPrivateKey(ctx context.Context) (crypto.Signer, error) {
+	if err := checkKeySourceConflicts(); err != nil {
+		return nil, err
+	}
+
 	switch {
 	case *useVault:
 		path, key, _ := strings.Cut(*privateKeyPath, ":")
@@ -88,23 +676,77 @@ func RetrieveGithubPrivateKey(ctx context.Context) (*rsa.PrivateKey, error) {
 	return nil, fmt.Errorf("no private key source found")
 }
 
-// ParsePrivateKey parses and returns a PEM encoded RSA private key.
-func parsePrivateKey(keyBytes []byte) (*rsa.PrivateKey, error) {
+// checkKeySourceConflicts warns when more than one private key source is configured,
+// or returns an error if -strict-key-source is set.
+func checkKeySourceConflicts() error {
+	var sources []string
+	switch {
+	case *useVault:
+		sources = append(sources, "vault")
+	case *privateKeyPath != "":
+		sources = append(sources, "file")
+	}
+
+	if os.Getenv("GH_PRIVATE_KEY") != "" {
+		sources = append(sources, "GH_PRIVATE_KEY")
+	}
+
+	if len(sources) < 2 {
+		return nil
+	}
+
+	if *strictKeySrc {
+		return fmt.Errorf("multiple private key sources configured: %s", strings.Join(sources, ", "))
+	}
+
+	log.Printf("warning: multiple private key sources configured (%s); using %s\n", strings.Join(sources, ", "), sources[0])
+	return nil
+}
+
+// ParsePrivateKey parses and returns a PEM encoded RSA or EC private key, in
+// PKCS#1 ("RSA PRIVATE KEY"), SEC 1 ("EC PRIVATE KEY") or PKCS#8
+// ("PRIVATE KEY") form.
+func parsePrivateKey(keyBytes []byte) (crypto.Signer, error) {
 	block, _ := pem.Decode(keyBytes)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
+	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block containing private key")
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		return key, nil
+
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		return key, nil
+
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("private key is a %T, not an RSA or EC key", key)
 	}
 
-	return key, nil
+	return nil, fmt.Errorf("unsupported PEM block type for private key: %s", block.Type)
 }
 
 // LoadPrivateKeyFromFile reads the private key from a .pem file.
-func loadPrivateKeyFromFile(path string) (*rsa.PrivateKey, error) {
+func loadPrivateKeyFromFile(path string) (crypto.Signer, error) {
 	keyBytes, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read private key: %w", err)
@@ -114,7 +756,7 @@ func loadPrivateKeyFromFile(path string) (*rsa.PrivateKey, error) {
 }
 
 // RetrievePrivateKeyFromVault retrieves an RSA private key from hashicorp Vault.
-func retrievePrivateKeyFromVault(ctx context.Context, vaultPath, key string) (*rsa.PrivateKey, error) {
+func retrievePrivateKeyFromVault(ctx context.Context, vaultPath, key string) (crypto.Signer, error) {
 	if vaultPath == "" {
 		return nil, fmt.Errorf("vault path is empty")
 	}
@@ -134,6 +776,8 @@ func retrievePrivateKeyFromVault(ctx context.Context, vaultPath, key string) (*r
 		vaultPath = vaultPath[1:]
 	}
 
+	usedVault = true
+
 	mount, path, _ := strings.Cut(vaultPath, "/")
 	secret, err := client.KVv2(mount).Get(ctx, path)
 	if err != nil {
@@ -153,7 +797,7 @@ func retrievePrivateKeyFromVault(ctx context.Context, vaultPath, key string) (*r
 }
 
 // GetPrivateKeyFromEnv retrieves an RSA private key from an environment variable.
-func getPrivateKeyFromEnv(varName string) (*rsa.PrivateKey, error) {
+func getPrivateKeyFromEnv(varName string) (crypto.Signer, error) {
 	if varName == "" {
 		// default to GH_PRIVATE_KEY
 		varName = "GH_PRIVATE_KEY"
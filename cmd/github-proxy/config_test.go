@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// encodeKey returns the PEM encoding of a DER encoded private key.
+func encodeKey(t *testing.T, blockType string, der []byte, err error) []byte {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+// checkJWT parses a GitHub App JWT, checking that it is signed with alg by the
+// private key matching public and issued by clientID.
+func checkJWT(t *testing.T, token, alg string, public crypto.PublicKey, clientID string) {
+	t.Helper()
+
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
+		return public, nil
+	}, jwt.WithValidMethods([]string{alg}))
+	if err != nil {
+		t.Fatalf("JWT doesn't verify: %v", err)
+	}
+	if parsed.Method.Alg() != alg {
+		t.Errorf("JWT alg = %s, want %s", parsed.Method.Alg(), alg)
+	}
+	if claims["iss"] != clientID {
+		t.Errorf("JWT iss = %v, want %s", claims["iss"], clientID)
+	}
+}
+
+func TestParseRSAPrivateKeys(t *testing.T) {
+	key := newTestRSAKey(t)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	tests := map[string][]byte{
+		"PKCS#1": encodeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), nil),
+		"PKCS#8": encodeKey(t, "PRIVATE KEY", pkcs8, err),
+	}
+
+	for name, keyBytes := range tests {
+		parsed, err := parsePrivateKey(keyBytes)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !key.Equal(parsed) {
+			t.Fatalf("%s: parsed a different key", name)
+		}
+
+		token, err := GenerateJWT("Iv1.test", parsed, time.Minute)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkJWT(t, token, "RS256", &key.PublicKey, "Iv1.test")
+	}
+}
+
+func TestParseECPrivateKeys(t *testing.T) {
+	curves := []struct {
+		curve elliptic.Curve
+		alg   string
+	}{
+		{elliptic.P256(), "ES256"},
+		{elliptic.P384(), "ES384"},
+		{elliptic.P521(), "ES512"},
+	}
+
+	for _, c := range curves {
+		key, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sec1, sec1Err := x509.MarshalECPrivateKey(key)
+		pkcs8, pkcs8Err := x509.MarshalPKCS8PrivateKey(key)
+		encodings := map[string][]byte{
+			"SEC 1":  encodeKey(t, "EC PRIVATE KEY", sec1, sec1Err),
+			"PKCS#8": encodeKey(t, "PRIVATE KEY", pkcs8, pkcs8Err),
+		}
+
+		for name, keyBytes := range encodings {
+			parsed, err := parsePrivateKey(keyBytes)
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.alg, name, err)
+			}
+			if !key.Equal(parsed) {
+				t.Fatalf("%s %s: parsed a different key", c.alg, name)
+			}
+
+			token, err := GenerateJWT("Iv1.test", parsed, time.Minute)
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.alg, name, err)
+			}
+			checkJWT(t, token, c.alg, &key.PublicKey, "Iv1.test")
+		}
+	}
+}
+
+func TestGenerateJWTRejectsUnsupportedCurves(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GenerateJWT("Iv1.test", key, 0); err == nil {
+		t.Error("P-224 key: expected an error")
+	}
+}
+
+func TestParsePrivateKeyErrors(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPKCS8, err := x509.MarshalPKCS8PrivateKey(edKey)
+
+	tests := map[string][]byte{
+		"not PEM":              []byte("not a key"),
+		"PKCS#8 Ed25519 key":   encodeKey(t, "PRIVATE KEY", edPKCS8, err),
+		"corrupt PKCS#8":       encodeKey(t, "PRIVATE KEY", []byte("corrupt"), nil),
+		"corrupt PKCS#1":       encodeKey(t, "RSA PRIVATE KEY", []byte("corrupt"), nil),
+		"corrupt SEC 1":        encodeKey(t, "EC PRIVATE KEY", []byte("corrupt"), nil),
+		"unsupported PEM type": encodeKey(t, "PUBLIC KEY", []byte("corrupt"), nil),
+	}
+
+	for name, keyBytes := range tests {
+		if _, err := parsePrivateKey(keyBytes); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// stringList is a repeatable flag collecting its values.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// configFlags is a flag set standing in for the proxy's flags in config tests.
+type configFlags struct {
+	fs         *flag.FlagSet
+	bind       *string
+	apiVersion *string
+	authToken  *string
+	maxRetries *int
+	compress   *bool
+	timeout    *time.Duration
+	apps       stringList
+}
+
+func newConfigFlags(t *testing.T, args ...string) *configFlags {
+	t.Helper()
+
+	f := &configFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.bind = f.fs.String("bind", ":8080", "")
+	f.apiVersion = f.fs.String("github-api-version", "", "")
+	f.authToken = f.fs.String("auth-token", "", "")
+	f.maxRetries = f.fs.Int("max-retries", 3, "")
+	f.compress = f.fs.Bool("compress", false, "")
+	f.timeout = f.fs.Duration("github-timeout", time.Minute, "")
+	f.fs.String("config", "", "")
+	f.fs.Var(&f.apps, "app", "")
+
+	if err := f.fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// applyConfig writes content to a config file and applies it to f.
+func (f *configFlags) applyConfig(t *testing.T, content string) error {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	return cfg.apply(f.fs)
+}
+
+func TestKeySourceConflicts(t *testing.T) {
+	newKey := func() (*ecdsa.PrivateKey, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		return key, encodeKey(t, "EC PRIVATE KEY", der, err)
+	}
+	fileKey, filePEM := newKey()
+	envKey, envPEM := newKey()
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, filePEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		env     string
+		vault   bool
+		strict  bool
+		want    *ecdsa.PrivateKey
+		warning string
+		err     bool
+	}{
+		{name: "file only", file: path, want: fileKey},
+		{name: "env only", env: string(envPEM), want: envKey},
+		{name: "file and env", file: path, env: string(envPEM), want: fileKey, warning: "multiple private key sources configured (file, GH_PRIVATE_KEY); using file"},
+		{name: "file and env, strict", file: path, env: string(envPEM), strict: true, err: true},
+		{name: "vault and env, strict", file: "secret/app:key", env: string(envPEM), vault: true, strict: true, err: true},
+		{name: "env only, strict", env: string(envPEM), strict: true, want: envKey},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, privateKeyPath, tt.file)
+		setForTest(t, useVault, tt.vault)
+		setForTest(t, strictKeySrc, tt.strict)
+		t.Setenv("GH_PRIVATE_KEY", tt.env)
+
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		key, err := RetrieveGithubPrivateKey(context.Background())
+		log.SetOutput(io.Discard)
+
+		if tt.err {
+			if err == nil || !strings.Contains(err.Error(), "multiple private key sources") {
+				t.Errorf("%s: error = %v, want one naming the conflict", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.want.Equal(key) {
+			t.Errorf("%s: the wrong key was used", tt.name)
+		}
+		if got := logged.String(); tt.warning == "" && strings.Contains(got, "warning") || !strings.Contains(got, tt.warning) {
+			t.Errorf("%s: log = %q, want warning %q", tt.name, got, tt.warning)
+		}
+	}
+}
+
+func TestConfigValuesAreKeptAsWritten(t *testing.T) {
+	for name, content := range map[string]string{
+		"YAML": "github-api-version: 2022-11-28\nauth-token: 1e7\nmax-retries: 5\ncompress: true\ngithub-timeout: 1m30s\napp: [a, b]\n",
+		"JSON": `{"github-api-version": "2022-11-28", "auth-token": 1e7, "max-retries": 5, "compress": true, "github-timeout": "1m30s", "app": ["a", "b"]}`,
+	} {
+		f := newConfigFlags(t)
+		if err := f.applyConfig(t, content); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if *f.apiVersion != "2022-11-28" {
+			t.Errorf("%s: github-api-version = %q, want 2022-11-28", name, *f.apiVersion)
+		}
+		if *f.authToken != "1e7" {
+			t.Errorf("%s: auth-token = %q, want 1e7", name, *f.authToken)
+		}
+		if *f.maxRetries != 5 || !*f.compress || *f.timeout != 90*time.Second {
+			t.Errorf("%s: max-retries = %d, compress = %t, github-timeout = %s; want 5, true, 1m30s", name, *f.maxRetries, *f.compress, *f.timeout)
+		}
+		if f.apps.String() != "a,b" {
+			t.Errorf("%s: app = %q, want a,b", name, f.apps.String())
+		}
+	}
+}
+
+func TestConfigFlagsTakePrecedence(t *testing.T) {
+	f := newConfigFlags(t, "-bind", ":9000", "-max-retries", "0", "-app", "cli")
+	if err := f.applyConfig(t, "bind: \":9090\"\nmax-retries: 5\ngithub-api-version: 2022-11-28\napp: [config]\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if *f.bind != ":9000" || *f.maxRetries != 0 || f.apps.String() != "cli" {
+		t.Errorf("bind = %q, max-retries = %d, app = %q; want the command line's :9000, 0, cli", *f.bind, *f.maxRetries, f.apps.String())
+	}
+	if *f.apiVersion != "2022-11-28" {
+		t.Errorf("github-api-version = %q, want the config file's 2022-11-28", *f.apiVersion)
+	}
+}
+
+func TestConfigRejectsMalformedFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"invalid YAML":         "bind: [\n",
+		"invalid JSON":         `{"bind": ":9090"`,
+		"not a mapping":        "- bind\n- compress\n",
+		"unknown option":       "unknown: 1\n",
+		"config option":        "config: other.yaml\n",
+		"list for single flag": "bind: [a, b]\n",
+		"mapping value":        "bind:\n  port: 9090\n",
+		"null value":           "bind:\n",
+		"mapping in list":      "app:\n  - name: a\n",
+		"wrong type":           "max-retries: many\n",
+		"misspelled option":    "max-retires: 5\n",
+		"string for bool":      "compress: maybe\n",
+		"number for duration":  "github-timeout: 30\n",
+		"null in list":         "app:\n  - a\n  -\n",
+	} {
+		if err := newConfigFlags(t).applyConfig(t, content); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestConfigCoversEveryFlag(t *testing.T) {
+	fields := make(map[string]bool)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		fields[configType.Field(i).Tag.Get("yaml")] = true
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		// go test registers its own flags
+		if strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+
+		if f.Name != "config" && f.Name != "version" && !fields[f.Name] {
+			t.Errorf("flag %s has no Config field", f.Name)
+		}
+		delete(fields, f.Name)
+	})
+
+	for name := range fields {
+		t.Errorf("Config field %s has no flag", name)
+	}
+}
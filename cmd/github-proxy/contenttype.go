@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/net/html/charset"
+)
+
+// defaultContentType is served when no content type source identifies a file.
+const defaultContentType = "application/octet-stream"
+
+// sniffLen is how much of the start of a file content type sniffing reads.
+const sniffLen = 3072
+
+var (
+	contentTypePrecedence = []string{"override", "extension", "sniff"}
+	contentTypeOverrides  = make(map[string]string)
+)
+
+// detectContentType returns the content type for the file name with the given
+// content, trying each source in contentTypePrecedence order:
+//
+//   - override: the -content-type-overrides entry for the file extension
+//   - extension: the system MIME type registered for the file extension
+//   - sniff: the type detected from the content itself, if sniff is set
+func detectContentType(name string, content []byte, sniff bool) string {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	for _, source := range contentTypePrecedence {
+		var contentType string
+		switch source {
+		case "override":
+			contentType = contentTypeOverrides[ext]
+		case "extension":
+			contentType = mime.TypeByExtension(ext)
+		case "sniff":
+			if !sniff {
+				continue
+			}
+
+			if mtype := mimetype.Detect(content); mtype != nil && mtype.String() != defaultContentType {
+				contentType = mtype.String()
+			}
+		}
+
+		if contentType != "" {
+			return contentType
+		}
+	}
+
+	return defaultContentType
+}
+
+// withCharset appends the charset detected from the start of content to a text
+// contentType that doesn't already declare one. Detection uses any byte order
+// mark or HTML meta tag, otherwise UTF-8 if the content is valid UTF-8 and
+// windows-1252 if not.
+func withCharset(contentType string, content []byte) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "text/") || params["charset"] != "" {
+		return contentType
+	}
+
+	_, name, _ := charset.DetermineEncoding(content, contentType)
+	return contentType + "; charset=" + name
+}
+
+// parseContentTypePrecedence parses a comma-separated ordering of content type sources.
+func parseContentTypePrecedence(s string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(s, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case "override", "extension", "sniff":
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("unknown content type source: %s", source)
+		}
+	}
+
+	return sources, nil
+}
+
+// parseContentTypeOverrides parses a comma-separated list of .ext=type pairs.
+func parseContentTypeOverrides(s string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	if s == "" {
+		return overrides, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		ext, contentType, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.HasPrefix(ext, ".") || contentType == "" {
+			return nil, fmt.Errorf("invalid content type override: %s", pair)
+		}
+
+		overrides[strings.ToLower(ext)] = contentType
+	}
+
+	return overrides, nil
+}
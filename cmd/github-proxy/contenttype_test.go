@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+func TestContentTypePrecedence(t *testing.T) {
+	setForTest(t, &contentTypeOverrides, map[string]string{".json": "text/plain"})
+
+	// a file whose extension, override and content all disagree
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+
+	tests := []struct {
+		precedence string
+		name       string
+		sniff      bool
+		want       string
+	}{
+		{"override,extension,sniff", "data.json", true, "text/plain"},
+		{"extension,override,sniff", "data.json", true, "application/json"},
+		{"sniff,override,extension", "data.json", true, "image/png"},
+		{"sniff,extension", "data.json", true, "image/png"},
+
+		// sources that don't identify the file are skipped
+		{"override,extension,sniff", "data.JSON", true, "text/plain"},
+		{"override,sniff,extension", "image.unknownext", true, "image/png"},
+		{"sniff,override,extension", "data.json", false, "text/plain"},
+		{"override", "image.png", true, defaultContentType},
+		{"extension", "image.unknownext", true, defaultContentType},
+	}
+
+	for _, tt := range tests {
+		precedence, err := parseContentTypePrecedence(tt.precedence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setForTest(t, &contentTypePrecedence, precedence)
+
+		if got := detectContentType(tt.name, png, tt.sniff); got != tt.want {
+			t.Errorf("%s with %s, sniff %t: content type = %q, want %q", tt.name, tt.precedence, tt.sniff, got, tt.want)
+		}
+	}
+}
+
+func TestParseContentTypePrecedence(t *testing.T) {
+	for _, s := range []string{"", "override,,sniff", "override,magic", "Extension"} {
+		if _, err := parseContentTypePrecedence(s); err == nil {
+			t.Errorf("parseContentTypePrecedence(%q): expected an error", s)
+		}
+	}
+}
+
+func TestWithCharset(t *testing.T) {
+	tests := []struct {
+		contentType string
+		content     string
+		want        string
+	}{
+		{"text/plain", "héllo", "text/plain; charset=utf-8"},
+		{"text/plain", "h\xe9llo", "text/plain; charset=windows-1252"},
+		{"text/plain", "\xff\xfeh\x00i\x00", "text/plain; charset=utf-16le"},
+		{"text/html", "<meta charset=\"iso-8859-2\">h\xe9llo", "text/html; charset=iso-8859-2"},
+
+		// content types that declare a charset, or aren't text, are kept
+		{"text/plain; charset=iso-8859-1", "héllo", "text/plain; charset=iso-8859-1"},
+		{"application/octet-stream", "h\xe9llo", "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		if got := withCharset(tt.contentType, []byte(tt.content)); got != tt.want {
+			t.Errorf("withCharset(%q, %q) = %q, want %q", tt.contentType, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestDetectCharset(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "utf8.md", "# héllo")
+	gh.setFile("owner", "repo", "latin1.md", "# h\xe9llo")
+	setForTest(t, &contentTypeOverrides, map[string]string{".md": "text/markdown"})
+
+	tests := []struct {
+		path   string
+		detect bool
+		want   string
+	}{
+		{"/owner/repo/utf8.md", false, "text/markdown"},
+		{"/owner/repo/utf8.md", true, "text/markdown; charset=utf-8"},
+		{"/owner/repo/latin1.md", true, "text/markdown; charset=windows-1252"},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, detectCharset, tt.detect)
+
+		resp := get(handler, tt.path)
+		if got := resp.Header.Get("Content-Type"); got != tt.want {
+			t.Errorf("%s, detect %t: Content-Type = %q, want %q", tt.path, tt.detect, got, tt.want)
+		}
+	}
+}
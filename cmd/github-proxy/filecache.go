@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileCacheMaxEntries bounds the number of files kept for ETag revalidation.
+	fileCacheMaxEntries = 1000
+
+	// fileCacheMaxFileSize is the largest file kept for ETag revalidation.
+	fileCacheMaxFileSize = 1024 * 1024
+)
+
+// The file cache is content addressed: files are indexed by path and ref, but
+// their content is stored once per git blob SHA, so identical files at several
+// paths or refs share it. Blobs are reference counted, and dropped once no
+// cached file refers to them.
+var (
+	fileCache      = make(map[string]fileCacheEntry)
+	blobCache      = make(map[string]*blobEntry)
+	fileCacheMutex sync.Mutex
+
+	// fileCacheBytes is the size of the content held by the cache, counting
+	// each blob once.
+	fileCacheBytes int64
+
+	// cacheTTL is how long files are served from cache without revalidation,
+	// unless cacheTTLs has an entry for their content type.
+	cacheTTL  time.Duration
+	cacheTTLs []contentTypeTTL
+)
+
+// fileCacheEntry is a cached file and when it was last fetched or revalidated.
+// The content of files with a blob SHA is held in blobCache rather than file.
+type fileCacheEntry struct {
+	file    *FileContent
+	fetched time.Time
+}
+
+// blobEntry is the content of a git blob and the number of cached files referring to it.
+type blobEntry struct {
+	content []byte
+	refs    int
+}
+
+// contentTypeTTL is the cache TTL for content types matching pattern, e.g. image/*.
+type contentTypeTTL struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// fileCacheKey returns the key identifying a file at a ref in the file cache.
+func fileCacheKey(owner, repo, path, ref string) string {
+	return repoKey(owner, repo) + "/" + path + "@" + ref
+}
+
+// getCachedFile returns a copy of the last fetched version of a file and when
+// it was fetched, or nil.
+func getCachedFile(key string) (*FileContent, time.Time) {
+	fileCacheMutex.Lock()
+	defer fileCacheMutex.Unlock()
+
+	entry, ok := fileCache[key]
+	if !ok {
+		return nil, time.Time{}
+	}
+
+	cached := *entry.file
+	if cached.SHA != "" {
+		cached.Content = blobCache[cached.SHA].content
+	}
+
+	return &cached, entry.fetched
+}
+
+// putCachedFile keeps a copy of file so that it can be revalidated with its
+// ETag. When the cache is full, or holds more than -cache-max-bytes, arbitrary
+// entries are evicted.
+func putCachedFile(key string, file *FileContent) {
+	size := int64(len(file.Content))
+	if file.ETag == "" || size > fileCacheMaxFileSize || (*cacheMaxBytes > 0 && size > *cacheMaxBytes) {
+		return
+	}
+
+	fileCacheMutex.Lock()
+	defer fileCacheMutex.Unlock()
+	defer observeFileCache()
+
+	if _, ok := fileCache[key]; !ok && len(fileCache) >= fileCacheMaxEntries {
+		for evict := range fileCache {
+			removeCachedFile(evict)
+			break
+		}
+	}
+
+	cached := *file
+	if cached.SHA != "" {
+		blob, ok := blobCache[cached.SHA]
+		if !ok {
+			blob = &blobEntry{content: cached.Content}
+			blobCache[cached.SHA] = blob
+			fileCacheBytes += size
+		}
+		blob.refs++
+		cached.Content = nil
+	}
+
+	// release any blob of the file being replaced only after referencing the
+	// new one, which may be the same
+	removeCachedFile(key)
+	fileCache[key] = fileCacheEntry{file: &cached, fetched: time.Now()}
+	if cached.SHA == "" {
+		fileCacheBytes += size
+	}
+
+	for evict := range fileCache {
+		if *cacheMaxBytes <= 0 || fileCacheBytes <= *cacheMaxBytes {
+			break
+		}
+		if evict != key {
+			removeCachedFile(evict)
+		}
+	}
+}
+
+// removeCachedFile drops a file from the cache, along with its blob if no
+// other file refers to it. The caller must hold fileCacheMutex.
+func removeCachedFile(key string) {
+	entry, ok := fileCache[key]
+	if !ok {
+		return
+	}
+	delete(fileCache, key)
+
+	sha := entry.file.SHA
+	if sha == "" {
+		fileCacheBytes -= int64(len(entry.file.Content))
+		return
+	}
+
+	blob := blobCache[sha]
+	blob.refs--
+	if blob.refs == 0 {
+		delete(blobCache, sha)
+		fileCacheBytes -= int64(len(blob.content))
+	}
+}
+
+// observeFileCache updates the file cache gauges. The caller must hold
+// fileCacheMutex.
+func observeFileCache() {
+	fileCacheEntries.Set(float64(len(fileCache)))
+	fileCacheSize.Set(float64(fileCacheBytes))
+}
+
+// cacheTTLFor returns the cache TTL for contentType: that of the first matching
+// -cache-ttls pattern, otherwise -cache-ttl.
+func cacheTTLFor(contentType string) time.Duration {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return cacheTTL
+	}
+
+	for _, entry := range cacheTTLs {
+		if matched, _ := path.Match(entry.pattern, mediaType); matched {
+			return entry.ttl
+		}
+	}
+
+	return cacheTTL
+}
+
+// parseCacheTTLs parses comma-separated content type pattern=duration pairs,
+// such as image/*=24h.
+func parseCacheTTLs(s string) ([]contentTypeTTL, error) {
+	var ttls []contentTypeTTL
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		pattern, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.Count(pattern, "/") != 1 {
+			return nil, fmt.Errorf("invalid cache TTL: %s", pair)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid cache TTL pattern %s: %w", pattern, err)
+		}
+
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid cache TTL for %s: %s", pattern, value)
+		}
+
+		ttls = append(ttls, contentTypeTTL{pattern: strings.ToLower(pattern), ttl: ttl})
+	}
+
+	return ttls, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cachedFile returns a file to cache with content, as GitHub would serve it.
+func cachedFile(content string) *FileContent {
+	return &FileContent{Content: []byte(content), SHA: blobSHA(content), ETag: `"` + blobSHA(content) + `"`}
+}
+
+// checkCacheSize checks that fileCacheBytes and the gauges report entries files
+// of size bytes in total.
+func checkCacheSize(t *testing.T, entries int, size int64) {
+	t.Helper()
+
+	fileCacheMutex.Lock()
+	gotEntries, gotSize := len(fileCache), fileCacheBytes
+	fileCacheMutex.Unlock()
+
+	if gotEntries != entries || gotSize != size {
+		t.Errorf("cache holds %d entries of %d bytes, want %d of %d", gotEntries, gotSize, entries, size)
+	}
+	if got := testutil.ToFloat64(fileCacheEntries); got != float64(entries) {
+		t.Errorf("entries gauge = %v, want %d", got, entries)
+	}
+	if got := testutil.ToFloat64(fileCacheSize); got != float64(size) {
+		t.Errorf("bytes gauge = %v, want %d", got, size)
+	}
+}
+
+func TestFileCacheBytes(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, cacheMaxBytes, 0)
+
+	putCachedFile("a@main", cachedFile("aaaa"))
+	checkCacheSize(t, 1, 4)
+
+	// the same content at another path is stored once
+	putCachedFile("b@main", cachedFile("aaaa"))
+	checkCacheSize(t, 2, 4)
+
+	putCachedFile("c@main", cachedFile("cccccc"))
+	checkCacheSize(t, 3, 10)
+
+	// replacing a file releases its old content
+	putCachedFile("c@main", cachedFile("cc"))
+	checkCacheSize(t, 3, 6)
+
+	// files without a blob SHA are counted too
+	putCachedFile("d@main", &FileContent{Content: []byte("ddd"), ETag: `"d"`})
+	checkCacheSize(t, 4, 9)
+
+	fileCacheMutex.Lock()
+	removeCachedFile("a@main")
+	removeCachedFile("d@main")
+	observeFileCache()
+	fileCacheMutex.Unlock()
+	checkCacheSize(t, 2, 6)
+
+	fileCacheMutex.Lock()
+	removeCachedFile("b@main")
+	observeFileCache()
+	fileCacheMutex.Unlock()
+	checkCacheSize(t, 1, 2)
+}
+
+func TestFileCacheMaxBytes(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, cacheMaxBytes, 10)
+
+	putCachedFile("a@main", cachedFile(strings.Repeat("a", 4)))
+	putCachedFile("b@main", cachedFile(strings.Repeat("b", 4)))
+	checkCacheSize(t, 2, 8)
+
+	// adding a file over the limit evicts others, but never the file added
+	putCachedFile("c@main", cachedFile(strings.Repeat("c", 4)))
+	checkCacheSize(t, 2, 8)
+	if file, _ := getCachedFile("c@main"); file == nil {
+		t.Error("file just added was evicted")
+	}
+
+	// a file larger than the limit isn't cached at all
+	putCachedFile("d@main", cachedFile(strings.Repeat("d", 11)))
+	checkCacheSize(t, 2, 8)
+	if file, _ := getCachedFile("d@main"); file != nil {
+		t.Error("file larger than -cache-max-bytes was cached")
+	}
+}
+
+func TestIdenticalContentIsStoredOnce(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "a.txt", "shared")
+	gh.setFile("owner", "repo", "b.txt", "shared")
+	gh.setFile("owner", "repo", "c.txt", "other")
+	setForTest(t, cacheMaxBytes, 12)
+
+	// the same blob at two paths and two refs is stored once
+	for _, target := range []string{"/owner/repo/a.txt", "/owner/repo/b.txt", "/owner/repo/a.txt?ref=v1", "/owner/repo/b.txt?ref=v1"} {
+		if got := body(t, get(handler, target)); got != "shared" {
+			t.Fatalf("%s: body = %q, want shared", target, got)
+		}
+	}
+	checkCacheSize(t, 4, 6)
+
+	// and counted once against -cache-max-bytes, leaving room for another
+	if got := body(t, get(handler, "/owner/repo/c.txt")); got != "other" {
+		t.Fatalf("c.txt: body = %q, want other", got)
+	}
+	checkCacheSize(t, 5, 11)
+
+	// the shared content is released only with the last file using it
+	fileCacheMutex.Lock()
+	removeCachedFile(fileCacheKey("owner", "repo", "a.txt", ""))
+	removeCachedFile(fileCacheKey("owner", "repo", "b.txt", ""))
+	removeCachedFile(fileCacheKey("owner", "repo", "a.txt", "v1"))
+	observeFileCache()
+	fileCacheMutex.Unlock()
+	checkCacheSize(t, 2, 11)
+
+	fileCacheMutex.Lock()
+	removeCachedFile(fileCacheKey("owner", "repo", "b.txt", "v1"))
+	observeFileCache()
+	fileCacheMutex.Unlock()
+	checkCacheSize(t, 1, 5)
+}
+
+func TestCacheTTLs(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "logo.png", "\x89PNG\r\n\x1a\n")
+	gh.setFile("owner", "repo", "config.json", "{}")
+	gh.setFile("owner", "repo", "notes.txt", "notes")
+
+	ttls, err := parseCacheTTLs("image/*=24h, application/json=0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &cacheTTLs, ttls)
+	setForTest(t, &cacheTTL, time.Minute)
+
+	tests := []struct {
+		path         string
+		ttl          time.Duration
+		cacheControl string
+	}{
+		{"logo.png", 24 * time.Hour, "max-age=86400"},
+		{"config.json", 0, ""},
+		{"notes.txt", time.Minute, "max-age=60"},
+	}
+
+	for _, tt := range tests {
+		resp := get(handler, "/owner/repo/"+tt.path)
+		if got := cacheTTLFor(resp.Header.Get("Content-Type")); got != tt.ttl {
+			t.Errorf("%s: TTL = %s, want %s", tt.path, got, tt.ttl)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != tt.cacheControl {
+			t.Errorf("%s: Cache-Control = %q, want %q", tt.path, got, tt.cacheControl)
+		}
+
+		// a file is only revalidated once its TTL has passed
+		n := gh.count("/repos/")
+		get(handler, "/owner/repo/"+tt.path)
+		if revalidated := gh.count("/repos/") != n; revalidated != (tt.ttl == 0) {
+			t.Errorf("%s: revalidated %t within a TTL of %s", tt.path, revalidated, tt.ttl)
+		}
+	}
+
+	for _, s := range []string{"image=24h", "image/*", "image/*=forever", "image/*=-1h", "image/[=1h"} {
+		if _, err := parseCacheTTLs(s); err == nil {
+			t.Errorf("parseCacheTTLs(%q): expected an error", s)
+		}
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		status int // of GitHub's response to the refetch
+		stale  bool
+	}{
+		{"within window", time.Hour, http.StatusBadGateway, true},
+		{"within window, rate limited", time.Hour, http.StatusTooManyRequests, true},
+		{"within window, not found", time.Hour, http.StatusNotFound, false},
+		{"beyond window", time.Millisecond, http.StatusBadGateway, false},
+		{"disabled", 0, http.StatusBadGateway, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh, handler := newTestProxy(t)
+			gh.setFile("owner", "repo", "file.txt", "content")
+			setForTest(t, &cacheTTL, 0)
+			setForTest(t, maxRetries, 0)
+			setForTest(t, serveStaleOnError, tt.window)
+
+			if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			gh.setStatus(tt.status)
+			stale := testutil.ToFloat64(fileCacheStale)
+
+			resp := get(handler, "/owner/repo/file.txt")
+			if !tt.stale {
+				if resp.StatusCode == http.StatusOK {
+					t.Errorf("status = 200, want the refetch failure")
+				}
+				if got := testutil.ToFloat64(fileCacheStale) - stale; got != 0 {
+					t.Errorf("stale metric increased by %v, want 0", got)
+				}
+				return
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := body(t, resp); got != "content" {
+				t.Errorf("body = %q, want content", got)
+			}
+			if got := resp.Header.Get("Warning"); got != `110 - "Response is Stale"` {
+				t.Errorf("Warning = %q, want the stale warning", got)
+			}
+			if got := testutil.ToFloat64(fileCacheStale) - stale; got != 1 {
+				t.Errorf("stale metric increased by %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestOwnerAndRepoCaseShareState(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "lower")
+	gh.setFile("owner", "repo", "File.txt", "upper")
+	setForTest(t, &cacheTTL, time.Minute)
+	setForTest(t, repoRate, 1)
+	setForTest(t, repoBurst, 2)
+
+	if got := body(t, get(handler, "/owner/repo/file.txt")); got != "lower" {
+		t.Fatalf("body = %q, want lower", got)
+	}
+
+	// a request differing only in the case of owner and repo is served from
+	// the same cache entry and counted against the same repo limit
+	n := gh.count("/repos/")
+	resp := get(handler, "/Owner/Repo/file.txt")
+	if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "lower" {
+		t.Errorf("/Owner/Repo/file.txt: status %d, body %q; want the cached file", resp.StatusCode, got)
+	}
+	if got := gh.count("/repos/"); got != n {
+		t.Errorf("/Owner/Repo/file.txt: %d requests sent to GitHub", got-n)
+	}
+	if resp := get(handler, "/OWNER/REPO/file.txt"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("/OWNER/REPO/file.txt: status = %d, want 429 once the repo limit is used up", resp.StatusCode)
+	}
+
+	// while the file path keeps its case
+	setForTest(t, repoRate, 0)
+	if got := body(t, get(handler, "/owner/repo/File.txt")); got != "upper" {
+		t.Errorf("/owner/repo/File.txt: body = %q, want upper", got)
+	}
+}
@@ -1,193 +1,887 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime"
+	"math/rand/v2"
 	"net/http"
-	"path/filepath"
+	neturl "net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/golang-jwt/jwt/v4"
 )
 
 var (
-	installationToken       string
-	installationTokenExpiry time.Time
-	tokenMutex              sync.Mutex
+	githubClient = newGitHubClient(0, 0)
+
+	// streamClient downloads files streamed to clients, which may take longer
+	// than -github-timeout to read.
+	streamClient = newStreamClient(0, 0)
+
+	// githubAPIURL is the base URL of the GitHub REST API, without a trailing slash.
+	githubAPIURL = "https://api.github.com"
+
+	// githubWebURL is the base URL of the GitHub web host, which serves git LFS.
+	githubWebURL = "https://github.com"
+
+	// tokenPermissions are the permissions requested for installation tokens;
+	// when empty, tokens have all of the app's permissions.
+	tokenPermissions map[string]string
+
+	errJWTClockSkew = fmt.Errorf("JWT rejected due to clock skew")
+	errJSONTooLarge = fmt.Errorf("JSON response exceeds maximum size")
+
+	// errNotFound and errUpstreamAuth match upstreamErrors, with errors.Is, for
+	// a resource GitHub doesn't have and for credentials it rejected.
+	errNotFound     = fmt.Errorf("not found on GitHub")
+	errUpstreamAuth = fmt.Errorf("credentials rejected by GitHub")
+
+	errSubmodule = fmt.Errorf("path is a submodule")
 )
 
-// getInstallationToken returns a valid installation token, renewing it if necessary.
-func getInstallationToken() (string, error) {
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
+// jwtClockSkew is how far JWT claims are backdated when GitHub rejects them for clock drift.
+const jwtClockSkew = 60 * time.Second
+
+// retryBudgetRatio is the fraction of a token a successful GitHub request
+// returns to the retry budget.
+const retryBudgetRatio = 0.1
+
+// retries is the retry budget shared by all retried GitHub requests, or nil if
+// retries aren't budgeted.
+var retries = newRetryBudget(10)
+
+// retryBudget throttles retries while GitHub is failing, in the manner of
+// gRPC's retry throttling: each retryable failure takes a token, each success
+// returns retryBudgetRatio of one, and retries are only allowed while more
+// than half the tokens remain.
+type retryBudget struct {
+	mu        sync.Mutex
+	tokens    float64
+	maxTokens float64
+}
+
+// newRetryBudget returns a full retry budget of maxTokens.
+func newRetryBudget(maxTokens int) *retryBudget {
+	return &retryBudget{tokens: float64(maxTokens), maxTokens: float64(maxTokens)}
+}
+
+// record updates the budget with the outcome of a request.
+func (b *retryBudget) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failed {
+		b.tokens = max(b.tokens-1, 0)
+	} else {
+		b.tokens = min(b.tokens+retryBudgetRatio, b.maxTokens)
+	}
+}
+
+// allow reports whether the budget allows a retry.
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	if time.Now().Before(installationTokenExpiry) {
-		log.Printf("using installation token from cache; expires at %s\n", installationTokenExpiry.Add(3*time.Minute))
-		return installationToken, nil
+	return b.tokens > b.maxTokens/2
+}
+
+// newGitHubClient returns the HTTP client shared by all upstream requests.
+// maxConnsPerHost caps concurrent connections to each host; requests over the
+// cap wait for a free connection. Zero means no limit. timeout bounds each
+// request, including reading its response body; zero means no timeout.
+func newGitHubClient(maxConnsPerHost int, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     newGitHubTransport(maxConnsPerHost),
+		CheckRedirect: preserveGitHubAuth,
 	}
+}
+
+// newStreamClient returns the HTTP client for downloads streamed to clients.
+// Unlike newGitHubClient, timeout only bounds waiting for the response
+// headers, so that a large body isn't cut off however long it takes to read.
+// Streams are instead bounded by the client request's context.
+func newStreamClient(maxConnsPerHost int, timeout time.Duration) *http.Client {
+	transport := newGitHubTransport(maxConnsPerHost)
+	transport.ResponseHeaderTimeout = timeout
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: preserveGitHubAuth,
+	}
+}
+
+// newGitHubTransport returns a transport capping concurrent connections to
+// each host at maxConnsPerHost, or zero for no limit.
+func newGitHubTransport(maxConnsPerHost int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = maxConnsPerHost
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 20
+	transport.IdleConnTimeout = 90 * time.Second
 
-	log.Printf("acquiring new installation token\n")
+	return transport
+}
+
+// retryBaseDelay is the backoff before the first retry of a GitHub request; it
+// doubles with each further retry.
+const retryBaseDelay = 250 * time.Millisecond
+
+// doWithRetry sends req with client, retrying network errors and
+// 5xx responses up to -max-retries times with exponential backoff and jitter,
+// while the retry budget allows. Retries stop early if the request's context
+// is done.
+func doWithRetry(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+
+		retryable := isRetryable(req, resp, err)
+		if retryable || err == nil {
+			retries.record(retryable)
+		}
+
+		if attempt >= *maxRetries || !retryable {
+			return resp, err
+		}
 
-	jwt, err := GenerateJWT(*clientID, privateKey)
+		if !retries.allow() {
+			log.Printf("not retrying %s %s: retry budget exhausted\n", req.Method, req.URL.Path)
+			return resp, err
+		}
+
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		backoff := retryBaseDelay << attempt
+		delay := backoff/2 + rand.N(backoff/2)
+		log.Printf("retrying %s %s in %s (retry %d of %d): %s\n", req.Method, req.URL.Path, delay, attempt+1, *maxRetries, reason)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+		}
+	}
+}
+
+// newAPIRequest returns a GitHub REST API request authorized with token, a JWT
+// or installation token, pinned to the -github-api-version if set.
+func newAPIRequest(ctx context.Context, method, url string, body io.Reader, token string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate JWT: %w", err)
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if *githubAPIVersion != "" {
+		req.Header.Set("X-GitHub-Api-Version", *githubAPIVersion)
 	}
 
-	token, expiry, err := GetInstallationToken(jwt)
+	return req, nil
+}
+
+// isRetryable reports whether a GitHub request failed transiently: with a
+// network error, other than the request being canceled, or a 5xx response.
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
 	if err != nil {
-		return "", fmt.Errorf("failed to get installation token: %w", err)
+		return req.Context().Err() == nil
 	}
 
-	installationToken = token
-	installationTokenExpiry = expiry.Add(-(3 * time.Minute))
+	return resp.StatusCode >= 500
+}
 
-	log.Printf("installation token expires at %s\n", expiry)
+// preserveGitHubAuth is the redirect policy of the shared client. Go drops the
+// Authorization header when a redirect leaves the original host, which breaks
+// contents API requests redirected to another GitHub host; restore it when the
+// redirect is to a GitHub host over HTTPS.
+func preserveGitHubAuth(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
 
-	return installationToken, nil
+	if req.Header.Get("Authorization") != "" || req.URL.Scheme != "https" || !isGitHubHost(req.URL.Hostname()) {
+		return nil
+	}
+
+	if auth := via[0].Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return nil
 }
 
-// GenerateJWT creates a JWT for authenticating as a GitHub App.
-func GenerateJWT(clientID string, privateKey *rsa.PrivateKey) (string, error) {
-	now := time.Now()
+// isGitHubHost reports whether host is github.com or one of its subdomains, or
+// the host of the configured GitHub API.
+func isGitHubHost(host string) bool {
+	host = strings.ToLower(host)
+	if api, err := neturl.Parse(githubAPIURL); err == nil && host == strings.ToLower(api.Hostname()) {
+		return true
+	}
+
+	return host == "github.com" || strings.HasSuffix(host, ".github.com")
+}
+
+// setGitHubAPIURL sets the GitHub API base URL, and derives the web URL from
+// it. GitHub Enterprise Server serves its API at /api/v3 on the web host.
+func setGitHubAPIURL(apiURL string) error {
+	u, err := neturl.Parse(strings.TrimRight(apiURL, "/"))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid GitHub API URL: %s", apiURL)
+	}
+	githubAPIURL = u.String()
+
+	if strings.EqualFold(u.Host, "api.github.com") {
+		githubWebURL = "https://github.com"
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/api/v3")
+		githubWebURL = u.String()
+	}
+
+	return nil
+}
+
+// GenerateJWT creates a JWT for authenticating as a GitHub App, signed with
+// RS256 for an RSA key or the ECDSA method matching the curve of an EC key.
+// The iat and exp claims are moved back by skew to allow for clock drift.
+func GenerateJWT(clientID string, privateKey crypto.Signer, skew time.Duration) (string, error) {
+	method, err := jwtSigningMethod(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Add(-skew)
 	claims := jwt.MapClaims{
 		"iat": now.Unix(),
 		"exp": now.Add(10 * time.Minute).Unix(),
 		"iss": clientID,
-		"alg": "RS256",
+		"alg": method.Alg(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(method, claims)
 	return token.SignedString(privateKey)
 }
 
-// GetInstallationToken fetches an installation token for the GitHub App.
-func GetInstallationToken(jwt string) (string, time.Time, error) {
-	url := fmt.Sprintf("https://api.github.com/app/installations/%s/access_tokens", *installationID)
-	req, err := http.NewRequest("POST", url, nil)
+// jwtSigningMethod returns the JWT signing method for privateKey.
+func jwtSigningMethod(privateKey crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return jwt.SigningMethodES256, nil
+		case 384:
+			return jwt.SigningMethodES384, nil
+		case 521:
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported EC private key curve %s", key.Curve.Params().Name)
+	}
+
+	return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+}
+
+// GetInstallationToken fetches an installation token for a GitHub App
+// installation, returning it with the expiry GitHub reports for it.
+func GetInstallationToken(ctx context.Context, jwt, installationID string, permissions map[string]string) (string, time.Time, error) {
+	var body io.Reader
+	if len(permissions) > 0 {
+		b, err := json.Marshal(map[string]any{"permissions": permissions})
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to encode permissions: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", githubAPIURL, installationID)
+	req, err := newAPIRequest(ctx, "POST", url, body, jwt)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("failed to create request: %w", err)
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-	req.Header.Set("Authorization", "Bearer "+jwt)
-	req.Header.Set("Accept", "application/vnd.github+json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(githubClient, req)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("failed to fetch installation token: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized && isClockSkewRejection(resp.Body) {
+		return "", time.Time{}, fmt.Errorf("%w: %s", errJWTClockSkew, resp.Status)
+	}
+
 	if resp.StatusCode != http.StatusCreated {
-		return "", time.Time{}, fmt.Errorf("failed to get installation token: %s", resp.Status)
+		return "", time.Time{}, newUpstreamError("get installation token", resp)
 	}
 
-	var body struct {
-		Token string `json:"token"`
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+	if err := json.NewDecoder(limitJSON(resp.Body)).Decode(&token); err != nil {
 		return "", time.Time{}, fmt.Errorf("failed to parse response: %w", err)
 	}
-	return body.Token, time.Now().Add(time.Hour), nil
+
+	// tokens last an hour, unless GitHub says otherwise
+	if token.ExpiresAt.IsZero() {
+		log.Printf("installation token response has no expires_at; assuming the token lasts an hour\n")
+		token.ExpiresAt = time.Now().Add(time.Hour)
+	}
+
+	return token.Token, token.ExpiresAt, nil
+}
+
+// parseTokenPermissions parses comma-separated name=level pairs, such as
+// contents=read, into the permissions requested for installation tokens.
+func parseTokenPermissions(s string) (map[string]string, error) {
+	permissions := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, level, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid token permission: %s", pair)
+		}
+
+		switch level {
+		case "read", "write", "admin":
+		default:
+			return nil, fmt.Errorf("invalid level for token permission %s: %s", name, level)
+		}
+
+		permissions[name] = level
+	}
+
+	return permissions, nil
+}
+
+// githubRequestIDHeader identifies a request in GitHub's logs; quote it when contacting GitHub support.
+const githubRequestIDHeader = "X-GitHub-Request-Id"
+
+// upstreamError is an unexpected response status from an upstream request.
+type upstreamError struct {
+	Op         string
+	Status     string
+	StatusCode int
+	RequestID  string
+	RetryAfter time.Duration // set if GitHub rejected the request for exceeding a rate limit
+}
+
+// newUpstreamError returns an upstreamError describing the failed operation op
+// and its response. If GitHub rejected the request for exceeding a rate limit,
+// requests served with the installation it was made for are paused until
+// GitHub says to retry.
+func newUpstreamError(op string, resp *http.Response) error {
+	retryAfter := rateLimitRetryAfter(resp)
+	if retryAfter > 0 {
+		pauseUpstream(requestInstallation(resp.Request), time.Now().Add(retryAfter))
+	}
+
+	return &upstreamError{
+		Op:         op,
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(githubRequestIDHeader),
+		RetryAfter: retryAfter,
+	}
+}
+
+// requestInstallation returns the installation ID a GitHub request was made
+// for: that of its installation token, or of the installation whose token it
+// requests. It returns "unknown" if neither applies.
+func requestInstallation(req *http.Request) string {
+	if req == nil {
+		return "unknown"
+	}
+
+	if _, rest, ok := strings.Cut(req.URL.Path, "/app/installations/"); ok {
+		id, _, _ := strings.Cut(rest, "/")
+		return id
+	}
+
+	return installationForToken(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+}
+
+// Is reports whether target is errNotFound and GitHub responded 404, or is
+// errUpstreamAuth and GitHub responded 401, or 403 other than for a rate limit.
+func (e *upstreamError) Is(target error) bool {
+	switch target {
+	case errNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case errUpstreamAuth:
+		return e.StatusCode == http.StatusUnauthorized || (e.StatusCode == http.StatusForbidden && e.RetryAfter == 0)
+	}
+
+	return false
+}
+
+// rateLimitRetryAfter returns how long to wait before retrying a request that
+// GitHub rejected with 403 or 429 for exceeding a rate limit, from either its
+// Retry-After header or, for an exhausted primary rate limit, its
+// X-RateLimit-Reset header. It returns zero if resp isn't a rate limit rejection.
+func rateLimitRetryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return max(time.Duration(seconds)*time.Second, time.Second)
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return max(time.Until(at), time.Second)
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(time.Until(time.Unix(reset, 0)), time.Second)
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// without a header GitHub asks that clients wait at least a minute
+		return time.Minute
+	}
+
+	return 0
+}
+
+func (e *upstreamError) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("failed to %s: %s", e.Op, e.Status)
+	}
+
+	return fmt.Sprintf("failed to %s: %s (GitHub request ID: %s)", e.Op, e.Status, e.RequestID)
+}
+
+// isTransient reports whether a GitHub request failed with a network error,
+// other than the request being canceled, a 5xx response or a rate limit.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.StatusCode >= 500 || upstreamErr.RetryAfter > 0
+	}
+
+	return true
+}
+
+// isClockSkewRejection reports whether a 401 response body blames the JWT iat or exp claims.
+func isClockSkewRejection(body io.Reader) bool {
+	var errBody struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(limitJSON(body)).Decode(&errBody); err != nil {
+		return false
+	}
+
+	return strings.Contains(errBody.Message, "'iat'") || strings.Contains(errBody.Message, "'exp'")
+}
+
+// FileContent is a file fetched from a GitHub repository.
+type FileContent struct {
+	Content      []byte
+	ContentType  string
+	RequestID    string // X-GitHub-Request-Id of the contents API response
+	ETag         string // ETag of the contents API response
+	LastModified string // Last-Modified of the contents API response
+	CacheControl string // Cache-Control of the contents API response
+	NotModified  bool   // GitHub answered a conditional request with 304; Content is empty
+	SHA          string // git blob SHA of the file
+	Stale        bool   // served from cache past its TTL as GitHub couldn't be reached
+
+	// Body is set instead of Content when the file is streamed from GitHub
+	// rather than read into memory; it reads Size bytes and must be closed.
+	Body io.ReadCloser
+	Size int64
+
+	// SymlinkTarget is set instead of Content when the path is a symlink that
+	// GitHub didn't resolve, such as one to a directory or outside the repo.
+	SymlinkTarget string
+
+	// Listing is set instead of Content when the path is a directory.
+	Listing []DirectoryEntry
+}
+
+// DirectoryEntry is an entry in a directory listing.
+type DirectoryEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	SHA  string `json:"sha"`
+}
+
+// conditionalHeaders are the request headers forwarded to GitHub for conditional requests.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// staleOnError returns cached, marked stale, in place of err if revalidating
+// it failed transiently and it expired less than -serve-stale-on-error ago.
+// Otherwise it returns err. cached is nil if there is no cached copy, or it
+// is a directory listing or was bypassed by forwarded conditional headers.
+func staleOnError(cached *FileContent, fetched time.Time, err error) (*FileContent, error) {
+	if cached == nil || cached.Listing != nil || *serveStaleOnError <= 0 || !isTransient(err) {
+		return nil, err
+	}
+
+	expired := fetched.Add(cacheTTLFor(cached.ContentType))
+	if time.Since(expired) >= *serveStaleOnError {
+		return nil, err
+	}
+
+	log.Printf("serving stale copy from cache, fetched at %s: %v\n", fetched, err)
+	cached.RequestID = ""
+	cached.Stale = true
+	fileCacheStale.Inc()
+	return cached, nil
+}
+
+// escapePath escapes each segment of the repo file path p for use in a URL
+// path, so that characters such as ? and # can't end the path early.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = neturl.PathEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
 }
 
 // GetFileContent retrieves the file content from the GitHub repository.
-func GetFileContent(owner, repo, path, token string) ([]byte, string, error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s", owner, repo, path)
-	req, err := http.NewRequest("GET", url, nil)
+// If ref is non-empty it selects the branch, tag, commit or pull request ref
+// (e.g. pull/123/head) to read from, otherwise the default branch is used.
+// Any conditionalHeaders in conditional are sent to GitHub; if it responds 304
+// the returned FileContent has NotModified set. Otherwise the last fetched
+// version of the file is returned from the file cache if it is within its cache
+// TTL or ref is a commit SHA, or else its ETag is sent, and on a 304 it is
+// returned without downloading the file again. If stream is set, files larger than
+// -stream-threshold are returned with a Body to stream rather than Content.
+func GetFileContent(ctx context.Context, owner, repo, path, ref, token string, conditional http.Header, stream bool) (*FileContent, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/contents/%s", githubAPIURL, owner, repo, escapePath(path))
+	if ref != "" {
+		url += "?" + neturl.Values{"ref": {ref}}.Encode()
+	}
+	req, err := newAPIRequest(ctx, "GET", url, nil, token)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	forwarded := false
+	for _, name := range conditionalHeaders {
+		if value := conditional.Get(name); value != "" {
+			req.Header.Set(name, value)
+			forwarded = true
+		}
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.github+json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	cacheKey := fileCacheKey(owner, repo, path, ref)
+	cached, fetched := getCachedFile(cacheKey)
+	if !forwarded && cached != nil {
+		// content at a commit never changes, so is never revalidated
+		if isCommitSHA(ref) || time.Since(fetched) < cacheTTLFor(cached.ContentType) {
+			log.Printf("serving from cache: %s, fetched at %s\n", path, fetched)
+			cached.RequestID = ""
+			fileCacheHits.Inc()
+			return cached, nil
+		}
+
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := doWithRetry(githubClient, req)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to fetch file: %w", err)
+		return staleOnError(cached, fetched, fmt.Errorf("failed to fetch file: %w", err))
 	}
 	defer resp.Body.Close()
+	observeRateLimit(resp, token)
+
+	file := &FileContent{
+		RequestID:    resp.Header.Get(githubRequestIDHeader),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		CacheControl: resp.Header.Get("Cache-Control"),
+	}
+
+	if resp.StatusCode == http.StatusNotModified && !forwarded && cached != nil {
+		log.Printf("file not modified, serving from cache: %s, GitHub request ID: %s\n", path, file.RequestID)
+		cached.RequestID = file.RequestID
+		fileCacheHits.Inc()
+		putCachedFile(cacheKey, cached)
+		return cached, nil
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		log.Printf("file not modified: %s, GitHub request ID: %s\n", path, file.RequestID)
+		file.NotModified = true
+		return file, nil
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("failed to fetch file: %s", resp.Status)
+		return staleOnError(cached, fetched, newUpstreamError("fetch file", resp))
 	}
 
+	body, err := io.ReadAll(limitJSON(resp.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file data: %w", err)
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, fmt.Errorf("unexpected contents response for %s", path)
+	}
+
+	// the contents API responds with an array of entries for a directory
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(body, &file.Listing); err != nil {
+			return nil, fmt.Errorf("failed to parse directory listing: %w", err)
+		}
+
+		log.Printf("serving directory listing: %s, Entries: %d, GitHub request ID: %s\n", path, len(file.Listing), file.RequestID)
+
+		fileCacheMisses.Inc()
+		putCachedFile(cacheKey, file)
+		return file, nil
+	}
 	var fileData struct {
 		Content     string `json:"content"`
 		Name        string `json:"name"`
+		SHA         string `json:"sha"`
 		Encoding    string `json:"encoding"`
 		Size        int64  `json:"size"`
 		DownloadURL string `json:"download_url"`
+		Type        string `json:"type"`
+		Target      string `json:"target"`
+	}
+
+	if err := json.Unmarshal(body, &fileData); err != nil {
+		return nil, fmt.Errorf("failed to parse file data: %w", err)
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&fileData); err != nil {
-		return nil, "", fmt.Errorf("failed to parse file data: %w", err)
+	switch fileData.Type {
+	case "submodule":
+		return nil, fmt.Errorf("failed to fetch file %s: %w", path, errSubmodule)
+	case "symlink":
+		log.Printf("symlink: %s, Target: %s, GitHub request ID: %s\n", path, fileData.Target, file.RequestID)
+		file.SymlinkTarget = fileData.Target
+		return file, nil
+	case "file", "":
+	default:
+		return nil, fmt.Errorf("unexpected contents type for %s: %s", path, fileData.Type)
 	}
 
-	ext := filepath.Ext(fileData.Name)
 	var content []byte
 
-	// For larger files, request raw content to avoid auth/redirect issues.
+	// For larger files, request raw content to avoid auth/redirect issues. The
+	// blob is fetched by SHA, so it matches the metadata even if the ref moves.
 	if fileData.Size > 1024*1024 || fileData.Content == "" {
-		req, err = http.NewRequest("GET", url, nil)
+		rawURL := url
+		if fileData.SHA != "" {
+			rawURL = fmt.Sprintf("%s/repos/%s/%s/git/blobs/%s", githubAPIURL, owner, repo, fileData.SHA)
+		}
+
+		req, err = newAPIRequest(ctx, "GET", rawURL, nil, token)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to create raw download request: %w", err)
+			return nil, fmt.Errorf("failed to create raw download request: %w", err)
 		}
-		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("Accept", "application/vnd.github.raw")
 
-		resp, err = client.Do(req)
+		// large files are too big to be LFS pointers, so can be streamed as is
+		streaming := stream && *streamThreshold > 0 && fileData.Size > *streamThreshold
+		client := githubClient
+		if streaming {
+			client = streamClient
+		}
+
+		resp, err = doWithRetry(client, req)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to download raw file: %w", err)
+			return nil, fmt.Errorf("failed to download raw file: %w", err)
 		}
-		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			return nil, "", fmt.Errorf("failed to download raw file: %s", resp.Status)
+			resp.Body.Close()
+			return nil, newUpstreamError("download raw file", resp)
+		}
+
+		if streaming {
+			streamFile(file, fileData.Name, fileData.Size, resp.Body, isSniffingAllowed(owner, repo))
+			log.Printf("streaming filename: %s, Size: %d bytes, File type: %v, GitHub request ID: %s\n", fileData.Name, fileData.Size, file.ContentType, file.RequestID)
+
+			file.SHA = fileData.SHA
+			fileCacheMisses.Inc()
+			return file, nil
 		}
 
 		content, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to read raw download response: %w", err)
+			return nil, fmt.Errorf("failed to read raw download response: %w", err)
 		}
 	} else {
 		// Decode the Base64-encoded content
 		content, err = base64.StdEncoding.DecodeString(fileData.Content)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to decode file content: %w", err)
+			return nil, fmt.Errorf("failed to decode file content: %w", err)
 		}
 	}
 
+	if err := checkSize(content, fileData.Size); err != nil {
+		return nil, fmt.Errorf("failed to fetch file %s: %w", path, err)
+	}
+
 	if lfsPointer, ok := parseLFSPointer(content); ok {
-		content, err = downloadLFSObject(owner, repo, token, lfsPointer)
+		if stream && *streamThreshold > 0 && lfsPointer.Size > *streamThreshold {
+			body, err := openLFSObject(ctx, streamClient, owner, repo, token, lfsPointer)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download LFS object: %w", err)
+			}
+
+			streamFile(file, fileData.Name, lfsPointer.Size, body, isSniffingAllowed(owner, repo))
+			log.Printf("streaming LFS object: %s, Size: %d bytes, File type: %v, GitHub request ID: %s\n", fileData.Name, lfsPointer.Size, file.ContentType, file.RequestID)
+
+			fileCacheMisses.Inc()
+			return file, nil
+		}
+
+		content, err = downloadLFSObject(ctx, owner, repo, token, lfsPointer)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to download LFS object: %w", err)
+			return nil, fmt.Errorf("failed to download LFS object: %w", err)
 		}
 	}
 
-	// Identify content type
-	contentType := mime.TypeByExtension(ext)
-	if contentType == "" {
-		mtype := mimetype.Detect(content)
-		if mtype != nil {
-			contentType = mtype.String()
-		} else {
-			contentType = "application/octet-stream" // Default fallback content type
-		}
+	contentType := detectContentType(fileData.Name, content, isSniffingAllowed(owner, repo))
+
+	log.Printf("serving filename: %s, Size: %d bytes, File type: %v, GitHub request ID: %s\n", fileData.Name, fileData.Size, contentType, file.RequestID)
+
+	file.Content = content
+	file.ContentType = contentType
+	file.SHA = fileData.SHA
+	fileCacheMisses.Inc()
+	putCachedFile(cacheKey, file)
+
+	return file, nil
+}
+
+// Repository is the subset of GitHub's repository metadata used by the proxy.
+type Repository struct {
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+	Archived      bool   `json:"archived"`
+}
+
+// GetRepository retrieves the metadata for a GitHub repository.
+func GetRepository(ctx context.Context, owner, repo, token string) (*Repository, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s", githubAPIURL, owner, repo)
+	req, err := newAPIRequest(ctx, "GET", url, nil, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := doWithRetry(githubClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch repository: %w", err)
+	}
+	defer resp.Body.Close()
+	observeRateLimit(resp, token)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("fetch repository", resp)
+	}
+
+	var repository Repository
+	if err := json.NewDecoder(limitJSON(resp.Body)).Decode(&repository); err != nil {
+		return nil, fmt.Errorf("failed to parse repository: %w", err)
+	}
+
+	return &repository, nil
+}
+
+// TreeEntry is an entry in a git tree.
+type TreeEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+	Size int64  `json:"size"`
+}
+
+// GetTree retrieves the full, recursive git tree of the repository at ref,
+// or at the default branch if ref is empty.
+func GetTree(ctx context.Context, owner, repo, ref, token string) ([]TreeEntry, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/%s/git/trees/%s?recursive=1", githubAPIURL, owner, repo, neturl.PathEscape(ref))
+	req, err := newAPIRequest(ctx, "GET", url, nil, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := doWithRetry(githubClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tree: %w", err)
+	}
+	defer resp.Body.Close()
+	observeRateLimit(resp, token)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("fetch tree", resp)
+	}
+
+	var tree struct {
+		Tree      []TreeEntry `json:"tree"`
+		Truncated bool        `json:"truncated"`
+	}
+	if err := json.NewDecoder(limitJSON(resp.Body)).Decode(&tree); err != nil {
+		return nil, fmt.Errorf("failed to parse tree: %w", err)
 	}
 
-	log.Printf("serving filename: %s, Size: %d bytes, File type: %v\n", fileData.Name, fileData.Size, contentType)
+	if tree.Truncated {
+		log.Printf("tree for %s/%s@%s truncated by GitHub; %d entries returned\n", owner, repo, ref, len(tree.Tree))
+	}
 
-	return content, contentType, nil
+	return tree.Tree, nil
 }
 
 type lfsPointer struct {
@@ -256,34 +950,55 @@ type lfsBatchError struct {
 	Message string `json:"message"`
 }
 
-func downloadLFSObject(owner, repo, token string, pointer *lfsPointer) ([]byte, error) {
+func downloadLFSObject(ctx context.Context, owner, repo, token string, pointer *lfsPointer) ([]byte, error) {
+	body, err := openLFSObject(ctx, githubClient, owner, repo, token, pointer)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LFS download response: %w", err)
+	}
+
+	if err := checkSize(content, pointer.Size); err != nil {
+		return nil, fmt.Errorf("failed to download LFS object: %w", err)
+	}
+
+	return content, nil
+}
+
+// openLFSObject starts downloading the LFS object for pointer with client,
+// returning its content to be read and closed by the caller.
+func openLFSObject(ctx context.Context, client *http.Client, owner, repo, token string, pointer *lfsPointer) (io.ReadCloser, error) {
 	reqBody := lfsBatchRequest{
 		Operation: "download",
 		Objects:   []lfsBatchObject{{OID: pointer.OID, Size: pointer.Size}},
 	}
 
-	action, err := requestLFSBatchAction(fmt.Sprintf("https://api.github.com/repos/%s/%s/git/lfs/objects/batch", owner, repo), token, reqBody, false)
+	action, err := requestLFSBatchAction(ctx, fmt.Sprintf("%s/repos/%s/%s/git/lfs/objects/batch", githubAPIURL, owner, repo), token, reqBody, false)
 	if err != nil {
 		if !strings.Contains(err.Error(), "404") {
 			return nil, err
 		}
 
-		action, err = requestLFSBatchAction(fmt.Sprintf("https://github.com/%s/%s.git/info/lfs/objects/batch", owner, repo), token, reqBody, true)
+		action, err = requestLFSBatchAction(ctx, fmt.Sprintf("%s/%s/%s.git/info/lfs/objects/batch", githubWebURL, owner, repo), token, reqBody, true)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return downloadLFSAction(action)
+	return openLFSAction(ctx, client, action)
 }
 
-func requestLFSBatchAction(url, token string, reqBody lfsBatchRequest, useBasicAuth bool) (lfsBatchAction, error) {
+func requestLFSBatchAction(ctx context.Context, url, token string, reqBody lfsBatchRequest, useBasicAuth bool) (lfsBatchAction, error) {
 	bodyBytes, err := json.Marshal(reqBody)
 	if err != nil {
 		return lfsBatchAction{}, fmt.Errorf("failed to encode LFS batch request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyBytes))
 	if err != nil {
 		return lfsBatchAction{}, fmt.Errorf("failed to create LFS batch request: %w", err)
 	}
@@ -297,19 +1012,18 @@ func requestLFSBatchAction(url, token string, reqBody lfsBatchRequest, useBasicA
 	req.Header.Set("Accept", "application/vnd.git-lfs+json")
 	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := githubClient.Do(req)
 	if err != nil {
 		return lfsBatchAction{}, fmt.Errorf("failed to request LFS batch: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return lfsBatchAction{}, fmt.Errorf("failed to request LFS batch: %s", resp.Status)
+		return lfsBatchAction{}, newUpstreamError("request LFS batch", resp)
 	}
 
 	var batchResp lfsBatchResponse
-	if err := json.NewDecoder(resp.Body).Decode(&batchResp); err != nil {
+	if err := json.NewDecoder(limitJSON(resp.Body)).Decode(&batchResp); err != nil {
 		return lfsBatchAction{}, fmt.Errorf("failed to parse LFS batch response: %w", err)
 	}
 
@@ -330,9 +1044,10 @@ func requestLFSBatchAction(url, token string, reqBody lfsBatchRequest, useBasicA
 	return action, nil
 }
 
-func downloadLFSAction(action lfsBatchAction) ([]byte, error) {
-	client := &http.Client{}
-	downloadReq, err := http.NewRequest("GET", action.Href, nil)
+// openLFSAction starts the LFS download described by action with client,
+// returning the object's content to be read and closed by the caller.
+func openLFSAction(ctx context.Context, client *http.Client, action lfsBatchAction) (io.ReadCloser, error) {
+	downloadReq, err := http.NewRequestWithContext(ctx, "GET", action.Href, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LFS download request: %w", err)
 	}
@@ -344,18 +1059,74 @@ func downloadLFSAction(action lfsBatchAction) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to download LFS object: %w", err)
 	}
-	defer downloadResp.Body.Close()
 
 	if downloadResp.StatusCode != http.StatusOK {
+		downloadResp.Body.Close()
 		return nil, fmt.Errorf("failed to download LFS object: %s", downloadResp.Status)
 	}
 
-	content, err := io.ReadAll(downloadResp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read LFS download response: %w", err)
+	return downloadResp.Body, nil
+}
+
+// jsonLimitReader reads from r, failing with errJSONTooLarge once more than n
+// bytes have been read.
+type jsonLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+// limitJSON limits a JSON response body to -max-json-size bytes, so that an
+// oversized response fails to decode rather than using up memory.
+func limitJSON(r io.Reader) io.Reader {
+	return &jsonLimitReader{r, *maxJSONSize}
+}
+
+func (l *jsonLimitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errJSONTooLarge
 	}
 
-	return content, nil
+	// read at most one byte past the limit, to detect exceeding it
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		// the byte past the limit isn't returned, so a response that only
+		// parses with it fails to decode
+		n, l.n = int(l.n), -1
+		return n, errJSONTooLarge
+	}
+	l.n -= int64(n)
+
+	return n, err
+}
+
+// streamFile sets the body of file to the raw content read from body, and its
+// content type to that detected from its name or, if sniff is set, the start
+// of the content.
+func streamFile(file *FileContent, name string, size int64, body io.ReadCloser, sniff bool) {
+	br := bufio.NewReaderSize(body, sniffLen)
+	head, _ := br.Peek(sniffLen)
+
+	file.ContentType = detectContentType(name, head, sniff)
+	file.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, body}
+	file.Size = size
+}
+
+// checkSize returns an error if content isn't the expected size, such as when
+// an upstream download was cut short, so that partial content is never served
+// or cached as if complete.
+func checkSize(content []byte, expected int64) error {
+	if int64(len(content)) != expected {
+		return fmt.Errorf("incomplete content: got %d of %d bytes", len(content), expected)
+	}
+
+	return nil
 }
 
 type RateLimit struct {
@@ -369,29 +1140,31 @@ type RateLimit struct {
 }
 
 // fetchRateLimit fetches the rate limit for the GitHub API.
-func fetchRateLimit(token string) (*RateLimit, error) {
-	req, err := http.NewRequest("GET", "https://api.github.com/rate_limit", nil)
+func fetchRateLimit(ctx context.Context, token string) (*RateLimit, error) {
+	req, err := newAPIRequest(ctx, "GET", githubAPIURL+"/rate_limit", nil, token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.github+json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(githubClient, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch rate limit: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch rate limit: %s", resp.Status)
+		return nil, newUpstreamError("fetch rate limit", resp)
 	}
 
 	var rateLimit RateLimit
-	if err := json.NewDecoder(resp.Body).Decode(&rateLimit); err != nil {
+	if err := json.NewDecoder(limitJSON(resp.Body)).Decode(&rateLimit); err != nil {
 		return nil, fmt.Errorf("failed to parse rate limit response: %w", err)
 	}
+	installation := installationForToken(token)
+	rateLimitRemaining.WithLabelValues(installation).Set(float64(rateLimit.Resources.Core.Remaining))
+	rateLimitLimit.WithLabelValues(installation).Set(float64(rateLimit.Resources.Core.Limit))
+	rateLimitReset.WithLabelValues(installation).Set(float64(rateLimit.Resources.Core.Reset))
+	recordRateLimit(installation, rateLimit.Resources.Core.Remaining, time.Unix(int64(rateLimit.Resources.Core.Reset), 0))
 
 	return &rateLimit, nil
 }
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// concurrency tracks the peak number of concurrent calls to a handler.
+type concurrency struct {
+	active, peak atomic.Int32
+}
+
+// enter records a call starting, returning a func to record it finishing.
+func (c *concurrency) enter() func() {
+	n := c.active.Add(1)
+	for {
+		p := c.peak.Load()
+		if n <= p || c.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+
+	return func() { c.active.Add(-1) }
+}
+
+func TestGitHubClientMaxConnsPerHost(t *testing.T) {
+	const maxConns, requests = 2, 10
+
+	var c concurrency
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer c.enter()()
+
+		// hold the connection so that other requests have to wait for it
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := newGitHubClient(maxConns, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// requests over the cap queue for a connection rather than failing
+	for err := range errs {
+		t.Errorf("request failed: %v", err)
+	}
+
+	if got := c.peak.Load(); got > maxConns {
+		t.Errorf("peak concurrent requests = %d, want at most %d", got, maxConns)
+	}
+	if got := c.peak.Load(); got < maxConns {
+		t.Errorf("peak concurrent requests = %d, want the cap of %d to be reached", got, maxConns)
+	}
+}
+
+func TestGitHubClientUncapped(t *testing.T) {
+	const requests = 5
+
+	var c concurrency
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer c.enter()()
+
+		<-release
+	}))
+	defer server.Close()
+
+	client := newGitHubClient(0, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if resp, err := client.Get(server.URL); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	// without a cap every request gets its own connection at once
+	deadline := time.Now().Add(5 * time.Second)
+	for c.peak.Load() < requests && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := c.peak.Load(); got != requests {
+		t.Errorf("peak concurrent requests = %d, want %d", got, requests)
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func BenchmarkGitHubClientMaxConnsPerHost(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := newGitHubClient(4, 0)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}
+	})
+}
+
+func TestShaPinnedCacheHitsAreNotRevalidated(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	for i := 0; i < 3; i++ {
+		resp := get(handler, "/owner/repo/file.txt?ref="+sha)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, resp.StatusCode)
+		}
+		if got := body(t, resp); got != "content" {
+			t.Errorf("request %d: body = %q, want content", i, got)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+			t.Errorf("request %d: Cache-Control = %q, want immutable", i, got)
+		}
+	}
+
+	if n := gh.count("/repos/owner/repo/contents/"); n != 1 {
+		t.Errorf("%d contents requests sent to GitHub, want 1", n)
+	}
+}
+
+func TestBranchCacheHitsAreRevalidated(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	for i := 0; i < 2; i++ {
+		if resp := get(handler, "/owner/repo/file.txt?ref=main"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, resp.StatusCode)
+		}
+	}
+
+	if n := gh.count("/repos/owner/repo/contents/"); n != 2 {
+		t.Fatalf("%d contents requests sent to GitHub, want 2", n)
+	}
+	if got := gh.lastRequest("/repos/owner/repo/contents/").Header.Get("If-None-Match"); got == "" {
+		t.Error("cached file revalidated without If-None-Match")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(4)
+	if !b.allow() {
+		t.Fatal("full budget doesn't allow retries")
+	}
+
+	b.record(true)
+	if !b.allow() {
+		t.Error("3 of 4 tokens: retries not allowed")
+	}
+	b.record(true)
+	if b.allow() {
+		t.Error("2 of 4 tokens: retries allowed")
+	}
+
+	b.record(true)
+	b.record(true)
+	if b.allow() {
+		t.Error("0 of 4 tokens: retries allowed")
+	}
+
+	// successes refill the budget gradually
+	for i := 0; i < 19; i++ {
+		b.record(false)
+	}
+	if b.allow() {
+		t.Error("1.9 of 4 tokens: retries allowed")
+	}
+	b.record(false)
+	b.record(false)
+	if !b.allow() {
+		t.Error("2.1 of 4 tokens: retries not allowed")
+	}
+
+	// it never holds more than its size
+	for i := 0; i < 100; i++ {
+		b.record(false)
+	}
+	if b.tokens != 4 {
+		t.Errorf("tokens = %v, want 4", b.tokens)
+	}
+
+	var unbudgeted *retryBudget
+	unbudgeted.record(true)
+	if !unbudgeted.allow() {
+		t.Error("nil budget doesn't allow retries")
+	}
+}
+
+func TestRetriesStopWhenBudgetDepleted(t *testing.T) {
+	var calls, status atomic.Int32
+	status.Store(http.StatusBadGateway)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	setForTest(t, &githubClient, newGitHubClient(0, 0))
+	setForTest(t, maxRetries, 3)
+	setForTest(t, &retries, newRetryBudget(4))
+
+	do := func() int {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := doWithRetry(githubClient, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the first request's retry takes the budget to half, stopping retries
+	do()
+	if n := calls.Swap(0); n != 2 {
+		t.Errorf("first request: %d attempts, want 2", n)
+	}
+
+	do()
+	if n := calls.Swap(0); n != 1 {
+		t.Errorf("with the budget depleted: %d attempts, want 1", n)
+	}
+
+	// successes refill the budget
+	status.Store(http.StatusOK)
+	for i := 0; i < 20; i++ {
+		do()
+	}
+	calls.Store(0)
+
+	status.Store(http.StatusBadGateway)
+	do()
+	if n := calls.Swap(0); n < 2 {
+		t.Errorf("with the budget refilled: %d attempts, want retries", n)
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int // requests failing before one succeeds
+		fail     func(w http.ResponseWriter)
+		attempts int32
+		status   int
+	}{
+		{
+			name:     "5xx then success",
+			failures: 1,
+			fail:     func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+			attempts: 2,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "network errors then success",
+			failures: 2,
+			fail: func(w http.ResponseWriter) {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			},
+			attempts: 3,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "5xx beyond -max-retries",
+			failures: 5,
+			fail:     func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+			attempts: 3,
+			status:   http.StatusBadGateway,
+		},
+		{
+			name:     "4xx",
+			failures: 1,
+			fail:     func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) },
+			attempts: 1,
+			status:   http.StatusNotFound,
+		},
+	}
+
+	setForTest(t, &githubClient, newGitHubClient(0, 0))
+	setForTest(t, maxRetries, 2)
+
+	for _, tt := range tests {
+		setForTest(t, &retries, (*retryBudget)(nil))
+
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) <= int32(tt.failures) {
+				tt.fail(w)
+			}
+		}))
+
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := doWithRetry(githubClient, req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if resp.Body.Close(); resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if n := calls.Load(); n != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, n, tt.attempts)
+		}
+
+		server.Close()
+	}
+}
+
+func TestRepositoryAndTreeRequestsAreRetried(t *testing.T) {
+	gh, _ := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.remaining = 1234
+	setForTest(t, maxRetries, 1)
+
+	tokenInstallations.Store("token", "42")
+	defer tokenInstallations.Delete("token")
+
+	for name, fetch := range map[string]func() error{
+		"repository": func() error {
+			_, err := GetRepository(context.Background(), "owner", "repo", "token")
+			return err
+		},
+		"tree": func() error {
+			_, err := GetTree(context.Background(), "owner", "repo", "", "token")
+			return err
+		},
+	} {
+		rateLimitRemaining.DeleteLabelValues("42")
+
+		// GitHub fails the first attempt only
+		gh.setStatus(http.StatusBadGateway)
+		n := gh.count("/repos/")
+		go func() {
+			for gh.count("/repos/") == n {
+				time.Sleep(time.Millisecond)
+			}
+			gh.setStatus(0)
+		}()
+
+		if err := fetch(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if got := gh.count("/repos/") - n; got != 2 {
+			t.Errorf("%s: %d attempts, want 2", name, got)
+		}
+		if got := testutil.ToFloat64(rateLimitRemaining.WithLabelValues("42")); got != 1234 {
+			t.Errorf("%s: rate limit remaining = %v, want 1234", name, got)
+		}
+	}
+}
+
+func TestFilePathIsEscaped(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.setFile("owner", "repo", "docs/what?#.txt", "question")
+
+	resp := get(handler, "/owner/repo/file.txt%3Fref=evil")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+
+	req := gh.lastRequest("/repos/owner/repo/contents/")
+	if req == nil {
+		t.Fatal("no contents request sent to GitHub")
+	}
+	if req.URL.Path != "/repos/owner/repo/contents/file.txt?ref=evil" || req.URL.RawQuery != "" {
+		t.Errorf("GitHub requested path %q with query %q, want the ? kept in the path", req.URL.Path, req.URL.RawQuery)
+	}
+
+	resp = get(handler, "/owner/repo/docs/what%3F%23.txt")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := body(t, resp); got != "question" {
+		t.Errorf("body = %q, want question", got)
+	}
+}
+
+func TestRedirectedContentsResponse(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "renamed", "file.txt", "content")
+
+	// GitHub redirects requests for a renamed repo to its new name
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/repos/owner/repo/"); ok {
+			http.Redirect(w, r, "/repos/owner/renamed/"+rest, http.StatusFound)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "Requires authentication", http.StatusUnauthorized)
+			return
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	resp := get(handler, "/owner/repo/file.txt")
+	if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "content" {
+		t.Errorf("status %d, body %q; want the file after the redirect", resp.StatusCode, got)
+	}
+}
+
+func TestPreserveGitHubAuth(t *testing.T) {
+	original, err := http.NewRequest(http.MethodGet, "https://api.github.com/repos/owner/repo/contents/file.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original.Header.Set("Authorization", "Bearer ghs_token")
+
+	tests := []struct {
+		target string
+		auth   string
+	}{
+		{"https://api.github.com/repositories/1/contents/file.txt", "Bearer ghs_token"},
+		{"https://raw.github.com/owner/repo/main/file.txt", "Bearer ghs_token"},
+		{"https://github.com/owner/repo/raw/main/file.txt", "Bearer ghs_token"},
+		{"http://api.github.com/repositories/1/contents/file.txt", ""},
+		{"https://example.com/file.txt", ""},
+		{"https://github.com.example.com/file.txt", ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, tt.target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := preserveGitHubAuth(req, []*http.Request{original}); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != tt.auth {
+			t.Errorf("redirect to %s: Authorization = %q, want %q", tt.target, got, tt.auth)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api.github.com/", nil)
+	if err := preserveGitHubAuth(req, make([]*http.Request, 10)); err == nil {
+		t.Error("followed an 11th redirect")
+	}
+}
+
+func TestInstallationTokenPermissions(t *testing.T) {
+	gh, _ := newTestProxy(t)
+
+	var sent []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/access_tokens") {
+			sent, _ = io.ReadAll(r.Body)
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	permissions, err := parseTokenPermissions("contents=read, metadata=read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetInstallationToken(context.Background(), "jwt", "1", permissions); err != nil {
+		t.Fatal(err)
+	}
+	var got struct{ Permissions map[string]string }
+	if err := json.Unmarshal(sent, &got); err != nil {
+		t.Fatalf("token request body %q: %v", sent, err)
+	}
+	if len(got.Permissions) != 2 || got.Permissions["contents"] != "read" || got.Permissions["metadata"] != "read" {
+		t.Errorf("token request body = %s, want contents and metadata read permissions", sent)
+	}
+	if got := gh.lastRequest("/app/").Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("token request Content-Type = %q, want application/json", got)
+	}
+
+	// without permissions the token has all of the app's
+	if _, _, err := GetInstallationToken(context.Background(), "jwt", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Errorf("token request body = %s without permissions, want none", sent)
+	}
+
+	for _, s := range []string{"contents", "=read", "contents=none", "contents=Read"} {
+		if _, err := parseTokenPermissions(s); err == nil {
+			t.Errorf("parseTokenPermissions(%q): expected an error", s)
+		}
+	}
+}
+
+func TestGitHubAPIURL(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	// a GitHub Enterprise Server serves its API under /api/v3
+	var paths []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/api/v3")
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	if err := setGitHubAPIURL(server.URL + "/api/v3/"); err != nil {
+		t.Fatal(err)
+	}
+	if githubAPIURL != server.URL+"/api/v3" || githubWebURL != server.URL {
+		t.Errorf("API URL %s and web URL %s, want %s/api/v3 and %s", githubAPIURL, githubWebURL, server.URL, server.URL)
+	}
+
+	if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if _, err := fetchRateLimit(context.Background(), "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/api/v3/app/installations/1/access_tokens", "/api/v3/repos/owner/repo/contents/file.txt", "/api/v3/rate_limit"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("requests for %q, want %q", paths, want)
+	}
+
+	for _, apiURL := range []string{"api.github.com", "ftp://ghe.example.com/api/v3", "https://"} {
+		if err := setGitHubAPIURL(apiURL); err == nil {
+			t.Errorf("setGitHubAPIURL(%q): expected an error", apiURL)
+		}
+	}
+	if err := setGitHubAPIURL("https://api.github.com/"); err != nil || githubAPIURL != "https://api.github.com" || githubWebURL != "https://github.com" {
+		t.Errorf("API URL %s and web URL %s, want https://api.github.com and https://github.com", githubAPIURL, githubWebURL)
+	}
+}
+
+func TestTruncatedDownloadsAreNotServed(t *testing.T) {
+	tests := []struct {
+		name     string
+		truncate func(w http.ResponseWriter, content string)
+	}{
+		{"connection reset", func(w http.ResponseWriter, content string) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			io.WriteString(w, content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}},
+		{"short body", func(w http.ResponseWriter, content string) {
+			io.WriteString(w, content[:len(content)/2])
+		}},
+	}
+
+	for _, tt := range tests {
+		gh, handler := newTestProxy(t)
+		gh.setFile("owner", "repo", "file.txt", "0123456789")
+		gh.inlineMax = 0
+		setForTest(t, maxRetries, 0)
+
+		var truncate atomic.Bool
+		truncate.Store(true)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/git/blobs/") && truncate.Load() {
+				tt.truncate(w, "0123456789")
+				return
+			}
+			gh.serveHTTP(w, r)
+		}))
+		setForTest(t, &githubAPIURL, server.URL)
+
+		resp := get(handler, "/owner/repo/file.txt")
+		if got := body(t, resp); resp.StatusCode != http.StatusBadGateway || strings.Contains(got, "01234") {
+			t.Errorf("%s: status %d, body %q; want 502 without the partial file", tt.name, resp.StatusCode, got)
+		}
+
+		// the partial file wasn't cached
+		truncate.Store(false)
+		resp = get(handler, "/owner/repo/file.txt")
+		if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "0123456789" {
+			t.Errorf("%s: status %d, body %q; want the whole file", tt.name, resp.StatusCode, got)
+		}
+		server.Close()
+	}
+}
+
+func TestMaxJSONSize(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "big.txt", strings.Repeat("x", 4096))
+	gh.setFile("owner", "repo", "small.txt", "x")
+	setForTest(t, maxRetries, 0)
+	if _, err := defaultApp.getInstallationToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an oversized contents or rate limit response fails cleanly
+	setForTest(t, maxJSONSize, 1024)
+	if resp := get(handler, "/owner/repo/big.txt"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("big.txt: status = %d, want 502", resp.StatusCode)
+	}
+	if resp := get(handler, "/owner/repo/small.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("small.txt: status = %d, want 200", resp.StatusCode)
+	}
+
+	setForTest(t, maxJSONSize, 16)
+	if _, err := fetchRateLimit(context.Background(), "token"); !errors.Is(err, errJSONTooLarge) {
+		t.Errorf("rate limit: error = %v, want %v", err, errJSONTooLarge)
+	}
+
+	// even when the limit is exceeded by a single byte
+	setForTest(t, maxJSONSize, 8)
+	for _, tt := range []struct {
+		body string
+		err  error
+	}{
+		{`"1234"`, nil},
+		{`"123456"`, nil},
+		{`"1234567"`, errJSONTooLarge},
+	} {
+		var v string
+		if err := json.NewDecoder(limitJSON(strings.NewReader(tt.body))).Decode(&v); !errors.Is(err, tt.err) {
+			t.Errorf("decode %s: error = %v, want %v", tt.body, err, tt.err)
+		}
+	}
+}
+
+func TestGitHubAPIVersion(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.inlineMax = 0
+	setForTest(t, archivedBehavior, "warn")
+
+	for _, version := range []string{"2026-03-10", ""} {
+		setForTest(t, githubAPIVersion, version)
+		setForTest(t, &fileCache, make(map[string]fileCacheEntry))
+		setForTest(t, &repoInfoCache, newLRUMap[repoInfoEntry](100))
+		n := gh.count("/")
+
+		// token, repo, contents, blob and rate limit requests
+		if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		if _, err := fetchRateLimit(context.Background(), "token"); err != nil {
+			t.Fatal(err)
+		}
+
+		gh.mu.Lock()
+		requests := gh.requests[n:]
+		gh.mu.Unlock()
+		if len(requests) < 4 {
+			t.Errorf("version %q: %d requests sent to GitHub, want at least 4", version, len(requests))
+		}
+		for _, req := range requests {
+			if got := req.Header.Get("X-GitHub-Api-Version"); got != version {
+				t.Errorf("version %q: %s sent with X-GitHub-Api-Version %q", version, req.URL.Path, got)
+			}
+		}
+	}
+}
+
+func TestStreamedFilesOutlastGitHubTimeout(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	content := strings.Repeat("0123456789", 400)
+	gh.setFile("owner", "repo", "large.bin", content)
+	gh.inlineMax = 0
+	gh.stall = 200 * time.Millisecond
+
+	setForTest(t, &githubClient, newGitHubClient(0, 100*time.Millisecond))
+	setForTest(t, &streamClient, newStreamClient(0, 100*time.Millisecond))
+	setForTest(t, streamThreshold, 1000)
+
+	resp := get(handler, "/owner/repo/large.bin")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := body(t, resp); got != content {
+		t.Errorf("got %d of %d bytes", len(got), len(content))
+	}
+	if n := gh.count("/repos/owner/repo/git/blobs/"); n != 1 {
+		t.Errorf("%d blob requests sent to GitHub, want 1", n)
+	}
+}
+
+func TestGitHubClientTimeout(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	setForTest(t, maxRetries, 0)
+	if _, err := defaultApp.getInstallationToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	// GitHub hangs on a contents request
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/") {
+			<-release
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	defer close(release)
+	setForTest(t, &githubAPIURL, server.URL)
+	setForTest(t, &githubClient, newGitHubClient(0, 50*time.Millisecond))
+
+	start := time.Now()
+	if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %s, want it cut off by the 50ms timeout", elapsed)
+	}
+}
+
+func TestStreamClientTimesOutWaitingForHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	resp, err := newStreamClient(0, 50*time.Millisecond).Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the response headers to time out")
+	}
+}
+
+func TestStreamedLFSObjectsOutlastGitHubTimeout(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	content := strings.Repeat("0123456789", 400)
+	gh.setLFSFile("owner", "repo", "large.bin", content)
+	gh.stall = 200 * time.Millisecond
+
+	setForTest(t, &githubClient, newGitHubClient(0, 100*time.Millisecond))
+	setForTest(t, &streamClient, newStreamClient(0, 100*time.Millisecond))
+	setForTest(t, streamThreshold, 1000)
+
+	resp := get(handler, "/owner/repo/large.bin")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := body(t, resp); got != content {
+		t.Errorf("got %d of %d bytes", len(got), len(content))
+	}
+	if n := gh.count("/lfs/"); n != 1 {
+		t.Errorf("%d LFS downloads sent to GitHub, want 1", n)
+	}
+}
@@ -1,66 +1,801 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 func requestHandler(ctx context.Context) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestsTotal.Inc()
+
 		if ctx.Err() != nil {
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-			log.Printf("Error [%d]: %s\n", http.StatusServiceUnavailable, "Service unavailable; terminating")
+			httpError(w, http.StatusServiceUnavailable, "Service Unavailable", errors.New("service unavailable; terminating"))
 			return
 		}
 
-		if err := checkLimits(r); err != nil {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			log.Printf("Error [%d]: %s\n", http.StatusTooManyRequests, err)
+		// GitHub requests made for the request are canceled if the client goes
+		// away or the request timeout expires
+		if *requestTimeout > 0 {
+			reqCtx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+			defer cancel()
+			r = r.WithContext(reqCtx)
+		}
+
+		if r.URL.Path == "/" {
+			serveRoot(w, r)
 			return
 		}
 
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			log.Printf("Error [%d]: %s\n", http.StatusMethodNotAllowed, "Invalid request method")
+		if err := checkLimits(r); errors.Is(err, errRateLimitUnknown) {
+			httpError(w, http.StatusServiceUnavailable, "Service Unavailable", err)
+			return
+		} else if err != nil {
+			setRetryAfter(w, err)
+			httpError(w, http.StatusTooManyRequests, "Too Many Requests", err)
 			return
 		}
 
-		installationToken, err := getInstallationToken()
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error [%d]: %s\n", http.StatusInternalServerError, err)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			httpError(w, http.StatusMethodNotAllowed, "Method Not Allowed", errors.New("invalid request method"))
 			return
 		}
 
-		// Parse the request URL: /owner/repo/path/to/file
+		if len(allowedParams) > 0 {
+			if unknown := filterParams(r.URL); len(unknown) > 0 && *unknownParams == "reject" {
+				httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("unknown query parameters: %s", strings.Join(unknown, ", ")))
+				return
+			}
+		}
+
+		if *rejectGetBody && hasBody(r) {
+			httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("%s request has a body", r.Method))
+			return
+		}
+
+		if err := authenticator.Authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "Unauthorized", err)
+			return
+		}
+
+		// Parse the request URL: /owner/repo/path/to/file, where /owner/repo and
+		// /owner/repo/ have an empty path
 		parts := strings.SplitN(r.URL.Path, "/", 4)
+		if len(parts) == 3 && parts[2] != "" {
+			parts = append(parts, "")
+		}
 		if len(parts) < 4 {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			log.Printf("Error [%d]: %s\n", http.StatusBadRequest, "Invalid request path")
+			httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("invalid request path: %s", r.URL.Path))
 			return
 		}
 		owner, repo, filePath := parts[1], parts[2], parts[3]
 
-		log.Printf("incoming request: %s %s [owner: %s, repo: %s, path: %s]\n", r.Method, r.URL.Path, owner, repo, filePath)
+		if filePath == "" {
+			switch *emptyPathBehavior {
+			case "reject":
+				httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("empty file path: %s", r.URL.Path))
+				return
+			case "index":
+				filePath = *repoIndexFile
+			}
+		}
+		ref := r.URL.Query().Get("ref")
+		if ref != "" && !isValidRef(ref) {
+			httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("invalid ref: %q", ref))
+			return
+		}
+
+		if !isRepoAllowed(owner, repo) {
+			httpError(w, http.StatusForbidden, "Permission Denied", fmt.Errorf("repo %s/%s is not allowed", owner, repo))
+			return
+		}
+
+		app, err := appForRequest(r, owner)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Bad Request", err)
+			return
+		}
+
+		if err := checkUpstreamPaused(app.installationID); err != nil {
+			setRetryAfter(w, err)
+			httpError(w, http.StatusTooManyRequests, "Too Many Requests", err)
+			return
+		}
+
+		tokenStart := time.Now()
+		installationToken, err := app.getInstallationToken()
+		tokenDuration := time.Since(tokenStart)
+		if setRetryAfter(w, err) {
+			httpError(w, http.StatusTooManyRequests, "Too Many Requests", err)
+			return
+		} else if err != nil {
+			if *tokenFailureBehavior == "serve-stale" {
+				if checkErr := checkStaleAllowed(r.Context(), w, owner, repo, filePath, ref); checkErr != nil {
+					log.Printf("not serving %s/%s/%s from cache: %v\n", owner, repo, filePath, checkErr)
+				} else if serveStale(w, r, owner, repo, filePath, ref) {
+					log.Printf("served %s/%s/%s from cache as no installation token is available: %v\n", owner, repo, filePath, err)
+					return
+				}
+			}
+
+			if *tokenFailureBehavior != "error" {
+				w.Header().Set("Retry-After", strconv.Itoa(int(tokenFailureRetryAfter.Seconds())))
+				httpError(w, http.StatusServiceUnavailable, "Service Unavailable", err)
+				return
+			}
 
-		for _, elem := range strings.Split(filePath, "/") {
-			if len(elem) > 0 && elem[0] == '.' {
-				http.Error(w, "Permission Denied", http.StatusForbidden)
-				log.Printf("Error [%d]: %s\n", http.StatusForbidden, "Permission denied")
+			httpError(w, http.StatusInternalServerError, "Internal Server Error", err)
+			return
+		}
+
+		log.Printf("incoming request: %s %s [owner: %s, repo: %s, path: %s, ref: %s]\n", r.Method, redactedURI(r.URL), owner, repo, filePath, ref)
+
+		if isHiddenPath(filePath) {
+			httpError(w, http.StatusForbidden, "Permission Denied", fmt.Errorf("hidden path: %s", filePath))
+			return
+		}
+
+		if err := checkRefAllowed(r.Context(), owner, repo, ref, installationToken); err != nil {
+			httpError(w, http.StatusForbidden, "Permission Denied", err)
+			return
+		}
+
+		if *archivedBehavior != "serve" {
+			if archived, err := isArchived(r.Context(), owner, repo, installationToken); err != nil {
+				log.Printf("unable to check whether %s/%s is archived: %v\n", owner, repo, err)
+			} else if archived && *archivedBehavior == "block" {
+				httpError(w, http.StatusGone, "Gone", fmt.Errorf("repository %s/%s is archived", owner, repo))
 				return
+			} else if archived {
+				w.Header().Set("Warning", `299 - "repository is archived"`)
+			}
+		}
+
+		if *emptyPathBehavior == "repo-index" && filePath == "" {
+			serveRepoIndex(w, r, owner, repo, ref, installationToken)
+			return
+		}
+
+		if *sitemapEnabled && filePath == "sitemap.xml" {
+			serveSitemap(w, r, owner, repo, ref, installationToken)
+			return
+		}
+
+		filePath, err = resolveRepoPath(owner, repo, filePath)
+		if err != nil {
+			httpError(w, http.StatusForbidden, "Permission Denied", err)
+			return
+		}
+
+		var conditional http.Header
+		if *forwardConditional {
+			conditional = r.Header
+		}
+
+		// near the end of the rate limit, save what remains for cached files,
+		// which are revalidated with conditional requests that don't count
+		// against it
+		if *shedBelow > 0 {
+			if reset, low := lowHeadroom(app.installationID); low {
+				if cached, _ := getCachedFile(fileCacheKey(owner, repo, filePath, ref)); cached == nil {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
+					httpError(w, http.StatusServiceUnavailable, "Service Unavailable", fmt.Errorf("shedding uncached request for %s/%s/%s; GitHub rate limit nearly exhausted", owner, repo, filePath))
+					return
+				}
 			}
 		}
 
-		content, contentType, err := GetFileContent(owner, repo, filePath, installationToken)
+		upstreamStart := time.Now()
+		// files are only streamed if served as is, without reading them whole
+		stream := *signingKey == "" && !*detectCharset && !(*decompressGzip && strings.HasSuffix(filePath, ".gz")) && r.URL.Query().Get("format") != "json"
+
+		file, err := GetFileContent(r.Context(), owner, repo, filePath, ref, installationToken, conditional, stream)
+		upstreamDuration := time.Since(upstreamStart)
 		if err != nil {
-			http.Error(w, "File Not Found", http.StatusNotFound)
-			log.Printf("Error [%d]: %s\n", http.StatusNotFound, err)
+			var upstreamErr *upstreamError
+			if *echoRequestID && errors.As(err, &upstreamErr) && upstreamErr.RequestID != "" {
+				w.Header().Set(githubRequestIDHeader, upstreamErr.RequestID)
+			}
+
+			upstreamFailure(w, err)
 			return
 		}
+		if file.Body != nil {
+			defer file.Body.Close()
+		}
 
-		w.Header().Set("Content-Type", contentType)
-		w.Write(content)
+		if file.SymlinkTarget != "" && *symlinkBehavior == "follow" {
+			file, filePath, err = followSymlinks(r.Context(), owner, repo, filePath, ref, installationToken, file)
+			if errors.Is(err, errSymlinkForbidden) {
+				httpError(w, http.StatusForbidden, "Permission Denied", err)
+				return
+			} else if err != nil {
+				upstreamFailure(w, err)
+				return
+			}
+		} else if file.SymlinkTarget != "" {
+			file.Content = []byte(file.SymlinkTarget)
+			file.ContentType = "text/plain; charset=utf-8"
+		}
+		upstreamDuration = time.Since(upstreamStart)
+
+		if *echoRequestID && file.RequestID != "" {
+			w.Header().Set(githubRequestIDHeader, file.RequestID)
+		}
+
+		if file.Stale {
+			w.Header().Add("Warning", `110 - "Response is Stale"`)
+		}
+
+		if *serverTiming {
+			w.Header().Set("Server-Timing", formatServerTiming(map[string]time.Duration{
+				"token":    tokenDuration,
+				"upstream": upstreamDuration,
+				"total":    time.Since(start),
+			}))
+		}
+
+		if isCommitSHA(ref) {
+			// content at a commit never changes, so clients need never revalidate
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else if ttl := cacheTTLFor(file.ContentType); ttl > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+		} else if file.CacheControl != "" {
+			w.Header().Set("Cache-Control", file.CacheControl)
+		} else if *defaultCacheControl != "" {
+			w.Header().Set("Cache-Control", *defaultCacheControl)
+		}
+
+		if (*forwardConditional || *relayETag) && file.ETag != "" {
+			// relay GitHub's ETag; ServeContent answers matching If-None-Match
+			// requests with 304
+			w.Header().Set("ETag", file.ETag)
+		}
+
+		if *forwardConditional {
+			// relay GitHub's validators so clients can make conditional requests
+			if file.LastModified != "" {
+				w.Header().Set("Last-Modified", file.LastModified)
+			}
+
+			if file.NotModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		if file.Listing != nil || r.URL.Query().Get("format") == "json" {
+			serveListing(w, r, owner, repo, filePath, file)
+			return
+		}
+
+		if file.Body != nil {
+			serveStream(w, r, file)
+			return
+		}
+
+		if *decompressGzip && strings.HasSuffix(filePath, ".gz") {
+			// the response now depends on whether the client accepts gzip
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			if !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+				content, err := gunzip(file.Content, *maxDecompressed)
+				if err != nil {
+					httpError(w, http.StatusBadGateway, "Bad Gateway", err)
+					return
+				}
+
+				file.Content = content
+				file.ContentType = detectContentType(strings.TrimSuffix(filePath, ".gz"), content, isSniffingAllowed(owner, repo))
+
+				// GitHub's ETag identifies the compressed file
+				w.Header().Del("ETag")
+			}
+		}
+
+		if *detectCharset {
+			file.ContentType = withCharset(file.ContentType, file.Content)
+		}
+
+		// ServeContent handles HEAD, Range and If-Modified-Since requests. The
+		// modification time is only known from GitHub's Last-Modified; the zero
+		// time leaves it out rather than advertising a time that changes on
+		// every request.
+		modTime, _ := http.ParseTime(file.LastModified)
+
+		if *signingKey != "" {
+			w = signResponse(w, file.Content)
+		}
+
+		w.Header().Set("Content-Type", file.ContentType)
+		http.ServeContent(w, r, path.Base(filePath), modTime, bytes.NewReader(file.Content))
 	}
 }
+
+// filterParams returns the sorted names of the query parameters in u that
+// aren't -allowed-params. If -unknown-params is strip, they are also removed
+// from u.
+func filterParams(u *neturl.URL) []string {
+	query := u.Query()
+
+	var unknown []string
+	for name := range query {
+		if !allowedParams[name] {
+			unknown = append(unknown, name)
+			delete(query, name)
+		}
+	}
+	sort.Strings(unknown)
+
+	if len(unknown) > 0 && *unknownParams == "strip" {
+		u.RawQuery = query.Encode()
+	}
+
+	return unknown
+}
+
+// maxDrainedBody is the most of a rejected request body that is read to allow
+// the connection to be reused.
+const maxDrainedBody = 64 * 1024
+
+// hasBody reports whether the request has a non-empty body, which it drains.
+func hasBody(r *http.Request) bool {
+	if r.ContentLength == 0 {
+		return false
+	}
+
+	n, _ := io.Copy(io.Discard, io.LimitReader(r.Body, maxDrainedBody))
+	return n > 0
+}
+
+// tokenFailureRetryAfter is the Retry-After sent with 503 responses to requests
+// failing for want of an installation token.
+const tokenFailureRetryAfter = 30 * time.Second
+
+// checkStaleAllowed applies the checks a request must pass to be served,
+// which serveStale can't make for itself, using only cached repo metadata as
+// there is no installation token to fetch it with. It returns an error if the
+// file is hidden, the ref isn't allowed, or the repo is archived and
+// -archived-behavior is block, or if metadata needed to tell isn't cached.
+// For an archived repo with -archived-behavior warn it sets the Warning header.
+func checkStaleAllowed(ctx context.Context, w http.ResponseWriter, owner, repo, filePath, ref string) error {
+	if isHiddenPath(filePath) {
+		return fmt.Errorf("hidden path: %s", filePath)
+	}
+
+	if err := checkRefAllowed(ctx, owner, repo, ref, ""); err != nil {
+		return err
+	}
+
+	if *archivedBehavior == "serve" {
+		return nil
+	}
+
+	archived, err := isArchived(ctx, owner, repo, "")
+	if err != nil && *archivedBehavior == "block" {
+		return err
+	} else if archived && *archivedBehavior == "block" {
+		return fmt.Errorf("repository %s/%s is archived", owner, repo)
+	} else if archived {
+		w.Header().Set("Warning", `299 - "repository is archived"`)
+	}
+
+	return nil
+}
+
+// serveStale serves the cached copy of a file, however old, reporting whether
+// there was one. It is used when the file can't be fetched from GitHub, only
+// once checkStaleAllowed has passed.
+func serveStale(w http.ResponseWriter, r *http.Request, owner, repo, filePath, ref string) bool {
+	if isHiddenPath(filePath) {
+		return false
+	}
+
+	filePath, err := resolveRepoPath(owner, repo, filePath)
+	if err != nil {
+		return false
+	}
+
+	file, _ := getCachedFile(fileCacheKey(owner, repo, filePath, ref))
+	if file == nil || file.Listing != nil {
+		return false
+	}
+
+	if *signingKey != "" {
+		w = signResponse(w, file.Content)
+	}
+
+	modTime, _ := http.ParseTime(file.LastModified)
+
+	w.Header().Add("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Content-Type", file.ContentType)
+	http.ServeContent(w, r, path.Base(filePath), modTime, bytes.NewReader(file.Content))
+
+	return true
+}
+
+// requestScheme returns the scheme a request was made with: https if it was
+// received over TLS, otherwise that of X-Forwarded-Proto if it was set by one
+// of the -trusted-proxies, otherwise http. The header is ignored from other
+// peers, which could set it to anything.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if !isTrustedProxy(remoteIP(r)) {
+		return "http"
+	}
+
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		return proto
+	}
+
+	return "http"
+}
+
+// redirectHTTP wraps next, redirecting plain HTTP requests to the HTTPS
+// equivalent with 301 Moved Permanently. Requests are taken to be HTTPS if they
+// were received over TLS, or if one of the -trusted-proxies has set
+// X-Forwarded-Proto to https.
+func redirectHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestScheme(r) == "https" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// restrictHosts wraps next, rejecting requests whose Host header isn't one of
+// the -allowed-hosts with 421 Misdirected Request. A host is allowed if it is
+// listed either with its port or without one.
+func restrictHosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+
+		if !allowedHosts[host] && !allowedHosts[hostname] {
+			httpError(w, http.StatusMisdirectedRequest, "Misdirected Request", fmt.Errorf("unexpected host: %s", r.Host))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// collapseSlashes wraps next, collapsing runs of slashes in the request path so
+// that /owner/repo//dir///file is served as /owner/repo/dir/file. With
+// -strict-paths such requests are rejected instead.
+func collapseSlashes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "//") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if *strictPaths {
+			httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("duplicate slashes in path: %s", r.URL.Path))
+			return
+		}
+
+		var b strings.Builder
+		for i := 0; i < len(r.URL.Path); i++ {
+			if r.URL.Path[i] == '/' && i > 0 && r.URL.Path[i-1] == '/' {
+				continue
+			}
+			b.WriteByte(r.URL.Path[i])
+		}
+
+		r.URL.Path = b.String()
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveRoot responds to requests for the bare root path according to -root-behavior.
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "Method Not Allowed", errors.New("invalid request method"))
+		return
+	}
+
+	switch *rootBehavior {
+	case "redirect":
+		http.Redirect(w, r, *rootRedirectURL, http.StatusFound)
+	case "index":
+		http.ServeFile(w, r, *rootIndexFile)
+	default:
+		httpError(w, http.StatusNotFound, "Not Found", errors.New("no file requested"))
+	}
+}
+
+// signContent returns the X-Content-Signature of content: "sha256=" followed
+// by the lowercase hex encoded HMAC-SHA256 of content, keyed by key, the bytes
+// of the -signing-key string. content is the whole file exactly as served
+// without Content-Encoding: after -decompress-gzip, but before -compress.
+func signContent(key, content []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingWriter adds the X-Content-Signature of a file to a response only if
+// it is a 200 carrying the whole file, not a 206 or 304 whose body doesn't
+// match the signature.
+type signingWriter struct {
+	http.ResponseWriter
+	signature   string
+	wroteHeader bool
+}
+
+// signResponse returns w wrapped to sign a response serving content.
+func signResponse(w http.ResponseWriter, content []byte) http.ResponseWriter {
+	return &signingWriter{ResponseWriter: w, signature: signContent([]byte(*signingKey), content)}
+}
+
+func (s *signingWriter) WriteHeader(status int) {
+	if !s.wroteHeader && status == http.StatusOK {
+		s.Header().Set("X-Content-Signature", s.signature)
+	}
+	s.wroteHeader = true
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *signingWriter) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *signingWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// formatServerTiming formats durations as a Server-Timing header value, in milliseconds.
+func formatServerTiming(metrics map[string]time.Duration) string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fmt.Sprintf("%s;dur=%.3f", name, float64(metrics[name].Microseconds())/1000))
+	}
+
+	return strings.Join(entries, ", ")
+}
+
+// serveStream copies a streamed file to the client. Unlike files read into
+// memory, streamed files are always served whole, ignoring Range and
+// conditional requests.
+func serveStream(w http.ResponseWriter, r *http.Request, file *FileContent) {
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if n, err := io.Copy(w, file.Body); err != nil || n != file.Size {
+		log.Printf("Error streaming file: copied %d of %d bytes: %v\n", n, file.Size, err)
+	}
+}
+
+// maxSymlinkHops is the most symlinks followed in resolving a path.
+const maxSymlinkHops = 8
+
+var errSymlinkForbidden = fmt.Errorf("symlink target not allowed")
+
+// followSymlinks fetches the target of the symlink file at the repo path
+// filePath, and the targets of any symlinks it leads to, returning the final
+// file and its repo path. Targets must be within the repo root and not hidden.
+func followSymlinks(ctx context.Context, owner, repo, filePath, ref, token string, file *FileContent) (*FileContent, string, error) {
+	root := repoRootFor(owner, repo)
+
+	for hops := 0; file.SymlinkTarget != ""; hops++ {
+		if hops == maxSymlinkHops {
+			return nil, "", fmt.Errorf("too many levels of symlinks: %s", filePath)
+		}
+
+		target := path.Join(path.Dir(filePath), file.SymlinkTarget)
+		if path.IsAbs(file.SymlinkTarget) || target == ".." || strings.HasPrefix(target, "../") {
+			return nil, "", fmt.Errorf("%w: %s points outside the repo", errSymlinkForbidden, filePath)
+		}
+
+		relative := target
+		if root != "" {
+			if !strings.HasPrefix(target, root+"/") {
+				return nil, "", fmt.Errorf("%w: %s points outside the repo root", errSymlinkForbidden, filePath)
+			}
+			relative = strings.TrimPrefix(target, root+"/")
+		}
+
+		if isHiddenPath(relative) {
+			return nil, "", fmt.Errorf("%w: %s points to a hidden path", errSymlinkForbidden, filePath)
+		}
+
+		var err error
+		if file, err = GetFileContent(ctx, owner, repo, target, ref, token, nil, false); err != nil {
+			return nil, "", err
+		}
+		filePath = target
+	}
+
+	return file, filePath, nil
+}
+
+// upstreamFailure responds to a request that failed with err fetching from
+// GitHub: 429 if GitHub's rate limit was exceeded, 504 if GitHub or the request
+// timed out, 404 if GitHub doesn't have the file, 409 if it is a submodule, 500
+// if GitHub rejected the proxy's credentials, which clients can't remedy, and
+// 502 for any other error or response.
+func upstreamFailure(w http.ResponseWriter, err error) {
+	switch {
+	case setRetryAfter(w, err):
+		httpError(w, http.StatusTooManyRequests, "Too Many Requests", err)
+	case isTimeout(err):
+		httpError(w, http.StatusGatewayTimeout, "Gateway Timeout", err)
+	case errors.Is(err, errNotFound):
+		httpError(w, http.StatusNotFound, "File Not Found", err)
+	case errors.Is(err, errSubmodule):
+		httpError(w, http.StatusConflict, "Conflict", err)
+	case errors.Is(err, errUpstreamAuth):
+		httpError(w, http.StatusInternalServerError, "Internal Server Error", err)
+	default:
+		httpError(w, http.StatusBadGateway, "Bad Gateway", err)
+	}
+}
+
+// isTimeout reports whether err is due to a timeout, either of a GitHub
+// request or of the client request it was made for.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// setRetryAfter sets the Retry-After header, in whole seconds, if err is due to
+// GitHub's rate limit, and reports whether it was.
+func setRetryAfter(w http.ResponseWriter, err error) bool {
+	wait, ok := retryAfter(err)
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return true
+}
+
+// httpError responds with status and message, logging err. If -verbose-errors is
+// set, err is appended to the response body to help debugging; it must never
+// contain secrets.
+func httpError(w http.ResponseWriter, status int, message string, err error) {
+	if *verboseErrors && err != nil {
+		message = fmt.Sprintf("%s: %v", message, err)
+	}
+
+	http.Error(w, message, status)
+	log.Printf("Error [%d]: %s\n", status, err)
+}
+
+// isCommitSHA reports whether ref is a full hex commit SHA (SHA-1 or SHA-256).
+func isCommitSHA(ref string) bool {
+	if len(ref) != 40 && len(ref) != 64 {
+		return false
+	}
+
+	for _, c := range ref {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// maxRefLength is the longest ref accepted in a request.
+const maxRefLength = 255
+
+// isValidRef reports whether ref is a plausible branch, tag, commit SHA or pull
+// request ref: ASCII letters, digits, '.', '_', '-' and '/' only, without empty
+// or dot-prefixed path elements or a "..", and not starting with '-'.
+func isValidRef(ref string) bool {
+	if len(ref) > maxRefLength || strings.HasPrefix(ref, "-") || strings.Contains(ref, "..") {
+		return false
+	}
+
+	for _, c := range ref {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("._-/", c)) {
+			return false
+		}
+	}
+
+	for _, elem := range strings.Split(ref, "/") {
+		if elem == "" || strings.HasPrefix(elem, ".") || strings.HasSuffix(elem, ".lock") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isHiddenPath reports whether any element of filePath starts or ends with a dot.
+// Elements are NFKC normalized first so that unicode lookalikes of '.', such as
+// U+FF0E FULLWIDTH FULL STOP or U+2024 ONE DOT LEADER, are caught as well.
+func isHiddenPath(filePath string) bool {
+	for _, elem := range strings.Split(filePath, "/") {
+		elem = norm.NFKC.String(elem)
+		if elem == "" {
+			continue
+		}
+
+		first, _ := utf8.DecodeRuneInString(elem)
+		last, _ := utf8.DecodeLastRuneInString(elem)
+		if isDot(first) || isDot(last) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDot reports whether r is a full stop once NFKC normalized.
+func isDot(r rune) bool {
+	return r == '.' || r == '\u3002' // IDEOGRAPHIC FULL STOP
+}
+
+// repoRootFor returns the configured root directory for a repo, without surrounding slashes.
+func repoRootFor(owner, repo string) string {
+	root, ok := repoRoots[repoKey(owner, repo)]
+	if !ok {
+		root = *repoRoot
+	}
+
+	return strings.Trim(root, "/")
+}
+
+// resolveRepoPath prefixes filePath with the configured root for the repo,
+// refusing any path that would resolve outside of that root.
+func resolveRepoPath(owner, repo, filePath string) (string, error) {
+	root := repoRootFor(owner, repo)
+	if root == "" {
+		return filePath, nil
+	}
+
+	resolved := path.Join(root, filePath)
+	if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+		return "", fmt.Errorf("path %s escapes repo root %s", filePath, root)
+	}
+
+	return resolved, nil
+}
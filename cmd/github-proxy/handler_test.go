@@ -0,0 +1,1197 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsHiddenPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		hidden bool
+	}{
+		{path: "index.html"},
+		{path: "docs/guide.md"},
+		{path: "a.b/c.d"},
+		{path: ""},
+		{path: ".env", hidden: true},
+		{path: "config/.secrets/key", hidden: true},
+		{path: "docs/.git/config", hidden: true},
+		{path: "..", hidden: true},
+		{path: "docs/../.env", hidden: true},
+
+		// trailing dots, which some filesystems and servers strip
+		{path: "env.", hidden: true},
+		{path: "docs./file", hidden: true},
+		{path: "file...", hidden: true},
+
+		// unicode lookalikes of '.'
+		{path: "．env", hidden: true},             // FULLWIDTH FULL STOP
+		{path: "․env", hidden: true},             // ONE DOT LEADER
+		{path: "﹒env", hidden: true},             // SMALL FULL STOP
+		{path: "。env", hidden: true},             // IDEOGRAPHIC FULL STOP
+		{path: "docs/．git/config", hidden: true}, // in a directory
+		{path: "env．", hidden: true},             // trailing
+		{path: "docs/résumé.pdf"},                // unrelated non-ASCII is fine
+		{path: "‥env", hidden: true},             // TWO DOT LEADER normalizes to ".."
+	}
+
+	for _, tt := range tests {
+		if got := isHiddenPath(tt.path); got != tt.hidden {
+			t.Errorf("isHiddenPath(%q) = %t, want %t", tt.path, got, tt.hidden)
+		}
+	}
+}
+
+func TestHiddenPathsAreForbidden(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", ".env", "SECRET=1")
+	gh.setFile("owner", "repo", "env.", "SECRET=1")
+
+	for _, target := range []string{
+		"/owner/repo/.env",
+		"/owner/repo/env.",
+		"/owner/repo/%EF%BC%8Eenv",
+		"/owner/repo/docs/%E2%80%A4git/config",
+	} {
+		if resp := get(handler, target); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s: status = %d, want 403", target, resp.StatusCode)
+		}
+	}
+
+	if n := gh.count("/repos/owner/repo/contents/"); n != 0 {
+		t.Errorf("%d contents requests sent to GitHub for hidden paths", n)
+	}
+}
+
+func TestPullRequestRefs(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "index.html", "preview")
+
+	tests := []struct {
+		ref    string
+		status int
+	}{
+		{"pull/123/head", http.StatusOK},
+		{"pull/123/merge", http.StatusOK},
+		{"pull/123//head", http.StatusBadRequest},
+		{"pull/123/../head", http.StatusBadRequest},
+		{"pull/123/.head", http.StatusBadRequest},
+		{"pull/123/head.lock", http.StatusBadRequest},
+		{"pull/123/head%3Fx%3D1", http.StatusBadRequest},
+		{"-pull/123/head", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		n := gh.count("/repos/owner/repo/contents/")
+		resp := get(handler, "/owner/repo/index.html?ref="+tt.ref)
+		if resp.StatusCode != tt.status {
+			t.Errorf("ref %s: status = %d, want %d", tt.ref, resp.StatusCode, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			if got := gh.count("/repos/owner/repo/contents/"); got != n {
+				t.Errorf("ref %s: %d requests sent to GitHub", tt.ref, got-n)
+			}
+			continue
+		}
+		if got := gh.lastRequest("/repos/owner/repo/contents/").URL.Query().Get("ref"); got != tt.ref {
+			t.Errorf("ref %s: GitHub asked for ref %q", tt.ref, got)
+		}
+	}
+}
+
+func TestResolveRepoPath(t *testing.T) {
+	setForTest(t, repoRoot, "/public/")
+	setForTest(t, &repoRoots, map[string]string{"owner/site": "site/dist"})
+
+	tests := []struct {
+		repo, path string
+		want       string
+		escapes    bool
+	}{
+		{repo: "repo", path: "index.html", want: "public/index.html"},
+		{repo: "repo", path: "docs/guide.md", want: "public/docs/guide.md"},
+		{repo: "repo", path: "docs/../index.html", want: "public/index.html"},
+		{repo: "repo", path: "", want: "public"},
+		{repo: "site", path: "index.html", want: "site/dist/index.html"},
+		{repo: "repo", path: "../secret.txt", escapes: true},
+		{repo: "repo", path: "docs/../../secret.txt", escapes: true},
+		{repo: "site", path: "../src/main.go", escapes: true},
+		{repo: "repo", path: "../publicity/secret.txt", escapes: true},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveRepoPath("owner", tt.repo, tt.path)
+		if tt.escapes {
+			if err == nil {
+				t.Errorf("%s %q: resolved to %q, want it refused", tt.repo, tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: resolved to %q, %v; want %q", tt.repo, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestRepoRoot(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "public/index.html", "public")
+	gh.setFile("owner", "repo", "secret.txt", "secret")
+	setForTest(t, repoRoot, "public")
+
+	resp := get(handler, "/owner/repo/index.html")
+	if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "public" {
+		t.Errorf("status %d, body %q; want the file under the repo root", resp.StatusCode, got)
+	}
+	if req := gh.lastRequest("/repos/owner/repo/contents/"); req == nil || req.URL.Path != "/repos/owner/repo/contents/public/index.html" {
+		t.Errorf("GitHub not asked for the file under the repo root")
+	}
+
+	n := gh.count("/repos/")
+	for _, target := range []string{"/owner/repo/%2E%2E/secret.txt", "/owner/repo/docs/%2E%2E/%2E%2E/secret.txt"} {
+		if resp := get(handler, target); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", target, resp.StatusCode)
+		}
+	}
+	if got := gh.count("/repos/"); got != n {
+		t.Errorf("%d requests sent to GitHub for paths outside the repo root", got-n)
+	}
+}
+
+func TestGitHubRequestID(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	setForTest(t, maxRetries, 0)
+	if _, err := defaultApp.getInstallationToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+
+	// the ID of a failed GitHub request is logged, but only echoed with
+	// -echo-github-request-id
+	gh.setStatus(http.StatusInternalServerError)
+	for _, echo := range []bool{false, true} {
+		setForTest(t, echoRequestID, echo)
+		logged.Reset()
+
+		resp := get(handler, "/owner/repo/file.txt")
+		id := "FAKE:" + strconv.Itoa(gh.count("/"))
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("echo %t: status = %d, want 502", echo, resp.StatusCode)
+		}
+		if got := logged.String(); !strings.Contains(got, "(GitHub request ID: "+id+")") {
+			t.Errorf("echo %t: log = %q, want GitHub request ID %s", echo, got, id)
+		}
+		if got, want := resp.Header.Get("X-GitHub-Request-Id"), map[bool]string{true: id}[echo]; got != want {
+			t.Errorf("echo %t: X-GitHub-Request-Id = %q, want %q", echo, got, want)
+		}
+	}
+
+	// as is that of a successful one
+	gh.setStatus(0)
+	resp := get(handler, "/owner/repo/file.txt")
+	if got, want := resp.Header.Get("X-GitHub-Request-Id"), "FAKE:"+strconv.Itoa(gh.count("/")); got != want {
+		t.Errorf("success: X-GitHub-Request-Id = %q, want %q", got, want)
+	}
+}
+
+func TestVerboseErrors(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	setForTest(t, maxRetries, 0)
+	if _, err := defaultApp.getInstallationToken(); err != nil {
+		t.Fatal(err)
+	}
+	gh.setStatus(http.StatusInternalServerError)
+
+	tests := []struct {
+		verbose bool
+		want    string
+	}{
+		{false, "Bad Gateway\n"},
+		{true, "Bad Gateway: failed to fetch file: 500 Internal Server Error (GitHub request ID: FAKE:"},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, verboseErrors, tt.verbose)
+
+		resp := get(handler, "/owner/repo/file.txt")
+		got := body(t, resp)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("verbose %t: status = %d, want 502", tt.verbose, resp.StatusCode)
+		}
+		if tt.verbose && !strings.HasPrefix(got, tt.want) || !tt.verbose && got != tt.want {
+			t.Errorf("verbose %t: body = %q, want %q", tt.verbose, got, tt.want)
+		}
+		if strings.Contains(got, "ghs_") {
+			t.Errorf("verbose %t: body = %q, which includes the installation token", tt.verbose, got)
+		}
+	}
+}
+
+func TestRootBehavior(t *testing.T) {
+	gh, handler := newTestProxy(t)
+
+	index := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(index, []byte("<h1>index</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, rootRedirectURL, "https://example.com/docs")
+	setForTest(t, rootIndexFile, index)
+
+	tests := []struct {
+		behavior string
+		status   int
+		location string
+		body     string
+	}{
+		{"404", http.StatusNotFound, "", "Not Found\n"},
+		{"redirect", http.StatusFound, "https://example.com/docs", ""},
+		{"index", http.StatusOK, "", "<h1>index</h1>"},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, rootBehavior, tt.behavior)
+
+		resp := get(handler, "/")
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.behavior, resp.StatusCode, tt.status)
+		}
+		if got := resp.Header.Get("Location"); got != tt.location {
+			t.Errorf("%s: Location = %q, want %q", tt.behavior, got, tt.location)
+		}
+		if got := body(t, resp); tt.body != "" && got != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.behavior, got, tt.body)
+		}
+
+		resp = serve(handler, httptest.NewRequest(http.MethodPost, "/", nil))
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: POST status = %d, want 405", tt.behavior, resp.StatusCode)
+		}
+	}
+	if got := gh.count("/"); got != 0 {
+		t.Errorf("%d requests sent to GitHub for /", got)
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "dir/file.txt", "content")
+	handler = collapseSlashes(handler)
+
+	for _, target := range []string{"/owner/repo//dir///file.txt", "//owner//repo/dir/file.txt"} {
+		resp := get(handler, target)
+		if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "content" {
+			t.Errorf("%s: status %d, body %q; want the file", target, resp.StatusCode, got)
+		}
+		if req := gh.lastRequest("/repos/owner/repo/contents/"); req == nil || req.URL.Path != "/repos/owner/repo/contents/dir/file.txt" {
+			t.Errorf("%s: GitHub not asked for the collapsed path", target)
+		}
+	}
+
+	// -strict-paths rejects the same paths without asking GitHub
+	setForTest(t, strictPaths, true)
+	n := gh.count("/")
+	if resp := get(handler, "/owner/repo//dir///file.txt"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("strict: status = %d, want 400", resp.StatusCode)
+	}
+	if resp := get(handler, "/owner/repo/dir/file.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("strict: status = %d for a path without duplicate slashes, want 200", resp.StatusCode)
+	}
+	if got := gh.count("/") - n; got != 1 {
+		t.Errorf("strict: %d requests sent to GitHub, want 1", got)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	if resp := get(handler, "/owner/repo/file.txt"); resp.Header.Get("Server-Timing") != "" {
+		t.Errorf("Server-Timing = %q without -server-timing", resp.Header.Get("Server-Timing"))
+	}
+
+	setForTest(t, serverTiming, true)
+	resp := get(handler, "/owner/repo/file.txt?ref=other")
+	header := resp.Header.Get("Server-Timing")
+	if !regexp.MustCompile(`^token;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}, upstream;dur=\d+\.\d{3}$`).MatchString(header) {
+		t.Errorf("Server-Timing = %q, want token, total and upstream durations", header)
+	}
+
+	got := formatServerTiming(map[string]time.Duration{"upstream": 1500 * time.Microsecond, "token": 0})
+	if want := "token;dur=0.000, upstream;dur=1.500"; got != want {
+		t.Errorf("formatServerTiming = %q, want %q", got, want)
+	}
+}
+
+func TestForwardConditional(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	setForTest(t, forwardConditional, true)
+
+	resp := get(handler, "/owner/repo/file.txt")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q; want 200 with GitHub's ETag", resp.StatusCode, etag)
+	}
+
+	// a matching If-None-Match goes to GitHub, and its 304 to the client
+	n := gh.count("/repos/owner/repo/contents/")
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = serve(handler, req)
+	if got := body(t, resp); resp.StatusCode != http.StatusNotModified || got != "" {
+		t.Errorf("status %d, body %q; want an empty 304", resp.StatusCode, got)
+	}
+	if got := resp.Header.Get("ETag"); got != etag {
+		t.Errorf("304 ETag = %q, want %q", got, etag)
+	}
+	if gh.count("/repos/owner/repo/contents/") != n+1 || gh.lastRequest("/repos/owner/repo/contents/").Header.Get("If-None-Match") != etag {
+		t.Error("If-None-Match not forwarded to GitHub")
+	}
+
+	// once the file changes GitHub, and so the proxy, answer with it
+	gh.setFile("owner", "repo", "file.txt", "changed")
+	resp = serve(handler, req)
+	if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "changed" {
+		t.Errorf("changed: status %d, body %q; want the new file", resp.StatusCode, got)
+	}
+
+	// without -forward-conditional the client's validators stay with the proxy
+	setForTest(t, forwardConditional, false)
+	if resp := serve(handler, req); resp.StatusCode != http.StatusOK {
+		t.Errorf("without -forward-conditional: status = %d, want 200", resp.StatusCode)
+	}
+	if got := gh.lastRequest("/repos/owner/repo/contents/").Header.Get("If-None-Match"); got == etag {
+		t.Error("without -forward-conditional: client's If-None-Match forwarded to GitHub")
+	}
+}
+
+func TestArchivedBehavior(t *testing.T) {
+	tests := []struct {
+		behavior string
+		archived bool
+		status   int
+		warning  string
+	}{
+		{"serve", true, http.StatusOK, ""},
+		{"warn", true, http.StatusOK, `299 - "repository is archived"`},
+		{"warn", false, http.StatusOK, ""},
+		{"block", true, http.StatusGone, ""},
+		{"block", false, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		gh, handler := newTestProxy(t)
+		gh.setFile("owner", "repo", "file.txt", "content")
+		gh.mu.Lock()
+		gh.archived["owner/repo"] = tt.archived
+		gh.mu.Unlock()
+		setForTest(t, archivedBehavior, tt.behavior)
+
+		for i := 0; i < 2; i++ {
+			resp := get(handler, "/owner/repo/file.txt")
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s, archived %t: status = %d, want %d", tt.behavior, tt.archived, resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Warning"); got != tt.warning {
+				t.Errorf("%s, archived %t: Warning = %q, want %q", tt.behavior, tt.archived, got, tt.warning)
+			}
+		}
+
+		// repo metadata is only fetched when needed, and then cached
+		want := 1
+		if tt.behavior == "serve" {
+			want = 0
+		}
+		if got := gh.count("/repos/owner/repo") - gh.count("/repos/owner/repo/"); got != want {
+			t.Errorf("%s, archived %t: repo metadata fetched %d times, want %d", tt.behavior, tt.archived, got, want)
+		}
+		if tt.status == http.StatusGone && gh.count("/repos/owner/repo/contents/") != 0 {
+			t.Errorf("%s, archived %t: file fetched from an archived repo", tt.behavior, tt.archived)
+		}
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "0123456789")
+
+	// GitHub's Last-Modified is the file's modification time
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/owner/repo/contents/") {
+			w.Header().Set("Last-Modified", lastModified)
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	resp := get(handler, "/owner/repo/file.txt")
+	for name, want := range map[string]string{
+		"Content-Type":   "text/plain; charset=utf-8",
+		"Content-Length": "10",
+		"Accept-Ranges":  "bytes",
+		"Last-Modified":  lastModified,
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	resp = serve(handler, req)
+	if got := body(t, resp); resp.StatusCode != http.StatusPartialContent || got != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("range: status %d, Content-Range %q, body %q; want bytes 2-5", resp.StatusCode, resp.Header.Get("Content-Range"), got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	if resp := serve(handler, req); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status = %d, want 304", resp.StatusCode)
+	}
+
+	// without a Last-Modified from GitHub none is made up
+	lastModified = ""
+	if resp := get(handler, "/owner/repo/file.txt?ref=other"); resp.Header.Get("Last-Modified") != "" {
+		t.Errorf("Last-Modified = %q, want none when GitHub sends none", resp.Header.Get("Last-Modified"))
+	}
+}
+
+func TestRelayETag(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	if resp := get(handler, "/owner/repo/file.txt"); resp.Header.Get("ETag") != "" {
+		t.Errorf("ETag = %q without -relay-etag", resp.Header.Get("ETag"))
+	}
+
+	setForTest(t, relayETag, true)
+	resp := get(handler, "/owner/repo/file.txt")
+	etag := resp.Header.Get("ETag")
+	upstream := gh.lastRequest("/repos/owner/repo/contents/")
+	if etag == "" {
+		t.Fatal("no ETag relayed")
+	}
+
+	// GitHub's ETag revalidates the cached file upstream, and clients' copies
+	// with the proxy
+	if got := upstream.Header.Get("If-None-Match"); got != etag {
+		t.Errorf("upstream If-None-Match = %q, want the relayed ETag %q", got, etag)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	if resp := serve(handler, req); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Errorf("status %d, ETag %q; want 304 with %q", resp.StatusCode, resp.Header.Get("ETag"), etag)
+	}
+
+	gh.setFile("owner", "repo", "file.txt", "changed")
+	if resp := serve(handler, req); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("changed: status %d, ETag %q; want 200 with a new ETag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestRejectGetBody(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	tests := []struct {
+		name          string
+		reject        bool
+		body          string
+		contentLength int64
+		status        int
+	}{
+		{"no body", true, "", 0, http.StatusOK},
+		{"body", true, "payload", 7, http.StatusBadRequest},
+		{"chunked body", true, "payload", -1, http.StatusBadRequest},
+		{"empty chunked body", true, "", -1, http.StatusOK},
+		{"body allowed", false, "payload", 7, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, rejectGetBody, tt.reject)
+
+		body := strings.NewReader(tt.body)
+		req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", body)
+		req.ContentLength = tt.contentLength
+		if resp := serve(handler, req); resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		// rejected bodies are drained so the connection can be reused
+		if tt.status == http.StatusBadRequest && body.Len() != 0 {
+			t.Errorf("%s: %d bytes of the body left unread", tt.name, body.Len())
+		}
+	}
+}
+
+func TestAllowedParams(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	tests := []struct {
+		allowed string
+		unknown string
+		target  string
+		status  int
+		query   string // the query string once unknown parameters are handled
+	}{
+		{"", "reject", "/owner/repo/file.txt?utm_source=x", http.StatusOK, "utm_source=x"},
+		{"ref, download", "reject", "/owner/repo/file.txt?ref=main&download=1", http.StatusOK, "ref=main&download=1"},
+		{"ref, download", "reject", "/owner/repo/file.txt?ref=main&utm_source=x&cb=1", http.StatusBadRequest, ""},
+		{"ref, download", "strip", "/owner/repo/file.txt?utm_source=x&ref=main&cb=1", http.StatusOK, "ref=main"},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, &allowedParams, parseAllowedParams(tt.allowed))
+		setForTest(t, unknownParams, tt.unknown)
+
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		resp := serve(handler, req)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s with %q allowed: status = %d, want %d", tt.unknown, tt.allowed, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusOK && req.URL.RawQuery != tt.query {
+			t.Errorf("%s with %q allowed: query = %q, want %q", tt.unknown, tt.allowed, req.URL.RawQuery, tt.query)
+		}
+	}
+
+	setForTest(t, &allowedParams, parseAllowedParams("ref"))
+	u, _ := url.Parse("/owner/repo/file.txt?b=1&ref=main&a=2")
+	if got := filterParams(u); strings.Join(got, ",") != "a,b" {
+		t.Errorf("unknown parameters = %q, want [a b]", got)
+	}
+}
+
+func TestUpstreamFailureStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream func(w http.ResponseWriter)
+		status   int
+	}{
+		{"not found", func(w http.ResponseWriter) { http.Error(w, "Not Found", http.StatusNotFound) }, http.StatusNotFound},
+		{"server error", func(w http.ResponseWriter) { http.Error(w, "Server Error", http.StatusInternalServerError) }, http.StatusBadGateway},
+		{"bad credentials", func(w http.ResponseWriter) { http.Error(w, "Bad credentials", http.StatusUnauthorized) }, http.StatusInternalServerError},
+		{"forbidden", func(w http.ResponseWriter) { http.Error(w, "Resource not accessible", http.StatusForbidden) }, http.StatusInternalServerError},
+		{"rate limited", func(w http.ResponseWriter) {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+			http.Error(w, "API rate limit exceeded", http.StatusForbidden)
+		}, http.StatusTooManyRequests},
+		{"malformed JSON", func(w http.ResponseWriter) { w.Write([]byte(`{"content": `)) }, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		gh, handler := newTestProxy(t)
+		setForTest(t, maxRetries, 0)
+		if _, err := defaultApp.getInstallationToken(); err != nil {
+			t.Fatal(err)
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/repos/owner/repo/contents/") {
+				tt.upstream(w)
+				return
+			}
+			gh.serveHTTP(w, r)
+		}))
+		setForTest(t, &githubAPIURL, server.URL)
+
+		if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		server.Close()
+	}
+}
+
+func TestCachingHeadersPropagate(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	setForTest(t, &cacheTTL, 0)
+	setForTest(t, defaultCacheControl, "public, max-age=300")
+
+	var cacheControl atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/owner/repo/contents/") {
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			if value := cacheControl.Load().(string); value != "" {
+				w.Header().Set("Cache-Control", value)
+			}
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	tests := []struct {
+		ref      string
+		upstream string
+		want     string
+	}{
+		{"main", "private, max-age=60, s-maxage=60", "private, max-age=60, s-maxage=60"},
+		{"dev", "", "public, max-age=300"},
+	}
+
+	for _, tt := range tests {
+		cacheControl.Store(tt.upstream)
+
+		resp := get(handler, "/owner/repo/file.txt?ref="+tt.ref)
+		if got := resp.Header.Get("Cache-Control"); got != tt.want {
+			t.Errorf("upstream %q: Cache-Control = %q, want %q", tt.upstream, got, tt.want)
+		}
+		if got := resp.Header.Get("Last-Modified"); got != "Mon, 02 Jan 2006 15:04:05 GMT" {
+			t.Errorf("upstream %q: Last-Modified = %q, want GitHub's", tt.upstream, got)
+		}
+	}
+
+	// neither overrides what the proxy knows about the file's content type or ref
+	setForTest(t, &cacheTTL, time.Minute)
+	if got := get(handler, "/owner/repo/file.txt").Header.Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("with a cache TTL: Cache-Control = %q, want max-age=60", got)
+	}
+	if got := get(handler, "/owner/repo/file.txt?ref="+strings.Repeat("a", 40)).Header.Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+		t.Errorf("at a commit: Cache-Control = %q, want immutable", got)
+	}
+}
+
+func TestSymlinksAndSubmodules(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "docs/a.md", "a")
+	gh.setFile("owner", "repo", ".env", "secret")
+
+	// GitHub describes symlinks it doesn't resolve, and submodules, without content
+	entries := map[string]string{
+		"link":       `{"type": "symlink", "target": "docs/a.md"}`,
+		"docs/chain": `{"type": "symlink", "target": "../link"}`,
+		"loop":       `{"type": "symlink", "target": "loop"}`,
+		"escape":     `{"type": "symlink", "target": "../other/file.txt"}`,
+		"absolute":   `{"type": "symlink", "target": "/etc/passwd"}`,
+		"hidden":     `{"type": "symlink", "target": ".env"}`,
+		"module":     `{"type": "submodule", "submodule_git_url": "https://github.com/owner/module.git"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry, ok := entries[strings.TrimPrefix(r.URL.Path, "/repos/owner/repo/contents/")]; ok {
+			w.Write([]byte(entry))
+			return
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	tests := []struct {
+		behavior string
+		path     string
+		status   int
+		body     string
+	}{
+		{"target", "link", http.StatusOK, "docs/a.md"},
+		{"target", "module", http.StatusConflict, ""},
+		{"follow", "link", http.StatusOK, "a"},
+		{"follow", "docs/chain", http.StatusOK, "a"},
+		{"follow", "loop", http.StatusBadGateway, ""},
+		{"follow", "escape", http.StatusForbidden, ""},
+		{"follow", "absolute", http.StatusForbidden, ""},
+		{"follow", "hidden", http.StatusForbidden, ""},
+		{"follow", "module", http.StatusConflict, ""},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, symlinkBehavior, tt.behavior)
+
+		resp := get(handler, "/owner/repo/"+tt.path)
+		got := body(t, resp)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: status = %d, want %d", tt.behavior, tt.path, resp.StatusCode, tt.status)
+		} else if tt.status == http.StatusOK && got != tt.body {
+			t.Errorf("%s %s: body = %q, want %q", tt.behavior, tt.path, got, tt.body)
+		}
+		if tt.status != http.StatusOK && strings.Contains(got, "secret") {
+			t.Errorf("%s %s: body = %q, which includes the hidden file", tt.behavior, tt.path, got)
+		}
+	}
+
+	setForTest(t, symlinkBehavior, "target")
+	if got := get(handler, "/owner/repo/link").Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("symlink target: Content-Type = %q, want text/plain; charset=utf-8", got)
+	}
+}
+
+func TestEmptyPathBehavior(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "index.html", "<h1>repo</h1>")
+	gh.setFile("owner", "repo", "site/home.html", "<h1>home</h1>")
+
+	tests := []struct {
+		behavior  string
+		indexFile string
+		status    int
+		body      string
+	}{
+		{"listing", "", http.StatusOK, `"name":"index.html"`},
+		{"index", "index.html", http.StatusOK, "<h1>repo</h1>"},
+		{"index", "site/home.html", http.StatusOK, "<h1>home</h1>"},
+		{"index", "missing.html", http.StatusNotFound, ""},
+		{"repo-index", "", http.StatusOK, `"full_name":"owner/repo"`},
+		{"reject", "", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		setForTest(t, emptyPathBehavior, tt.behavior)
+		setForTest(t, repoIndexFile, tt.indexFile)
+
+		for _, target := range []string{"/owner/repo/", "/owner/repo"} {
+			resp := get(handler, target)
+			got := body(t, resp)
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s %s: status = %d, want %d", tt.behavior, target, resp.StatusCode, tt.status)
+			} else if !strings.Contains(got, tt.body) {
+				t.Errorf("%s %s: body = %q, want it to include %q", tt.behavior, target, got, tt.body)
+			}
+		}
+	}
+}
+
+func TestClientCancellationAbortsUpstream(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	setForTest(t, maxRetries, 0)
+	if _, err := defaultApp.getInstallationToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	// GitHub hangs on a contents request until it is aborted
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/repos/") {
+			gh.serveHTTP(w, r)
+			return
+		}
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	// the client goes away mid-request
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serve(handler, httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil).WithContext(ctx))
+		close(done)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("upstream request not aborted when the client went away")
+	}
+	<-done
+
+	// -request-timeout bounds the whole request
+	setForTest(t, requestTimeout, 50*time.Millisecond)
+	resp := get(handler, "/owner/repo/file.txt")
+	<-started
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("timed out: status = %d, want 504", resp.StatusCode)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("upstream request not aborted when the request timed out")
+	}
+}
+
+func TestShedBelow(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "cached.txt", "cached")
+	gh.setFile("owner", "repo", "uncached.txt", "uncached")
+	installationRateLimits.Clear()
+	t.Cleanup(installationRateLimits.Clear)
+
+	// plenty of headroom: the file is fetched and cached
+	gh.remaining = 100
+	setForTest(t, shedBelow, 10)
+	if resp := get(handler, "/owner/repo/cached.txt"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("with headroom: status = %d, want 200", resp.StatusCode)
+	}
+
+	// low headroom: cache hits are still served, misses are shed
+	gh.remaining = 5
+	recordRateLimit(defaultApp.installationID, 5, time.Now().Add(time.Hour))
+
+	if resp := get(handler, "/owner/repo/cached.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("cache hit: status = %d, want 200", resp.StatusCode)
+	}
+
+	resp := get(handler, "/owner/repo/uncached.txt")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("cache miss: status = %d, want 503", resp.StatusCode)
+	}
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retryAfter <= 0 || retryAfter > 3600 {
+		t.Errorf("cache miss: Retry-After = %q, want the seconds until the rate limit resets", resp.Header.Get("Retry-After"))
+	}
+	if got := gh.count("/repos/owner/repo/contents/uncached.txt"); got != 0 {
+		t.Errorf("cache miss: %d requests to GitHub, want none", got)
+	}
+
+	// disabled, misses are fetched whatever the headroom
+	setForTest(t, shedBelow, 0)
+	if resp := get(handler, "/owner/repo/uncached.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("disabled: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestServeStaleOnTokenFailureKeepsChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		setup    func(t *testing.T, gh *fakeGitHub)
+		status   int
+		archived bool // whether the response warns the repo is archived
+	}{
+		{
+			name:   "no restrictions",
+			target: "/owner/repo/file.txt?ref=main",
+			status: http.StatusOK,
+		},
+		{
+			name:   "ref no longer allowed",
+			target: "/owner/repo/file.txt?ref=main",
+			setup: func(t *testing.T, gh *fakeGitHub) {
+				setForTest(t, &allowedRefs, map[string][]string{"owner/repo": {"release"}})
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "default branch allowed, metadata cached",
+			target: "/owner/repo/file.txt",
+			setup: func(t *testing.T, gh *fakeGitHub) {
+				setForTest(t, &allowedRefs, map[string][]string{"owner/repo": {"main"}})
+				if _, err := getRepoInfo(context.Background(), "owner", "repo", "ghs_token"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:   "default branch unknown",
+			target: "/owner/repo/file.txt",
+			setup: func(t *testing.T, gh *fakeGitHub) {
+				setForTest(t, &allowedRefs, map[string][]string{"owner/repo": {"main"}})
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "archived and blocked",
+			target: "/owner/repo/file.txt?ref=main",
+			setup: func(t *testing.T, gh *fakeGitHub) {
+				gh.archived["owner/repo"] = true
+				setForTest(t, archivedBehavior, "block")
+				if _, err := getRepoInfo(context.Background(), "owner", "repo", "ghs_token"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "archived status unknown and blocked",
+			target: "/owner/repo/file.txt?ref=main",
+			setup: func(t *testing.T, gh *fakeGitHub) {
+				setForTest(t, archivedBehavior, "block")
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "archived with a warning",
+			target: "/owner/repo/file.txt?ref=main",
+			setup: func(t *testing.T, gh *fakeGitHub) {
+				gh.archived["owner/repo"] = true
+				setForTest(t, archivedBehavior, "warn")
+				if _, err := getRepoInfo(context.Background(), "owner", "repo", "ghs_token"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			status:   http.StatusOK,
+			archived: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh, handler := newTestProxy(t)
+			gh.setFile("owner", "repo", "file.txt", "content")
+			setForTest(t, tokenFailureBehavior, "serve-stale")
+			setForTest(t, archivedBehavior, "serve")
+			setForTest(t, maxRetries, 0)
+
+			// cache the file while a token is available
+			if resp := get(handler, tt.target); resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			repoInfoCache = newLRUMap[repoInfoEntry](100)
+			if tt.setup != nil {
+				tt.setup(t, gh)
+			}
+
+			// then lose the token
+			defaultApp.tokenExpiry = time.Now().Add(-time.Second)
+			defaultApp.tokenRenewAt = defaultApp.tokenExpiry
+			gh.setStatus(http.StatusInternalServerError)
+
+			resp := get(handler, tt.target)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if got := body(t, resp); got != "content" {
+				t.Errorf("body = %q, want content", got)
+			}
+			warnings := strings.Join(resp.Header.Values("Warning"), ", ")
+			if !strings.Contains(warnings, "110") || strings.Contains(warnings, "archived") != tt.archived {
+				t.Errorf("Warning = %q, want stale and archived = %t", warnings, tt.archived)
+			}
+		})
+	}
+}
+
+func TestRedirectHTTPForwardedProto(t *testing.T) {
+	networks, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &trustedProxies, networks)
+
+	handler := redirectHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		peer     string
+		proto    string
+		tls      bool
+		redirect bool
+	}{
+		{name: "plain HTTP", peer: "203.0.113.5:1234", redirect: true},
+		{name: "TLS", peer: "203.0.113.5:1234", tls: true},
+		{name: "https forwarded by a trusted proxy", peer: "10.0.0.1:1234", proto: "https"},
+		{name: "HTTPS forwarded by a trusted proxy", peer: "10.0.0.1:1234", proto: "HTTPS"},
+		{name: "https first of several", peer: "10.0.0.1:1234", proto: "https, http"},
+		{name: "http forwarded by a trusted proxy", peer: "10.0.0.1:1234", proto: "http", redirect: true},
+		{name: "nothing forwarded by a trusted proxy", peer: "10.0.0.1:1234", redirect: true},
+		{name: "unknown scheme forwarded by a trusted proxy", peer: "10.0.0.1:1234", proto: "gopher", redirect: true},
+		{name: "https spoofed by an untrusted client", peer: "203.0.113.5:1234", proto: "https", redirect: true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://files.example.com/owner/repo/file.txt?ref=main", nil)
+		req.RemoteAddr = tt.peer
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		resp := serve(handler, req)
+		if !tt.redirect {
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s: status = %d, want 200", tt.name, resp.StatusCode)
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("%s: status = %d, want 301", tt.name, resp.StatusCode)
+		}
+		if got, want := resp.Header.Get("Location"), "https://files.example.com/owner/repo/file.txt?ref=main"; got != want {
+			t.Errorf("%s: Location = %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestContentSignature(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "hello")
+	setForTest(t, signingKey, "secret")
+	setForTest(t, relayETag, true)
+
+	sign := func(content string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(content))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	resp := get(handler, "/owner/repo/file.txt")
+	if got, want := resp.Header.Get("X-Content-Signature"), sign(body(t, resp)); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	etag := resp.Header.Get("ETag")
+
+	req := httptest.NewRequest(http.MethodHead, "/owner/repo/file.txt", nil)
+	if got := serve(handler, req).Header.Get("X-Content-Signature"); got != sign("hello") {
+		t.Errorf("HEAD signature = %q, want %q", got, sign("hello"))
+	}
+
+	// partial and not modified bodies aren't the whole file, so aren't signed
+	req = httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	if resp := serve(handler, req); resp.StatusCode != http.StatusPartialContent || resp.Header.Get("X-Content-Signature") != "" {
+		t.Errorf("range request: status %d with signature %q, want 206 without one", resp.StatusCode, resp.Header.Get("X-Content-Signature"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	if resp := serve(handler, req); resp.StatusCode != http.StatusNotModified || resp.Header.Get("X-Content-Signature") != "" {
+		t.Errorf("conditional request: status %d with signature %q, want 304 without one", resp.StatusCode, resp.Header.Get("X-Content-Signature"))
+	}
+
+	gh.setFile("owner", "repo", "file.txt", "hello, world")
+	resp = get(handler, "/owner/repo/file.txt")
+	if got := resp.Header.Get("X-Content-Signature"); got != sign("hello, world") || got == sign("hello") {
+		t.Errorf("signature after change = %q, want %q", got, sign("hello, world"))
+	}
+}
+
+func TestDecompressGzip(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	setForTest(t, decompressGzip, true)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("<p>hello</p>"))
+	zw.Close()
+	gh.setFile("owner", "repo", "index.html.gz", gz.String())
+
+	// clients that don't accept gzip get the decompressed content
+	resp := get(handler, "/owner/repo/index.html.gz")
+	if got := body(t, resp); got != "<p>hello</p>" {
+		t.Errorf("body = %q, want the decompressed content", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want that of the decompressed content", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+
+	// clients that do get the file as it is
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/index.html.gz", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	resp = serve(handler, req)
+	if got := body(t, resp); got != gz.String() {
+		t.Errorf("gzip accepted: body = %q, want the gzipped file", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("gzip accepted: Vary = %q, want Accept-Encoding", got)
+	}
+
+	// as do all clients without -decompress-gzip
+	setForTest(t, decompressGzip, false)
+	if got := body(t, get(handler, "/owner/repo/index.html.gz")); got != gz.String() {
+		t.Errorf("without -decompress-gzip: body = %q, want the gzipped file", got)
+	}
+}
+
+func TestDecompressGzipLimit(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	setForTest(t, decompressGzip, true)
+	setForTest(t, maxDecompressed, 10)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello, world"))
+	zw.Close()
+	gh.setFile("owner", "repo", "file.txt.gz", gz.String())
+
+	if resp := get(handler, "/owner/repo/file.txt.gz"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 for content over -max-decompressed-size", resp.StatusCode)
+	}
+
+	// clients accepting gzip are still served the compressed file
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt.gz", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if resp := serve(handler, req); resp.StatusCode != http.StatusOK {
+		t.Errorf("gzip accepted: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "small.txt", "hello")
+	gh.setFile("owner", "repo", "large.txt", strings.Repeat("0123456789", 4000))
+	gh.inlineMax = 0
+	setForTest(t, relayETag, true)
+	setForTest(t, streamThreshold, 1000)
+
+	tests := []struct {
+		target string
+		stall  time.Duration
+	}{
+		{target: "/owner/repo/small.txt"},
+
+		// HEAD of a streamed file doesn't wait for the file to download
+		{target: "/owner/repo/large.txt", stall: 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		want := get(handler, tt.target)
+		if want.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want 200", tt.target, want.StatusCode)
+		}
+
+		gh.stall = tt.stall
+		start := time.Now()
+		resp := serve(handler, httptest.NewRequest(http.MethodHead, tt.target, nil))
+		if elapsed := time.Since(start); tt.stall > 0 && elapsed > tt.stall/2 {
+			t.Errorf("HEAD %s took %v", tt.target, elapsed)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("HEAD %s: status = %d, want 200", tt.target, resp.StatusCode)
+		}
+		for _, name := range []string{"Content-Type", "Content-Length", "ETag", "Cache-Control"} {
+			if got := resp.Header.Get(name); got != want.Header.Get(name) {
+				t.Errorf("HEAD %s: %s = %q, want %q as for GET", tt.target, name, got, want.Header.Get(name))
+			}
+		}
+		if got := body(t, resp); got != "" {
+			t.Errorf("HEAD %s: body = %q, want none", tt.target, got)
+		}
+	}
+}
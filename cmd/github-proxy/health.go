@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ready is set once startup has loaded the private key, obtained the
+	// initial installation token and started the background workers.
+	ready atomic.Bool
+
+	// readySince is when ready was last set, in Unix nanoseconds.
+	readySince atomic.Int64
+)
+
+// setReady sets whether the proxy is ready, recording when it became so.
+func setReady(r bool) {
+	if r {
+		readySince.Store(time.Now().UnixNano())
+	}
+	ready.Store(r)
+}
+
+// isReady reports whether the proxy is ready and has been for at least the
+// -readiness-grace period.
+func isReady() bool {
+	return ready.Load() && time.Since(time.Unix(0, readySince.Load())) >= *readinessGrace
+}
+
+// healthProbes wraps next, answering the /healthz liveness and /readyz
+// readiness probes ahead of any other handling, so that probes are never
+// rate limited, redirected or rejected.
+func healthProbes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte("ok\n"))
+		case "/readyz":
+			if !isReady() {
+				httpError(w, http.StatusServiceUnavailable, "Service Unavailable", errors.New("not ready"))
+				return
+			}
+			w.Write([]byte("ok\n"))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
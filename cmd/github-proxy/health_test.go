@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// probe sends a readiness probe, returning its status.
+func probe() int {
+	return get(healthProbes(http.NotFoundHandler()), "/readyz").StatusCode
+}
+
+func TestReadiness(t *testing.T) {
+	setForTest(t, readinessGrace, 0)
+	t.Cleanup(func() { setReady(false) })
+
+	if got := probe(); got != http.StatusServiceUnavailable {
+		t.Errorf("before startup: status = %d, want 503", got)
+	}
+
+	setReady(true)
+	if got := probe(); got != http.StatusOK {
+		t.Errorf("after startup: status = %d, want 200", got)
+	}
+
+	setReady(false)
+	if got := probe(); got != http.StatusServiceUnavailable {
+		t.Errorf("shutting down: status = %d, want 503", got)
+	}
+}
+
+func TestReadinessGrace(t *testing.T) {
+	setForTest(t, readinessGrace, 50*time.Millisecond)
+	t.Cleanup(func() { setReady(false) })
+
+	setReady(true)
+	if got := probe(); got != http.StatusServiceUnavailable {
+		t.Errorf("within grace period: status = %d, want 503", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := probe(); got != http.StatusOK {
+		t.Errorf("after grace period: status = %d, want 200", got)
+	}
+
+	// liveness isn't affected by the grace period
+	setReady(false)
+	setReady(true)
+	if got := get(healthProbes(http.NotFoundHandler()), "/healthz").StatusCode; got != http.StatusOK {
+		t.Errorf("liveness within grace period: status = %d, want 200", got)
+	}
+}
@@ -2,25 +2,51 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-const (
-	ClientRate  time.Duration = time.Minute / 60
-	ClientBurst int           = 8
-)
+// defaultGlobalLimit is the hourly request budget assumed when GitHub's rate limit can't be fetched.
+const defaultGlobalLimit = 5000
+
+var errRateLimitUnknown = fmt.Errorf("global rate limit unknown")
 
 var (
-	globalLimiter  *rate.Limiter
+	// upstreamPauses holds, by installation ID, when requests may be sent to
+	// GitHub with the installation again after it reported a rate limit
+	// exceeded.
+	upstreamPauses sync.Map
+
+	pathLimiters []pathLimiter
+
+	// installationRateLimits holds the rateLimitState of each installation.
+	installationRateLimits sync.Map
+
+	// trustedProxies are the networks of proxies whose forwarding headers are
+	// believed.
+	trustedProxies []*net.IPNet
+
+	// globalLimiter limits requests served with every app, but is sized from
+	// the default app's GitHub rate limit only; other apps' rate limits are
+	// protected by -shed-below.
+	globalLimiter  atomic.Pointer[rate.Limiter]
 	clientLimiters = make(map[string]*clientLimiter)
 	limiterMutex   sync.Mutex
+
+	// repoLimiters holds the -repo-rate limiters of at most -max-tracked-repos
+	// repos, guarded by limiterMutex.
+	repoLimiters *lruMap[*clientLimiter]
 )
 
 type clientLimiter struct {
@@ -28,39 +54,322 @@ type clientLimiter struct {
 	lastSeen time.Time
 }
 
+// rateLimitState is GitHub's core rate limit for an installation, as last
+// reported by GitHub.
+type rateLimitState struct {
+	remaining int
+	reset     time.Time
+}
+
+// recordRateLimit records the core rate limit GitHub reported for installation.
+func recordRateLimit(installation string, remaining int, reset time.Time) {
+	installationRateLimits.Store(installation, rateLimitState{remaining, reset})
+}
+
+// lowHeadroom reports whether fewer than -shed-below requests remain in the
+// installation's rate limit, and if so when it resets.
+func lowHeadroom(installation string) (time.Time, bool) {
+	value, ok := installationRateLimits.Load(installation)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	state := value.(rateLimitState)
+	if state.remaining >= *shedBelow || !time.Now().Before(state.reset) {
+		return time.Time{}, false
+	}
+
+	return state.reset, true
+}
+
+// upstreamPausedError is returned by checkUpstreamPaused while requests to
+// GitHub are paused after it reported a rate limit exceeded.
+type upstreamPausedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *upstreamPausedError) Error() string {
+	return fmt.Sprintf("GitHub rate limit exceeded; retry after %s", e.RetryAfter)
+}
+
+// pauseUpstream stops checkUpstreamPaused allowing requests served with
+// installation until resume, unless they are already paused for longer.
+// Requests served with other installations, which have their own rate limits,
+// are unaffected.
+func pauseUpstream(installation string, resume time.Time) {
+	for {
+		current, loaded := upstreamPauses.LoadOrStore(installation, resume)
+		if !loaded || !resume.After(current.(time.Time)) || upstreamPauses.CompareAndSwap(installation, current, resume) {
+			break
+		}
+	}
+
+	log.Printf("GitHub rate limit exceeded for installation %s; pausing its requests until %s\n", installation, resume)
+}
+
+// upstreamPausedUntil returns when requests served with installation may be
+// sent to GitHub again, if they are paused.
+func upstreamPausedUntil(installation string) (time.Time, bool) {
+	value, ok := upstreamPauses.Load(installation)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	resume := value.(time.Time)
+	return resume, time.Now().Before(resume)
+}
+
+// checkUpstreamPaused returns an upstreamPausedError if requests served with
+// installation are paused.
+func checkUpstreamPaused(installation string) error {
+	if resume, paused := upstreamPausedUntil(installation); paused {
+		return &upstreamPausedError{RetryAfter: time.Until(resume)}
+	}
+
+	return nil
+}
+
+// retryAfter returns how long a client should wait before retrying a request
+// that failed with err, if err is due to GitHub's rate limit.
+func retryAfter(err error) (time.Duration, bool) {
+	var pausedErr *upstreamPausedError
+	if errors.As(err, &pausedErr) {
+		return pausedErr.RetryAfter, true
+	}
+
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > 0 {
+		return upstreamErr.RetryAfter, true
+	}
+
+	return 0, false
+}
+
 // checkLimits checks the request against current global and client rate limits
 func checkLimits(r *http.Request) error {
-	if !globalLimiter.Allow() {
+	limiter := globalLimiter.Load()
+	if limiter == nil {
+		return errRateLimitUnknown
+	}
+
+	allowed := limiter.Allow()
+	logLimitDecision("global", "-", allowed, limiter)
+	if !allowed {
 		return fmt.Errorf("global rate limit exceeded")
 	}
 
 	clientIP := getClientIP(r)
 	clientLimiter := getClientLimiter(clientIP)
 
-	if !clientLimiter.Allow() {
-		log.Printf("client %s rate set to %d requests per minute with burst: %d\n", clientIP, int(time.Minute/ClientRate), ClientBurst)
+	allowed = clientLimiter.Allow()
+	logLimitDecision("client", clientIP, allowed, clientLimiter)
+	if !allowed {
+		log.Printf("client %s rate set to %d requests per minute with burst: %d\n", clientIP, *clientRate, *clientBurst)
 		return fmt.Errorf("client rate limit exceeded")
 	}
 
+	if *repoRate > 0 {
+		// Limit both files and listings, including /owner/repo itself
+		parts := strings.SplitN(r.URL.Path, "/", 4)
+		if len(parts) >= 3 && parts[1] != "" && parts[2] != "" {
+			key := repoKey(parts[1], parts[2])
+			repoLimiter := getRepoLimiter(key)
+
+			allowed = repoLimiter.Allow()
+			logLimitDecision("repo", key, allowed, repoLimiter)
+			if !allowed {
+				return fmt.Errorf("repo rate limit exceeded for %s", key)
+			}
+		}
+	}
+
+	requestPath := strings.TrimPrefix(r.URL.Path, "/")
+	for _, pl := range pathLimiters {
+		if matched, _ := path.Match(pl.pattern, requestPath); !matched {
+			continue
+		}
+
+		allowed = pl.limiter.Allow()
+		logLimitDecision("path", pl.pattern, allowed, pl.limiter)
+		if !allowed {
+			return fmt.Errorf("path rate limit exceeded for %s", pl.pattern)
+		}
+		break
+	}
+
 	return nil
 }
 
-// getClientIP returns the client IP address from the request
+// pathLimiter is a rate limit shared by all requests for paths matching pattern.
+type pathLimiter struct {
+	pattern string
+	limiter *rate.Limiter
+}
+
+// parsePathRateLimits parses comma-separated pattern=rate pairs, where pattern
+// matches request paths without the leading slash, e.g. myorg/*/status.json,
+// and rate is in requests per minute with an optional :burst suffix.
+func parsePathRateLimits(s string) ([]pathLimiter, error) {
+	var limiters []pathLimiter
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		pattern, value, ok := strings.Cut(pair, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid path rate limit: %s", pair)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path rate limit pattern %s: %w", pattern, err)
+		}
+
+		perMinute, burstValue, hasBurst := strings.Cut(value, ":")
+		limit, err := strconv.Atoi(perMinute)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid rate for path rate limit %s: %s", pattern, perMinute)
+		}
+
+		burst := *clientBurst
+		if hasBurst {
+			if burst, err = strconv.Atoi(burstValue); err != nil || burst <= 0 {
+				return nil, fmt.Errorf("invalid burst for path rate limit %s: %s", pattern, burstValue)
+			}
+		}
+
+		limiters = append(limiters, pathLimiter{
+			pattern: pattern,
+			limiter: rate.NewLimiter(rate.Limit(float64(limit)/60), burst),
+		})
+	}
+
+	return limiters, nil
+}
+
+// logLimitDecision logs a rate limit decision when -log-rate-limits is set.
+func logLimitDecision(name, key string, allowed bool, limiter *rate.Limiter) {
+	if !*logRateLimits {
+		return
+	}
+
+	log.Printf("rate limit decision: limiter=%s key=%s allowed=%t remaining=%.2f\n", name, key, allowed, limiter.Tokens())
+}
+
+// getClientIP returns the client IP address from the request. Forwarding
+// headers are only believed from -trusted-proxies; empty or invalid ones are
+// ignored in favour of the peer address. When both X-Real-IP and
+// X-Forwarded-For are set, -client-ip-header chooses between them, and a
+// disagreement is logged as a sign of spoofing or misconfiguration.
 func getClientIP(r *http.Request) string {
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+	remote := remoteIP(r)
+	if !isTrustedProxy(remote) {
+		return remote
+	}
+
+	realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if net.ParseIP(realIP) == nil {
+		realIP = ""
+	}
+
+	forwardedIP := forwardedClientIP(r.Header.Values("X-Forwarded-For"))
+
+	preferred, fallback := realIP, forwardedIP
+	if *clientIPHeader == "x-forwarded-for" {
+		preferred, fallback = forwardedIP, realIP
 	}
 
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		ips := strings.Split(ip, ",")
-		return strings.TrimSpace(ips[0])
+	if preferred != "" && fallback != "" && !net.ParseIP(preferred).Equal(net.ParseIP(fallback)) {
+		log.Printf("X-Real-IP %s and X-Forwarded-For %s disagree for %s; using %s\n", realIP, forwardedIP, r.RemoteAddr, preferred)
 	}
 
-	pos := strings.LastIndex(r.RemoteAddr, ":")
-	if pos == -1 {
-		return r.RemoteAddr
+	if preferred != "" {
+		return preferred
 	}
-	return r.RemoteAddr[:pos]
+
+	if fallback != "" {
+		return fallback
+	}
+
+	return remote
+}
+
+// forwardedClientIP returns the client address from X-Forwarded-For header
+// values. Each proxy appends the address it received the request from, so the
+// list is walked from the right, skipping trusted proxies: the first untrusted
+// address is the client, and anything to its left may have been forged by it.
+// It returns "" if every address is trusted or one is invalid.
+func forwardedClientIP(values []string) string {
+	ips := strings.Split(strings.Join(values, ","), ",")
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(ips[i])
+		if net.ParseIP(ip) == nil {
+			return ""
+		}
+
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+
+	return ""
+}
+
+// remoteIP returns the IP address of the request's peer, without its port and
+// the brackets around an IPv6 address.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// no port
+		return strings.Trim(r.RemoteAddr, "[]")
+	}
+	return host
+}
+
+// isTrustedProxy reports whether ip is within one of the -trusted-proxies networks.
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDR ranges. A bare IP
+// address is taken as a range of just that address.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
 }
 
 // getClientLimiter returns a rate limiter for the given client IP address
@@ -73,15 +382,30 @@ func getClientLimiter(ip string) *rate.Limiter {
 		return l.limiter
 	}
 
-	// rate limit a client to 60 requests per minute, with a burst of 10
-	l := rate.NewLimiter(rate.Every(ClientRate), ClientBurst)
+	l := rate.NewLimiter(rate.Every(time.Minute/time.Duration(*clientRate)), *clientBurst)
 	clientLimiters[ip] = &clientLimiter{l, time.Now()}
-	log.Printf("client %s rate set to %d requests per minute with burst: %d\n", ip, int(time.Minute/ClientRate), ClientBurst)
+	log.Printf("client %s rate set to %d requests per minute with burst: %d\n", ip, *clientRate, *clientBurst)
 
 	return l
 }
 
-// cleanupStaleLimiters periodically removes stale client limiters
+// getRepoLimiter returns the rate limiter for the repo identified by key.
+func getRepoLimiter(key string) *rate.Limiter {
+	limiterMutex.Lock()
+	defer limiterMutex.Unlock()
+
+	if l, ok := repoLimiters.get(key); ok {
+		l.lastSeen = time.Now()
+		return l.limiter
+	}
+
+	l := rate.NewLimiter(rate.Every(time.Minute/time.Duration(*repoRate)), *repoBurst)
+	repoLimiters.put(key, &clientLimiter{l, time.Now()})
+
+	return l
+}
+
+// cleanupStaleLimiters periodically removes stale client and repo limiters
 func cleanupStaleLimiters(ctx context.Context, duration time.Duration) {
 	deleteStaleLimiters := func(duration time.Duration) {
 		limiterMutex.Lock()
@@ -92,6 +416,15 @@ func cleanupStaleLimiters(ctx context.Context, duration time.Duration) {
 			}
 		}
 
+		// repo limiters are kept in order of use, so the stale ones are oldest
+		for {
+			key, l, ok := repoLimiters.oldest()
+			if !ok || time.Since(l.lastSeen) <= duration {
+				break
+			}
+			repoLimiters.remove(key)
+		}
+
 		limiterMutex.Unlock()
 	}
 
@@ -105,8 +438,57 @@ func cleanupStaleLimiters(ctx context.Context, duration time.Duration) {
 	}
 }
 
-func initGlobalLimiter(token string) error {
-	rateLimit, err := fetchRateLimit(token)
+// wallClock returns the current wall clock time. Round(0) strips the monotonic
+// reading, so that Sub on its results uses the wall clock.
+var wallClock = func() time.Time { return time.Now().Round(0) }
+
+// watchClockJumps checks every interval whether the wall clock has jumped by
+// more than threshold against the monotonic clock, as after a large NTP
+// correction, and if so resets the rate limiters until ctx is done. The global
+// limiter's rate is derived from GitHub's wall clock reset time, so it is
+// fetched again.
+func watchClockJumps(ctx context.Context, interval, threshold time.Duration) {
+	last, lastWall := time.Now(), wallClock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			now, wall := time.Now(), wallClock()
+
+			jump := wall.Sub(lastWall) - now.Sub(last)
+			last, lastWall = now, wall
+
+			if jump.Abs() > threshold {
+				log.Printf("wall clock jumped by %s; resetting rate limiters\n", jump)
+				resetLimiters(ctx)
+			}
+		}
+	}
+}
+
+// resetLimiters discards the client and repo limiters and refetches the global
+// rate limit, keeping the current global limiter if that fails.
+func resetLimiters(ctx context.Context) {
+	limiterMutex.Lock()
+	clientLimiters = make(map[string]*clientLimiter)
+	repoLimiters = newLRUMap[*clientLimiter](*maxTrackedRepos)
+	limiterMutex.Unlock()
+
+	tok, err := getInstallationToken()
+	if err == nil {
+		err = initGlobalLimiter(ctx, tok)
+	}
+
+	if err != nil {
+		log.Printf("Error fetching global rate limit: %v\n", err)
+	}
+}
+
+// initGlobalLimiter sizes the global limiter from the core rate limit of token,
+// which is always the default app's.
+func initGlobalLimiter(ctx context.Context, token string) error {
+	rateLimit, err := fetchRateLimit(ctx, token)
 	if err != nil {
 		return err
 	}
@@ -115,8 +497,35 @@ func initGlobalLimiter(token string) error {
 	reset := time.Unix(int64(rateLimit.Resources.Core.Reset), 0)
 	duration := time.Until(reset)
 
-	globalLimiter = rate.NewLimiter(rate.Every(duration/time.Duration(limit)), limit)
+	globalLimiter.Store(rate.NewLimiter(rate.Every(duration/time.Duration(limit)), limit))
 	log.Printf("global rate limit set to %d requests per hour\n", limit)
 
 	return nil
 }
+
+// initDefaultGlobalLimiter sets the global limiter to the conservative default budget.
+func initDefaultGlobalLimiter() {
+	globalLimiter.Store(rate.NewLimiter(rate.Every(time.Hour/defaultGlobalLimit), defaultGlobalLimit))
+	log.Printf("global rate limit defaulted to %d requests per hour\n", defaultGlobalLimit)
+}
+
+// retryGlobalLimiter periodically retries initializing the global limiter
+// from GitHub until it succeeds or ctx is done.
+func retryGlobalLimiter(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			tok, err := getInstallationToken()
+			if err == nil {
+				err = initGlobalLimiter(ctx, tok)
+			}
+
+			if err == nil {
+				return
+			}
+			log.Printf("Error fetching global rate limit: %v\n", err)
+		}
+	}
+}
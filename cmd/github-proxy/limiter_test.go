@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"Retry-After seconds", http.StatusForbidden, http.Header{"Retry-After": {"30"}}, 30 * time.Second, 30 * time.Second},
+		{"Retry-After date", http.StatusTooManyRequests, http.Header{"Retry-After": {now.Add(2 * time.Minute).UTC().Format(http.TimeFormat)}}, 118 * time.Second, 2 * time.Minute},
+		{"X-RateLimit-Reset", http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}}, 59 * time.Minute, time.Hour},
+		{"reset in the past", http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)}}, time.Second, time.Second},
+		{"429 without headers", http.StatusTooManyRequests, http.Header{}, time.Minute, time.Minute},
+		{"403 with requests remaining", http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": {"10"}, "X-Ratelimit-Reset": {strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}}, 0, 0},
+		{"500", http.StatusInternalServerError, http.Header{"Retry-After": {"30"}}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		got := rateLimitRetryAfter(&http.Response{StatusCode: tt.status, Header: tt.header})
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: retry after %s, want between %s and %s", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestUpstreamPauseIsPerInstallation(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.setFile("other", "repo", "file.txt", "content")
+
+	other := newTestApp(t, "other", "2", "other")
+	if err := registerApp(other); err != nil {
+		t.Fatal(err)
+	}
+	for _, app := range []*githubApp{defaultApp, other} {
+		if _, err := app.getInstallationToken(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// GitHub rejects a request served with the default app's installation
+	gh.setStatus(http.StatusTooManyRequests)
+	resp := get(handler, "/owner/repo/file.txt")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("status = %d, Retry-After = %q; want 429 after 60s", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	gh.setStatus(0)
+
+	// further requests for that installation are rejected without asking GitHub
+	n := gh.count("/repos/")
+	resp = get(handler, "/owner/repo/file.txt")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("paused installation: status = %d, Retry-After = %q; want 429 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if got := gh.count("/repos/"); got != n {
+		t.Errorf("paused installation: %d requests sent to GitHub", got-n)
+	}
+
+	// while those for other installations are served
+	if resp := get(handler, "/other/repo/file.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("other installation: status = %d, want 200", resp.StatusCode)
+	}
+
+	if _, paused := upstreamPausedUntil("2"); paused {
+		t.Error("installation 2 paused")
+	}
+}
+
+func TestRepoRateCoversListings(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, repoRate, 1)
+	setForTest(t, repoBurst, 2)
+
+	// files and listings of a repo, with or without a trailing slash, share
+	// its limit
+	for _, target := range []string{"/owner/repo", "/owner/repo/file.txt"} {
+		if err := checkLimits(httptest.NewRequest(http.MethodGet, target, nil)); err != nil {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+	for _, target := range []string{"/owner/repo", "/owner/repo/", "/owner/repo/file.txt"} {
+		if err := checkLimits(httptest.NewRequest(http.MethodGet, target, nil)); err == nil {
+			t.Errorf("%s: allowed over the repo limit", target)
+		}
+	}
+
+	if err := checkLimits(httptest.NewRequest(http.MethodGet, "/owner/other", nil)); err != nil {
+		t.Errorf("other repo: %v", err)
+	}
+}
+
+func TestLogRateLimits(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, repoRate, 1)
+	setForTest(t, repoBurst, 1)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	checkLimits(req)
+	if got := logged.String(); strings.Contains(got, "rate limit decision") {
+		t.Errorf("log = %q without -log-rate-limits, want no decisions", got)
+	}
+
+	setForTest(t, logRateLimits, true)
+	checkLimits(req)
+	for _, want := range []string{
+		`rate limit decision: limiter=global key=- allowed=true remaining=`,
+		`rate limit decision: limiter=client key=192.0.2.1 allowed=true remaining=[0-9]+\.[0-9]{2}\n`,
+		`rate limit decision: limiter=repo key=owner/repo allowed=false remaining=0\.[0-9]{2}\n`,
+	} {
+		if !regexp.MustCompile(want).MatchString(logged.String()) {
+			t.Errorf("log = %q, want a line matching %q", logged.String(), want)
+		}
+	}
+}
+
+func TestPathRateLimits(t *testing.T) {
+	newTestProxy(t)
+	limiters, err := parsePathRateLimits("myorg/*/status.json=1:2, myorg/docs/*=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &pathLimiters, limiters)
+
+	// a matched path is throttled at its own limit
+	for i := 0; i < 2; i++ {
+		if err := checkLimits(httptest.NewRequest(http.MethodGet, "/myorg/app/status.json", nil)); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	if err := checkLimits(httptest.NewRequest(http.MethodGet, "/myorg/site/status.json", nil)); err == nil {
+		t.Error("status.json allowed over its path limit")
+	}
+
+	// while other paths, including those with limits of their own, are not
+	for _, target := range []string{"/myorg/app/index.html", "/myorg/docs/guide.md", "/other/app/status.json"} {
+		if err := checkLimits(httptest.NewRequest(http.MethodGet, target, nil)); err != nil {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+
+	for _, s := range []string{"myorg/*", "=60", "myorg/[=60", "myorg/*=0", "myorg/*=ten", "myorg/*=60:0"} {
+		if _, err := parsePathRateLimits(s); err == nil {
+			t.Errorf("parsePathRateLimits(%q): expected an error", s)
+		}
+	}
+}
+
+func TestClientRateLimits(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, clientRate, 1)
+	setForTest(t, clientBurst, 3)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+
+	limiter := getClientLimiter("192.0.2.1")
+	if got := logged.String(); !strings.Contains(got, "client 192.0.2.1 rate set to 1 requests per minute with burst: 3") {
+		t.Errorf("log = %q, want the configured rate and burst", got)
+	}
+	if limiter.Limit() != rate.Every(time.Minute) || limiter.Burst() != 3 {
+		t.Errorf("limit %v with burst %d, want one a minute with burst 3", limiter.Limit(), limiter.Burst())
+	}
+
+	// a client may burst up to -client-burst requests, and then no more
+	for i := 0; i < 3; i++ {
+		if err := checkLimits(httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	if err := checkLimits(httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)); err == nil {
+		t.Error("request allowed over the client limit")
+	}
+
+	// while other clients have limits of their own
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	if err := checkLimits(req); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+	if got := getClientLimiter("192.0.2.1"); got != limiter {
+		t.Error("client limiter not reused")
+	}
+}
+
+func TestClockJumpResetsLimiters(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, clientBurst, 1)
+
+	var offset atomic.Int64
+	setForTest(t, &wallClock, func() time.Time { return time.Now().Round(0).Add(time.Duration(offset.Load())) })
+
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt", nil)
+	if err := checkLimits(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLimits(req); err == nil {
+		t.Fatal("request allowed over the client limit")
+	}
+	unknown := globalLimiter.Load()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchClockJumps(ctx, 10*time.Millisecond, time.Minute)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// time passing as usual leaves the limiters alone
+	time.Sleep(50 * time.Millisecond)
+	if err := checkLimits(req); err == nil {
+		t.Fatal("client limiter reset without a clock jump")
+	}
+
+	// the wall clock jumps an hour ahead
+	offset.Store(int64(time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for checkLimits(req) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("client limiter not reset after the clock jumped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if limiter := globalLimiter.Load(); limiter == unknown || limiter.Burst() != 5000 {
+		t.Error("global limiter not resized from GitHub's rate limit after the clock jumped")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies("10.0.0.0/8, 127.0.0.1,::1,2001:db8::/32,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &trustedProxies, networks)
+
+	for ip, trusted := range map[string]bool{
+		"10.1.2.3":        true,
+		"127.0.0.1":       true,
+		"127.0.0.2":       false,
+		"::1":             true,
+		"2001:db8::7":     true,
+		"2001:db9::7":     false,
+		"203.0.113.5":     false,
+		"not an ip":       false,
+		"::ffff:10.0.0.1": true, // IPv4-mapped
+	} {
+		if got := isTrustedProxy(ip); got != trusted {
+			t.Errorf("isTrustedProxy(%q) = %t, want %t", ip, got, trusted)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.1/8/8"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("parseTrustedProxies(%q): expected an error", s)
+		}
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	networks, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &trustedProxies, networks)
+	setForTest(t, clientIPHeader, "x-real-ip")
+
+	tests := []struct {
+		name      string
+		peer      string
+		realIP    string
+		forwarded string
+		want      string
+	}{
+		{name: "untrusted peer", peer: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer spoofing X-Real-IP", peer: "203.0.113.5:1234", realIP: "198.51.100.7", want: "203.0.113.5"},
+		{name: "untrusted peer spoofing X-Forwarded-For", peer: "203.0.113.5:1234", forwarded: "198.51.100.7", want: "203.0.113.5"},
+		{name: "trusted X-Real-IP", peer: "10.0.0.1:1234", realIP: "198.51.100.7", want: "198.51.100.7"},
+		{name: "trusted X-Forwarded-For", peer: "10.0.0.1:1234", forwarded: "198.51.100.7", want: "198.51.100.7"},
+		{name: "client forging X-Forwarded-For through a trusted proxy", peer: "10.0.0.1:1234", forwarded: "6.6.6.6, 198.51.100.7", want: "198.51.100.7"},
+		{name: "chain of trusted proxies", peer: "10.0.0.1:1234", forwarded: "198.51.100.7, 10.0.0.2", want: "198.51.100.7"},
+		{name: "only trusted proxies forwarded", peer: "10.0.0.1:1234", forwarded: "10.0.0.2", want: "10.0.0.1"},
+		{name: "invalid X-Real-IP", peer: "10.0.0.1:1234", realIP: "garbage", want: "10.0.0.1"},
+		{name: "invalid X-Forwarded-For", peer: "10.0.0.1:1234", forwarded: "198.51.100.7, garbage", want: "10.0.0.1"},
+		{name: "headers disagree", peer: "10.0.0.1:1234", realIP: "198.51.100.7", forwarded: "198.51.100.8", want: "198.51.100.7"},
+		{name: "IPv6 peer", peer: "[2001:db8::1]:1234", realIP: "198.51.100.7", want: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+
+		if got := getClientIP(req); got != tt.want {
+			t.Errorf("%s: client IP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetClientIPEmptyForwardedFor(t *testing.T) {
+	networks, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &trustedProxies, networks)
+
+	// empty and blank forwarded values fall back to the peer address rather
+	// than bucketing all such clients under an empty key
+	for _, forwarded := range []string{"", " ", "\t", ",", " , ,", ", 10.0.0.2"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwarded)
+
+		if got := getClientIP(req); got != "10.0.0.1" {
+			t.Errorf("X-Forwarded-For %q: client IP = %q, want the peer 10.0.0.1", forwarded, got)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listingSchemaVersion is the latest version of the listing JSON schema,
+// served unless a client requests an earlier one.
+const listingSchemaVersion = 1
+
+// listingMediaTypePrefix and listingMediaTypeSuffix surround the version in
+// the media type clients accept to request a listing schema version, e.g.
+// application/vnd.github-proxy.listing.v1+json.
+const (
+	listingMediaTypePrefix = "application/vnd.github-proxy.listing.v"
+	listingMediaTypeSuffix = "+json"
+)
+
+// listingV1 is version 1 of the listing JSON schema.
+type listingV1 struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Entries       []DirectoryEntry `json:"entries"`
+}
+
+// serveListing responds with a JSON listing of the directory entries in file,
+// or of the file itself if it isn't a directory, in the schema version the
+// request asks for. Hidden entries are omitted, and entry paths are made
+// relative to the repo root.
+func serveListing(w http.ResponseWriter, r *http.Request, owner, repo, filePath string, file *FileContent) {
+	w.Header().Add("Vary", "Accept")
+
+	version, err := requestedSchemaVersion(r)
+	if err != nil {
+		httpError(w, http.StatusNotAcceptable, "Not Acceptable", err)
+		return
+	}
+
+	entries := listingEntries(owner, repo, filePath, file)
+	switch version {
+	case 1:
+		serveJSON(w, r, listingV1{SchemaVersion: 1, Entries: entries})
+	}
+}
+
+// requestedSchemaVersion returns the listing schema version requested by the
+// schema-version query parameter, or else by a listing media type in the
+// Accept header, defaulting to the latest. It returns an error if the version
+// requested isn't supported.
+func requestedSchemaVersion(r *http.Request) (int, error) {
+	if value := r.URL.Query().Get("schema-version"); value != "" {
+		return checkSchemaVersion(value)
+	}
+
+	var requested []string
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		value, ok := strings.CutPrefix(mediaType, listingMediaTypePrefix)
+		if !ok {
+			continue
+		}
+		value, ok = strings.CutSuffix(value, listingMediaTypeSuffix)
+		if !ok {
+			continue
+		}
+
+		if version, err := checkSchemaVersion(value); err == nil {
+			return version, nil
+		}
+		requested = append(requested, mediaType)
+	}
+
+	if len(requested) > 0 {
+		return 0, fmt.Errorf("unsupported listing schema: %s", strings.Join(requested, ", "))
+	}
+
+	return listingSchemaVersion, nil
+}
+
+// checkSchemaVersion parses a listing schema version, returning an error if
+// it isn't supported.
+func checkSchemaVersion(value string) (int, error) {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 || version > listingSchemaVersion {
+		return 0, fmt.Errorf("unsupported listing schema version: %s", value)
+	}
+
+	return version, nil
+}
+
+// serveJSON responds with v encoded as JSON and a strong ETag hashed from the
+// encoding, answering a request with a matching If-None-Match with 304 Not
+// Modified. Listings include the git SHA of each entry, so their ETag changes
+// whenever the directory's tree does.
+func serveJSON(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Internal Server Error", err)
+		return
+	}
+	body = append(body, '\n')
+
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", "application/json")
+
+	// ServeContent handles If-None-Match, HEAD and Range requests
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// repoIndex is the JSON index served at the root of a repo.
+type repoIndex struct {
+	Repository *Repository      `json:"repository"`
+	Entries    []DirectoryEntry `json:"entries"`
+}
+
+// serveRepoIndex responds with a JSON index of the repo: its metadata and the
+// entries at its root.
+func serveRepoIndex(w http.ResponseWriter, r *http.Request, owner, repo, ref, token string) {
+	repository, err := getRepoInfo(r.Context(), owner, repo, token)
+	if err != nil {
+		upstreamFailure(w, err)
+		return
+	}
+
+	root := repoRootFor(owner, repo)
+	file, err := GetFileContent(r.Context(), owner, repo, root, ref, token, nil, false)
+	if err != nil {
+		upstreamFailure(w, err)
+		return
+	}
+
+	serveJSON(w, r, repoIndex{
+		Repository: repository,
+		Entries:    listingEntries(owner, repo, root, file),
+	})
+}
+
+// listingEntries returns the directory entries in file, or the file itself if
+// it isn't a directory. Hidden entries are omitted, and entry paths are made
+// relative to the repo root.
+func listingEntries(owner, repo, filePath string, file *FileContent) []DirectoryEntry {
+	entries := file.Listing
+	if entries == nil {
+		entries = []DirectoryEntry{{
+			Name: path.Base(filePath),
+			Path: filePath,
+			Type: "file",
+			Size: int64(len(file.Content)),
+			SHA:  file.SHA,
+		}}
+	}
+
+	root := repoRootFor(owner, repo)
+	listing := make([]DirectoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if isHiddenPath(entry.Name) {
+			continue
+		}
+
+		if root != "" {
+			entry.Path = strings.TrimPrefix(strings.TrimPrefix(entry.Path, root), "/")
+		}
+		listing = append(listing, entry)
+	}
+
+	return listing
+}
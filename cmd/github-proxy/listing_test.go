@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListingETag(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "docs/a.md", "a")
+	gh.setFile("owner", "repo", "docs/b.md", "b")
+
+	resp := get(handler, "/owner/repo/docs")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || etag[0] != '"' {
+		t.Fatalf("ETag = %q, want a strong validator", etag)
+	}
+
+	var listing listingV1
+	if err := json.Unmarshal([]byte(body(t, resp)), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if entries := listing.Entries; len(entries) != 2 || entries[0].SHA != blobSHA("a") {
+		t.Fatalf("entries = %+v, want a.md and b.md with their SHAs", entries)
+	}
+
+	// unchanged directory
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/docs", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = serve(handler, req)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("unchanged: status = %d, want 304", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got != etag {
+		t.Errorf("unchanged: ETag = %q, want %q", got, etag)
+	}
+
+	// a file in the directory changes
+	gh.setFile("owner", "repo", "docs/b.md", "b2")
+
+	req = httptest.NewRequest(http.MethodGet, "/owner/repo/docs", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = serve(handler, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("changed: status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); got == "" || got == etag {
+		t.Errorf("changed: ETag = %q, want a new one", got)
+	}
+}
+
+func TestListingETagForFile(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	resp := get(handler, "/owner/repo/file.txt?format=json")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag = %q; want 200 with an ETag", resp.StatusCode, etag)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/owner/repo/file.txt?format=json", nil)
+	req.Header.Set("If-None-Match", etag)
+	if resp := serve(handler, req); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status = %d, want 304", resp.StatusCode)
+	}
+}
+
+func TestDirectoryListing(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "docs/a.md", "a")
+	gh.setFile("owner", "repo", "docs/guide/b.md", "bb")
+
+	tests := []struct {
+		target  string
+		entries []DirectoryEntry
+	}{
+		{"/owner/repo/docs", []DirectoryEntry{
+			{Name: "a.md", Path: "docs/a.md", Type: "file", Size: 1, SHA: blobSHA("a")},
+			{Name: "guide", Path: "docs/guide", Type: "dir", SHA: blobSHA("owner/repo/docs/guide")},
+		}},
+		{"/owner/repo/docs/guide?format=json", []DirectoryEntry{
+			{Name: "b.md", Path: "docs/guide/b.md", Type: "file", Size: 2, SHA: blobSHA("bb")},
+		}},
+		{"/owner/repo/docs/guide/b.md?format=json", []DirectoryEntry{
+			{Name: "b.md", Path: "docs/guide/b.md", Type: "file", Size: 2, SHA: blobSHA("bb")},
+		}},
+	}
+
+	for _, tt := range tests {
+		resp := get(handler, tt.target)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: status %d, Content-Type %q; want 200 with JSON", tt.target, resp.StatusCode, resp.Header.Get("Content-Type"))
+			continue
+		}
+
+		var listing listingV1
+		if err := json.Unmarshal([]byte(body(t, resp)), &listing); err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+		if !reflect.DeepEqual(listing.Entries, tt.entries) {
+			t.Errorf("%s: entries = %+v, want %+v", tt.target, listing.Entries, tt.entries)
+		}
+	}
+
+	// directory listings are cached, and revalidated like files
+	get(handler, "/owner/repo/docs")
+	if got := gh.lastRequest("/repos/owner/repo/contents/docs").Header.Get("If-None-Match"); got == "" {
+		t.Error("cached directory listing revalidated without If-None-Match")
+	}
+}
+
+func TestUnexpectedContentsResponse(t *testing.T) {
+	gh, handler := newTestProxy(t)
+
+	// the contents API returns an object for a file and an array for a
+	// directory, but nothing else
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/repos/") {
+			w.Write([]byte(`"file.txt"`))
+			return
+		}
+		gh.serveHTTP(w, r)
+	}))
+	defer server.Close()
+	setForTest(t, &githubAPIURL, server.URL)
+
+	if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestListingSchemaVersion(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "docs/a.md", "a")
+
+	tests := []struct {
+		name    string
+		target  string
+		accept  string
+		status  int
+		version int
+	}{
+		{name: "default", target: "/owner/repo/docs", status: http.StatusOK, version: 1},
+		{name: "query", target: "/owner/repo/docs?schema-version=1", status: http.StatusOK, version: 1},
+		{name: "accept", target: "/owner/repo/docs", accept: "application/vnd.github-proxy.listing.v1+json", status: http.StatusOK, version: 1},
+		{name: "accept among others", target: "/owner/repo/docs", accept: "application/vnd.github-proxy.listing.v9+json, application/vnd.github-proxy.listing.v1+json;q=0.5", status: http.StatusOK, version: 1},
+		{name: "unrelated accept", target: "/owner/repo/docs", accept: "application/json, */*", status: http.StatusOK, version: 1},
+		{name: "query overrides accept", target: "/owner/repo/docs?schema-version=1", accept: "application/vnd.github-proxy.listing.v9+json", status: http.StatusOK, version: 1},
+		{name: "file", target: "/owner/repo/docs/a.md?format=json&schema-version=1", status: http.StatusOK, version: 1},
+		{name: "unsupported query", target: "/owner/repo/docs?schema-version=2", status: http.StatusNotAcceptable},
+		{name: "invalid query", target: "/owner/repo/docs?schema-version=v1", status: http.StatusNotAcceptable},
+		{name: "unsupported accept", target: "/owner/repo/docs", accept: "application/vnd.github-proxy.listing.v0+json", status: http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+
+		resp := serve(handler, req)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept" {
+			t.Errorf("%s: Vary = %q, want Accept", tt.name, got)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var listing struct {
+			SchemaVersion int               `json:"schemaVersion"`
+			Entries       []json.RawMessage `json:"entries"`
+		}
+		if err := json.Unmarshal([]byte(body(t, resp)), &listing); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if listing.SchemaVersion != tt.version || len(listing.Entries) != 1 {
+			t.Errorf("%s: schemaVersion = %d with %d entries, want %d with 1", tt.name, listing.SchemaVersion, len(listing.Entries), tt.version)
+		}
+	}
+}
+
+func TestRepoIndex(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "README.md", "readme")
+	gh.setFile("owner", "repo", "docs/guide.md", "guide")
+	gh.setFile("owner", "repo", ".env", "secret")
+	setForTest(t, emptyPathBehavior, "repo-index")
+
+	for _, target := range []string{"/owner/repo/", "/owner/repo"} {
+		resp := get(handler, target)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: status %d, Content-Type %q; want 200 with JSON", target, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		var index repoIndex
+		if err := json.Unmarshal([]byte(body(t, resp)), &index); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if repository := index.Repository; repository == nil || repository.FullName != "owner/repo" || repository.DefaultBranch != "main" || repository.Archived {
+			t.Errorf("%s: repository = %+v, want owner/repo's metadata", target, repository)
+		}
+
+		var names []string
+		for _, entry := range index.Entries {
+			names = append(names, entry.Name+":"+entry.Type)
+		}
+		if got := strings.Join(names, " "); got != "README.md:file docs:dir" {
+			t.Errorf("%s: entries %s, want README.md and docs without hidden files", target, got)
+		}
+	}
+
+	// a repo that isn't allowed has no index
+	patterns, err := parseRepoPatterns("owner/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &allowedRepos, patterns)
+	if resp := get(handler, "/owner/repo/"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("repo not allowed: status = %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "container/list"
+
+// lruMap is a map holding at most max entries, evicting the least recently
+// used entry to make room for a new one. It is not safe for concurrent use.
+type lruMap[V any] struct {
+	max     int
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// newLRUMap returns an empty lruMap holding at most max entries.
+func newLRUMap[V any](max int) *lruMap[V] {
+	return &lruMap[V]{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value for key, marking it as recently used.
+func (m *lruMap[V]) get(key string) (V, bool) {
+	e, ok := m.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	m.order.MoveToFront(e)
+	return e.Value.(*lruEntry[V]).value, true
+}
+
+// put sets the value for key, evicting the least recently used entry if the
+// map is full.
+func (m *lruMap[V]) put(key string, value V) {
+	if e, ok := m.entries[key]; ok {
+		e.Value.(*lruEntry[V]).value = value
+		m.order.MoveToFront(e)
+		return
+	}
+
+	if m.order.Len() >= m.max {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+
+	m.entries[key] = m.order.PushFront(&lruEntry[V]{key, value})
+}
+
+// remove deletes the entry for key, if any.
+func (m *lruMap[V]) remove(key string) {
+	if e, ok := m.entries[key]; ok {
+		m.order.Remove(e)
+		delete(m.entries, key)
+	}
+}
+
+// oldest returns the least recently used entry, if any.
+func (m *lruMap[V]) oldest() (string, V, bool) {
+	e := m.order.Back()
+	if e == nil {
+		var zero V
+		return "", zero, false
+	}
+
+	entry := e.Value.(*lruEntry[V])
+	return entry.key, entry.value, true
+}
+
+// len returns the number of entries in the map.
+func (m *lruMap[V]) len() int {
+	return m.order.Len()
+}
@@ -9,23 +9,152 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
 var (
-	privateKeyPath *string = flag.String("private-key", "", "Path to the GitHub App private key file")
-	useVault       *bool   = flag.Bool("use-vault", false, "Use HashiCorp Vault to retrieve the private key")
-	clientID       *string = flag.String("client-id", "", "GitHub App client ID")
-	installationID *string = flag.String("installation-id", "", "GitHub App installation ID")
-	bindAddr       *string = flag.String("bind", ":8080", "Address to bind the server to")
-	verCheck       *bool   = flag.Bool("version", false, "Print the version and exit")
+	privateKeyPath       *string        = flag.String("private-key", "", "Path to the GitHub App private key file")
+	useVault             *bool          = flag.Bool("use-vault", false, "Use HashiCorp Vault to retrieve the private key")
+	clientID             *string        = flag.String("client-id", "", "GitHub App client ID")
+	forwardConditional   *bool          = flag.Bool("forward-conditional", false, "Forward If-None-Match/If-Modified-Since to GitHub and relay 304 responses")
+	installationID       *string        = flag.String("installation-id", "", "GitHub App installation ID")
+	bindAddr             *string        = flag.String("bind", ":8080", "Address to bind the server to")
+	verCheck             *bool          = flag.Bool("version", false, "Print the version and exit")
+	authToken            *string        = flag.String("auth-token", "", "Token clients must present as a Bearer token in the Authorization header")
+	allowedRefsFlag      *string        = flag.String("allowed-refs", "", "Comma-separated owner/repo=pattern pairs restricting which refs a repo is served from")
+	allowQueryKey        *bool          = flag.Bool("allow-query-key", false, "Also accept the auth token via the 'key' query parameter")
+	authMode             *string        = flag.String("auth-mode", "", "Client authentication: none, static or jwt (default static if -auth-token is set, otherwise none)")
+	authJWKSURL          *string        = flag.String("auth-jwks-url", "", "URL of the JWKS used to verify client JWTs in jwt auth mode")
+	authJWTIssuer        *string        = flag.String("auth-jwt-issuer", "", "Required iss claim of client JWTs in jwt auth mode")
+	authJWTAud           *string        = flag.String("auth-jwt-audience", "", "Required aud claim of client JWTs in jwt auth mode")
+	strictKeySrc         *bool          = flag.Bool("strict-key-source", false, "Fail if more than one private key source is configured")
+	maxConnsHost         *int           = flag.Int("max-conns-per-host", 0, "Maximum concurrent connections to each upstream host (0 for no limit)")
+	maxTokenRefreshes    *int           = flag.Int("max-token-refreshes", 2, "Maximum concurrent installation token requests across all GitHub Apps")
+	retryBudgetFlag      *int           = flag.Int("retry-budget", 10, "Size of the retry budget shared by all retried GitHub requests; retries stop while it is less than half full (0 for no budget)")
+	accessLogFile        *string        = flag.String("access-log-file", "", "Write access logs to this file instead of stderr (reopened on SIGHUP)")
+	repoRoot             *string        = flag.String("repo-root", "", "Directory within each repo that request paths are relative to")
+	repoRootsFlag        *string        = flag.String("repo-roots", "", "Per-repo roots as comma-separated owner/repo=dir pairs, overriding -repo-root")
+	failClosed           *bool          = flag.Bool("fail-closed", false, "Reject requests while GitHub's rate limit is unknown instead of assuming a default")
+	compressBodies       *bool          = flag.Bool("compress", false, "Compress text responses with brotli or gzip when the client accepts it")
+	ctPrecedence         *string        = flag.String("content-type-precedence", "override,extension,sniff", "Order in which content type sources are consulted")
+	ctOverrides          *string        = flag.String("content-type-overrides", "", "Comma-separated .ext=type content type overrides")
+	echoRequestID        *bool          = flag.Bool("echo-github-request-id", false, "Echo GitHub's X-GitHub-Request-Id response header to clients")
+	rootBehavior         *string        = flag.String("root-behavior", "404", "Response to requests for /: 404, redirect or index")
+	rootRedirectURL      *string        = flag.String("root-redirect-url", "", "URL to redirect / to when -root-behavior is redirect")
+	rootIndexFile        *string        = flag.String("root-index-file", "", "Local file to serve at / when -root-behavior is index")
+	serverTiming         *bool          = flag.Bool("server-timing", false, "Add a Server-Timing header with token, upstream and total durations")
+	sitemapEnabled       *bool          = flag.Bool("sitemap", false, "Serve a generated /owner/repo/sitemap.xml listing the repo's HTML files")
+	sitemapTTL           *time.Duration = flag.Duration("sitemap-ttl", time.Hour, "How long generated sitemaps are cached")
+	serveStaleOnError    *time.Duration = flag.Duration("serve-stale-on-error", 0, "How long after a cached file or sitemap expires it is still served if GitHub fails (0 to disable)")
+	cacheMaxBytes        *int64         = flag.Int64("cache-max-bytes", 0, "Maximum bytes held in each of the file and sitemap caches (0 for no limit)")
+	readinessGrace       *time.Duration = flag.Duration("readiness-grace", 0, "How long after startup completes /readyz keeps responding 503, giving the proxy time to warm up before receiving traffic")
+	redactFlag           *string        = flag.String("redact-params", "key,token,access_token", "Comma-separated query parameters whose values are redacted from logs")
+	strictPaths          *bool          = flag.Bool("strict-paths", false, "Reject paths containing duplicate slashes instead of collapsing them")
+	tlsCert              *string        = flag.String("tls-cert", "", "Path to a TLS certificate file; serves HTTPS when set with -tls-key")
+	tlsKey               *string        = flag.String("tls-key", "", "Path to the TLS private key file for -tls-cert")
+	appHeader            *string        = flag.String("app-header", "", "Request header naming the GitHub App to serve a request with (empty to disable)")
+	appSpecs             *appFlag       = newAppFlag("app", "Additional GitHub App as comma-separated name, client-id, installation-id, private-key and owners fields (repeatable)")
+	tlsMinVersion        *string        = flag.String("tls-min-version", "1.2", "Minimum TLS version to accept (1.2 or 1.3)")
+	decompressGzip       *bool          = flag.Bool("decompress-gzip", false, "Decompress .gz files for clients that do not accept gzip")
+	tokenPermsFlag       *string        = flag.String("token-permissions", "", "Comma-separated name=level permissions to request for installation tokens")
+	maxDecompressed      *int64         = flag.Int64("max-decompressed-size", 100<<20, "Maximum size in bytes of decompressed content")
+	archivedBehavior     *string        = flag.String("archived-behavior", "serve", "Handling of requests for archived repos: serve, warn or block")
+	metricsBind          *string        = flag.String("metrics-bind", "", "Address to serve Prometheus metrics on at /metrics (empty to disable)")
+	shutdownTimeout      *time.Duration = flag.Duration("shutdown-timeout", 5*time.Second, "How long shutdown waits for in-flight requests to complete before closing their connections")
+	detectCharset        *bool          = flag.Bool("detect-charset", false, "Append a detected charset to text content types that lack one")
+	allowedHostsFlag     *string        = flag.String("allowed-hosts", "", "Comma-separated Host header values to accept; others are rejected (empty to accept any)")
+	logRateLimits        *bool          = flag.Bool("log-rate-limits", false, "Log every rate limit decision (for tuning limits)")
+	allowReposFlag       *string        = flag.String("allow-repos", "", "Comma-separated owner/repo patterns restricting which repos are served (empty to allow any)")
+	redirectToHTTPS      *bool          = flag.Bool("redirect-http", false, "Redirect plain HTTP requests to HTTPS")
+	githubAPIURLFlag     *string        = flag.String("github-api-url", "https://api.github.com", "Base URL of the GitHub REST API")
+	cacheTTLFlag         *time.Duration = flag.Duration("cache-ttl", 0, "How long cached files are served without revalidating them with GitHub")
+	cacheTTLsFlag        *string        = flag.String("cache-ttls", "", "Comma-separated content type pattern=duration cache TTLs, overriding -cache-ttl")
+	maxRetries           *int           = flag.Int("max-retries", 3, "Maximum retries of GitHub requests failing with a network error or 5xx response")
+	signingKey           *string        = flag.String("signing-key", "", "Secret key for HMAC signing responses in the X-Content-Signature header")
+	githubTimeout        *time.Duration = flag.Duration("github-timeout", time.Minute, "Timeout for each request to GitHub, including reading the response unless it is streamed (0 for no timeout)")
+	relayETag            *bool          = flag.Bool("relay-etag", false, "Serve files with the ETag GitHub reported for them")
+	pathRateLimits       *string        = flag.String("path-rate-limits", "", "Comma-separated pattern=requests-per-minute[:burst] rate limits for matching paths")
+	repoInfoTTL          *time.Duration = flag.Duration("repo-info-ttl", 10*time.Minute, "How long repo metadata, such as the default branch, is cached")
+	webhookSecret        *string        = flag.String("webhook-secret", "", "Secret of GitHub webhooks delivered to /_webhooks/github (empty to disable)")
+	installationsFlag    *string        = flag.String("installations", "", "Comma-separated owner=installation-id pairs of further installations of the GitHub App")
+	configFile           *string        = flag.String("config", "", "Path to a YAML or JSON file setting options, overridden by flags")
+	maxTrackedRepos      *int           = flag.Int("max-tracked-repos", 10000, "Maximum number of repos for which per-repo state, such as metadata and sitemaps, is kept")
+	clientRate           *int           = flag.Int("client-rate", 60, "Maximum requests per minute from each client IP")
+	clientBurst          *int           = flag.Int("client-burst", 8, "Maximum burst of requests from each client IP")
+	tokenFailureBehavior *string        = flag.String("token-failure-behavior", "error", "Response to requests when no installation token can be obtained: error, unavailable or serve-stale")
+	repoRate             *int           = flag.Int("repo-rate", 0, "Maximum requests per minute for each repo, across all clients (0 for no limit)")
+	repoBurst            *int           = flag.Int("repo-burst", 8, "Maximum burst of requests for each repo, with -repo-rate")
+	maxJSONSize          *int64         = flag.Int64("max-json-size", 10<<20, "Maximum size in bytes of JSON responses from GitHub")
+	clientIPHeader       *string        = flag.String("client-ip-header", "x-real-ip", "Forwarding header preferred for the client IP when both are set: x-real-ip or x-forwarded-for")
+	trustedProxiesFlag   *string        = flag.String("trusted-proxies", "", "Comma-separated CIDR ranges of proxies whose X-Real-IP and X-Forwarded-For headers are trusted")
+	repoIndexEnabled     *bool          = flag.Bool("repo-index", false, "Serve a JSON index of repo metadata and top-level entries at /owner/repo/")
+	rejectGetBody        *bool          = flag.Bool("reject-get-body", false, "Reject GET and HEAD requests with a body with 400")
+	tlsRedirect          *string        = flag.String("tls-redirect", "", "Address of a plain HTTP listener redirecting to HTTPS, with -tls-cert (empty to disable)")
+	allowedParamsFlag    *string        = flag.String("allowed-params", "", "Comma-separated query parameters accepted in requests (empty to accept any)")
+	unknownParams        *string        = flag.String("unknown-params", "reject", "Handling of query parameters not in -allowed-params: reject or strip")
+	githubAPIVersion     *string        = flag.String("github-api-version", "2022-11-28", "GitHub REST API version requested with the X-GitHub-Api-Version header (empty to omit)")
+	defaultCacheControl  *string        = flag.String("default-cache-control", "", "Cache-Control header for files when GitHub sends none, e.g. public, max-age=300")
+	clockJumpThreshold   *time.Duration = flag.Duration("clock-jump-threshold", 0, "Reset rate limiters when the wall clock jumps by more than this (0 to disable)")
+	symlinkBehavior      *string        = flag.String("symlink-behavior", "target", "Response to requests for symlinks GitHub does not resolve: target or follow")
+	emptyPathBehavior    *string        = flag.String("empty-path-behavior", "listing", "Response to requests for a repo without a file path: listing, index, repo-index or reject")
+	repoIndexFile        *string        = flag.String("repo-index-file", "index.html", "File served for requests without a file path when -empty-path-behavior is index")
+	streamThreshold      *int64         = flag.Int64("stream-threshold", 100<<20, "Stream files larger than this many bytes to clients instead of reading them into memory (0 to disable)")
+	noSniffReposFlag     *string        = flag.String("no-sniff-repos", "", "Comma-separated owner/repo patterns of repos whose content types are never sniffed from file content")
+	requestTimeout       *time.Duration = flag.Duration("request-timeout", 0, "Maximum time to serve each request, including its GitHub requests (0 for no limit)")
+	shedBelow            *int           = flag.Int("shed-below", 0, "Reject requests for uncached files with 503 when fewer GitHub requests than this remain (0 to disable)")
+	check                *bool          = flag.Bool("check", false, "Check the configuration and obtain an installation token for each GitHub App, then exit")
+	adminToken           *string        = flag.String("admin-token", "", "Token admin clients must present as a Bearer token to use the /_admin endpoints (empty to disable them)")
+
+	verboseErrors *bool = flag.Bool("verbose-errors", false, "Include error details in error response bodies (for debugging)")
 
 	versionCheckErr error = fmt.Errorf("version check")
 )
 
 var Version string = "dev"
 
+// background tracks long-running goroutines so shutdown can wait for them.
+var background sync.WaitGroup
+
+// goBackground runs fn in a goroutine tracked by the background wait group.
+func goBackground(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// waitBackground waits for all background goroutines to exit, or for ctx to be done.
+func waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background workers did not exit: %w", ctx.Err())
+	}
+}
+
+// shutdownServer stops server accepting connections, closing idle ones, and
+// waits up to timeout for in-flight requests to complete before closing the
+// connections that remain.
+func shutdownServer(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+		server.Close()
+	}
+}
+
 func main() {
 	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer done()
@@ -35,49 +164,140 @@ func main() {
 			return
 		}
 
+		if *check {
+			fmt.Printf("configuration: FAILED: %v\ncheck failed\n", err)
+			os.Exit(1)
+		}
+
 		log.Fatalf("Error parsing flags: %v", err)
 	}
 
-	// set up global rate limiter
-	if tok, err := getInstallationToken(); err != nil {
-		log.Fatalf("Error getting installation token: %v", err)
-	} else {
-		if err := initGlobalLimiter(tok); err != nil {
-			log.Fatalf("Error initializing global rate limiter: %v", err)
+	// verify the configuration and credentials, then exit without serving
+	if *check {
+		if !runCheck() {
+			os.Exit(1)
 		}
+		return
 	}
 
-	// start cleanup goroutine
-	go cleanupStaleLimiters(ctx, 30*time.Minute)
+	// route access logs to a dedicated file, reopened on SIGHUP for rotation
+	if *accessLogFile != "" {
+		f, err := openReopenableFile(*accessLogFile)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer f.Close()
+
+		accessLog.SetOutput(f)
+		goBackground(func() { reopenOnSIGHUP(ctx, f) })
+	}
+
+	// start the background workers, only reporting ready once all have started
+	if err := runStartup(ctx, startupSteps()); err != nil {
+		log.Fatalf("Error starting up: %v", err)
+	}
+	setReady(true)
 
 	// Define routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", requestHandler(ctx))
+	mux.HandleFunc("/_admin/token/refresh", tokenRefreshHandler)
+	mux.HandleFunc("/_admin/health", healthHandler)
+	mux.HandleFunc("/_webhooks/github", webhookHandler)
+
+	var handler http.Handler = collapseSlashes(mux)
+	if len(allowedHosts) > 0 {
+		handler = restrictHosts(handler)
+	}
+	if *redirectToHTTPS {
+		handler = redirectHTTP(handler)
+	}
+	if *compressBodies {
+		handler = compress(handler)
+	}
+
+	// serve metrics on a separate address, so they aren't exposed publicly
+	var metricsServer *http.Server
+	if *metricsBind != "" {
+		registerMetrics()
+		metricsServer = newMetricsServer(*metricsBind)
+
+		go func() {
+			log.Printf("Metrics server started on %s", *metricsBind)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Error starting metrics server: %v", err)
+			}
+		}()
+	}
 
 	// Create the HTTP server
 	server := &http.Server{
 		Addr:    *bindAddr,
-		Handler: mux,
+		Handler: logAccess(healthProbes(handler)),
 	}
 
 	// Start the HTTP server
 	go func() {
-		log.Printf("Server started on %s", *bindAddr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if *tlsCert != "" {
+			server.TLSConfig, err = newTLSConfig(*tlsMinVersion)
+			if err != nil {
+				log.Fatalf("Error configuring TLS: %v", err)
+			}
+
+			log.Printf("Server started on %s (TLS)", *bindAddr)
+			err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			log.Printf("Server started on %s", *bindAddr)
+			err = server.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Error starting server: %v", err)
 		}
 	}()
 
+	// redirect plain HTTP requests on a second listener to the HTTPS server
+	var redirectServer *http.Server
+	if *tlsRedirect != "" {
+		redirectServer = &http.Server{
+			Addr:    *tlsRedirect,
+			Handler: redirectToTLS(*bindAddr),
+		}
+
+		go func() {
+			log.Printf("HTTPS redirect server started on %s", *tlsRedirect)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Error starting HTTPS redirect server: %v", err)
+			}
+		}()
+	}
+
 	// Wait for the context to be canceled (e.g., by Ctrl+C)
 	<-ctx.Done()
+	setReady(false)
+
+	shutdownServer(server, *shutdownTimeout)
 
-	// Create a new context with a timeout to allow for graceful shutdown
+	// Create a new context with a timeout to allow for the rest of the shutdown
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Attempt to gracefully shut down the server
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error stopping metrics server: %v", err)
+		}
+	}
+
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error stopping HTTPS redirect server: %v", err)
+		}
+	}
+
+	// Wait for background goroutines, bounded by the shutdown timeout
+	if err := waitBackground(shutdownCtx); err != nil {
+		log.Printf("Error stopping background workers: %v", err)
 	}
 
 	log.Println("Server exiting")
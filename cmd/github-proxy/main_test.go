@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	// the proxy logs every request; keep test output to failures
+	log.SetOutput(io.Discard)
+	accessLog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeGitHub is a stub of the GitHub API serving the files of its repos,
+// recording the requests it receives.
+type fakeGitHub struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	files     map[string]string // content by owner/repo/path
+	lfs       map[string]string // LFS object content by oid
+	archived  map[string]bool   // by owner/repo
+	status    int               // if set, every request is answered with it
+	inlineMax int               // files larger than this are served without inline content, as GitHub does over 1MB
+	stall     time.Duration     // if set, blob and LFS downloads pause halfway through for it
+	tokenTTL  time.Duration     // how long installation tokens last
+	remaining int               // if set, reported as the requests remaining in the rate limit
+	requests  []*http.Request
+	tokens    int
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	t.Helper()
+
+	gh := &fakeGitHub{files: make(map[string]string), lfs: make(map[string]string), archived: make(map[string]bool), inlineMax: 1 << 20, tokenTTL: time.Hour}
+	gh.Server = httptest.NewServer(http.HandlerFunc(gh.serveHTTP))
+	t.Cleanup(gh.Close)
+
+	return gh
+}
+
+// setFile adds or replaces a file in the repos served.
+func (gh *fakeGitHub) setFile(owner, repo, path, content string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+
+	gh.files[owner+"/"+repo+"/"+path] = content
+}
+
+// setLFSFile adds or replaces a file in the repos served, stored in git LFS.
+func (gh *fakeGitHub) setLFSFile(owner, repo, path, content string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+	gh.lfs[oid] = content
+	gh.files[owner+"/"+repo+"/"+path] = fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(content))
+}
+
+// setStatus makes every later request fail with status, or succeed if it is 0.
+func (gh *fakeGitHub) setStatus(status int) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+
+	gh.status = status
+}
+
+// count returns the number of requests received whose path starts with prefix.
+func (gh *fakeGitHub) count(prefix string) int {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+
+	n := 0
+	for _, r := range gh.requests {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// lastRequest returns the last request received whose path starts with prefix.
+func (gh *fakeGitHub) lastRequest(prefix string) *http.Request {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+
+	for i := len(gh.requests) - 1; i >= 0; i-- {
+		if strings.HasPrefix(gh.requests[i].URL.Path, prefix) {
+			return gh.requests[i]
+		}
+	}
+	return nil
+}
+
+func blobSHA(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (gh *fakeGitHub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	gh.mu.Lock()
+	gh.requests = append(gh.requests, r.Clone(context.Background()))
+	requestID := fmt.Sprintf("FAKE:%d", len(gh.requests))
+	status, remaining := gh.status, gh.remaining
+	gh.mu.Unlock()
+
+	w.Header().Set("X-GitHub-Request-Id", requestID)
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if remaining != 0 {
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 5)
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[0] == "app" && parts[3] == "access_tokens":
+		gh.mu.Lock()
+		gh.tokens++
+		token := fmt.Sprintf("ghs_%s_%d", parts[2], gh.tokens)
+		expiresAt := time.Now().Add(gh.tokenTTL).UTC().Format(time.RFC3339)
+		gh.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"token": token, "expires_at": expiresAt})
+
+	case r.URL.Path == "/rate_limit":
+		reset := time.Now().Add(time.Hour).Unix()
+		fmt.Fprintf(w, `{"resources":{"core":{"limit":5000,"remaining":5000,"reset":%d}}}`, reset)
+
+	case len(parts) == 3 && parts[0] == "repos":
+		gh.mu.Lock()
+		archived := gh.archived[parts[1]+"/"+parts[2]]
+		gh.mu.Unlock()
+
+		json.NewEncoder(w).Encode(Repository{FullName: parts[1] + "/" + parts[2], DefaultBranch: "main", Archived: archived})
+
+	case len(parts) >= 4 && parts[0] == "repos" && parts[3] == "contents":
+		var filePath string
+		if len(parts) == 5 {
+			filePath = parts[4]
+		}
+		gh.serveContents(w, r, parts[1]+"/"+parts[2], filePath)
+
+	case len(parts) == 5 && parts[0] == "repos" && parts[3] == "git" && strings.HasPrefix(parts[4], "trees/"):
+		gh.serveTree(w, parts[1]+"/"+parts[2])
+
+	case len(parts) == 5 && parts[0] == "repos" && parts[3] == "git" && strings.HasPrefix(parts[4], "blobs/"):
+		gh.serveBlob(w, r, parts[1]+"/"+parts[2], strings.TrimPrefix(parts[4], "blobs/"))
+
+	case r.Method == http.MethodPost && len(parts) == 5 && parts[0] == "repos" && parts[3] == "git" && parts[4] == "lfs/objects/batch":
+		gh.serveLFSBatch(w, r)
+
+	case len(parts) == 2 && parts[0] == "lfs":
+		gh.mu.Lock()
+		content, ok := gh.lfs[parts[1]]
+		gh.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		gh.serveDownload(w, content)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveContents answers a contents API request with a file, or a listing of
+// the directory's entries, honouring If-None-Match.
+func (gh *fakeGitHub) serveContents(w http.ResponseWriter, r *http.Request, repo, filePath string) {
+	gh.mu.Lock()
+	content, isFile := gh.files[repo+"/"+filePath]
+
+	var listing []DirectoryEntry
+	if !isFile {
+		prefix := repo + "/"
+		if filePath != "" {
+			prefix += filePath + "/"
+		}
+
+		seen := make(map[string]bool)
+		for name, content := range gh.files {
+			rest, ok := strings.CutPrefix(name, prefix)
+			if !ok {
+				continue
+			}
+
+			entry, _, isDir := strings.Cut(rest, "/")
+			if seen[entry] {
+				continue
+			}
+			seen[entry] = true
+
+			e := DirectoryEntry{Name: entry, Path: strings.TrimPrefix(filePath+"/"+entry, "/"), Type: "file", Size: int64(len(content)), SHA: blobSHA(content)}
+			if isDir {
+				e.Type, e.Size, e.SHA = "dir", 0, blobSHA(prefix+entry)
+			}
+			listing = append(listing, e)
+		}
+		sort.Slice(listing, func(i, j int) bool { return listing[i].Name < listing[j].Name })
+	}
+	gh.mu.Unlock()
+
+	if !isFile && listing == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var body []byte
+	if isFile {
+		encoding, inline := "base64", base64.StdEncoding.EncodeToString([]byte(content))
+		if len(content) > gh.inlineMax {
+			encoding, inline = "none", ""
+		}
+
+		body, _ = json.Marshal(map[string]any{
+			"type":     "file",
+			"name":     filePath[strings.LastIndex(filePath, "/")+1:],
+			"sha":      blobSHA(content),
+			"size":     len(content),
+			"encoding": encoding,
+			"content":  inline,
+		})
+	} else {
+		body, _ = json.Marshal(listing)
+	}
+
+	etag := `"` + blobSHA(string(body)) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// serveTree answers a recursive trees API request with the repo's files.
+func (gh *fakeGitHub) serveTree(w http.ResponseWriter, repo string) {
+	gh.mu.Lock()
+	var tree []TreeEntry
+	for name := range gh.files {
+		if p, ok := strings.CutPrefix(name, repo+"/"); ok {
+			tree = append(tree, TreeEntry{Path: p, Type: "blob"})
+		}
+	}
+	gh.mu.Unlock()
+
+	sort.Slice(tree, func(i, j int) bool { return tree[i].Path < tree[j].Path })
+	json.NewEncoder(w).Encode(map[string]any{"tree": tree})
+}
+
+// serveBlob answers a raw blob request with the content of the repo's file
+// with the given SHA.
+func (gh *fakeGitHub) serveBlob(w http.ResponseWriter, r *http.Request, repo, sha string) {
+	gh.mu.Lock()
+	var content string
+	found := false
+	for name, c := range gh.files {
+		if strings.HasPrefix(name, repo+"/") && blobSHA(c) == sha {
+			content, found = c, true
+			break
+		}
+	}
+	gh.mu.Unlock()
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	gh.serveDownload(w, content)
+}
+
+// serveLFSBatch answers an LFS batch request with a download action for each
+// object requested.
+func (gh *fakeGitHub) serveLFSBatch(w http.ResponseWriter, r *http.Request) {
+	var batch lfsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp lfsBatchResponse
+	for _, obj := range batch.Objects {
+		resp.Objects = append(resp.Objects, lfsBatchResponseObject{
+			OID:     obj.OID,
+			Size:    obj.Size,
+			Actions: map[string]lfsBatchAction{"download": {Href: gh.URL + "/lfs/" + obj.OID}},
+		})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveDownload writes content as a raw download, pausing halfway through
+// for the stall duration.
+func (gh *fakeGitHub) serveDownload(w http.ResponseWriter, content string) {
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+
+	half := len(content) / 2
+	io.WriteString(w, content[:half])
+	if gh.stall > 0 {
+		w.(http.Flusher).Flush()
+		time.Sleep(gh.stall)
+	}
+	io.WriteString(w, content[half:])
+}
+
+var (
+	testAppKeyOnce sync.Once
+	testAppKey     *rsa.PrivateKey
+)
+
+// newTestApp returns a GitHub App with a private key shared by all tests.
+func newTestApp(t *testing.T, name, installationID string, owners ...string) *githubApp {
+	t.Helper()
+
+	testAppKeyOnce.Do(func() {
+		var err error
+		if testAppKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+
+	return &githubApp{name: name, clientID: "client-" + name, installationID: installationID, privateKey: testAppKey, owners: owners}
+}
+
+// newTestProxy points the proxy at a fakeGitHub, resetting its app registry,
+// caches and limiters, and returns the fake with the proxy's request handler.
+func newTestProxy(t *testing.T) (*fakeGitHub, http.Handler) {
+	t.Helper()
+
+	gh := newFakeGitHub(t)
+
+	oldAPIURL, oldWebURL := githubAPIURL, githubWebURL
+	if err := setGitHubAPIURL(gh.URL); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { githubAPIURL, githubWebURL = oldAPIURL, oldWebURL })
+
+	setForTest(t, &githubClient, newGitHubClient(0, 0))
+	setForTest(t, &streamClient, newStreamClient(0, 0))
+	setForTest(t, &retries, newRetryBudget(10))
+	setForTest(t, &authenticator, Authenticator(noopAuthenticator{}))
+
+	setForTest(t, &tokenRefreshes, make(chan struct{}, *maxTokenRefreshes))
+	setForTest(t, &apps, make(map[string]*githubApp))
+	setForTest(t, &appsByOwner, make(map[string]*githubApp))
+	setForTest(t, &defaultApp, newTestApp(t, "default", "1"))
+	if err := registerApp(defaultApp); err != nil {
+		t.Fatal(err)
+	}
+
+	setForTest(t, &repoInfoCache, newLRUMap[repoInfoEntry](100))
+	setForTest(t, &sitemapCache, newLRUMap[sitemapEntry](100))
+	setForTest(t, &sitemapCacheBytes, 0)
+	setForTest(t, &repoLimiters, newLRUMap[*clientLimiter](100))
+	setForTest(t, &clientLimiters, make(map[string]*clientLimiter))
+	setForTest(t, &fileCache, make(map[string]fileCacheEntry))
+	setForTest(t, &blobCache, make(map[string]*blobEntry))
+	setForTest(t, &fileCacheBytes, 0)
+
+	upstreamPauses.Clear()
+	t.Cleanup(upstreamPauses.Clear)
+
+	oldLimiter := globalLimiter.Swap(rate.NewLimiter(rate.Inf, 0))
+	t.Cleanup(func() { globalLimiter.Store(oldLimiter) })
+
+	// tests send many requests from the same client address
+	setForTest(t, clientBurst, 1000)
+
+	return gh, http.HandlerFunc(requestHandler(context.Background()))
+}
+
+// serve sends req to handler and returns the response.
+func serve(handler http.Handler, req *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// get sends a GET request for target to handler and returns the response.
+func get(handler http.Handler, target string) *http.Response {
+	return serve(handler, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// body reads and returns the body of resp.
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestProxyServesFile(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "docs/readme.txt", "hello")
+
+	resp := get(handler, "/owner/repo/docs/readme.txt")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := body(t, resp); got != "hello" {
+		t.Errorf("body = %q, want hello", got)
+	}
+}
+
+func TestShutdownServer(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer close(release)
+
+	type result struct {
+		body string
+		err  error
+	}
+	fetch := func(path string) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			resp, err := server.Client().Get(server.URL + path)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			ch <- result{string(b), err}
+		}()
+		return ch
+	}
+	slow, fast := fetch("/slow"), fetch("/fast")
+	<-started
+	<-started
+
+	start := time.Now()
+	shutdownServer(server.Config, 500*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v, want about the 500ms timeout", elapsed)
+	}
+
+	// The fast request completes within the timeout; the slow one is cut off
+	if r := <-fast; r.err != nil || r.body != "done" {
+		t.Errorf("fast request = %q, %v, want done", r.body, r.err)
+	}
+	if r := <-slow; r.err == nil {
+		t.Errorf("slow request = %q, want an error once its connection is closed", r.body)
+	}
+}
+
+func TestBackgroundWorkersExitOnCancel(t *testing.T) {
+	newTestProxy(t)
+	setForTest(t, clockJumpThreshold, time.Minute)
+
+	f, err := openReopenableFile(t.TempDir() + "/access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the workers started at startup, and those started only in some
+	// configurations
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := runStartup(ctx, startupSteps()); err != nil {
+		t.Fatal(err)
+	}
+	goBackground(func() { retryGlobalLimiter(ctx, time.Minute) })
+	goBackground(func() { reopenOnSIGHUP(ctx, f) })
+
+	cancel()
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	if err := waitBackground(waitCtx); err != nil {
+		t.Errorf("background workers still running after cancel: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the proxy's Prometheus collectors, served by metricsHandler.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "github_proxy_requests_total",
+		Help: "Total file requests received.",
+	})
+
+	responsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_proxy_responses_total",
+		Help: "Total responses sent, by status code.",
+	}, []string{"code"})
+
+	fileCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "github_proxy_file_cache_hits_total",
+		Help: "Files served from the file cache after GitHub confirmed they were unchanged.",
+	})
+
+	fileCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "github_proxy_file_cache_misses_total",
+		Help: "Files downloaded from GitHub.",
+	})
+
+	fileCacheStale = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "github_proxy_file_cache_stale_total",
+		Help: "Expired files served from the file cache because GitHub failed to revalidate them, with -serve-stale-on-error.",
+	})
+
+	fileCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "github_proxy_file_cache_entries",
+		Help: "Files held in the file cache.",
+	})
+
+	fileCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "github_proxy_file_cache_bytes",
+		Help: "Bytes of file content held in the file cache, counting content shared by several files once.",
+	})
+
+	tokenRenewals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_proxy_installation_token_renewals_total",
+		Help: "Installation tokens acquired from GitHub, by app.",
+	}, []string{"app"})
+
+	// The rate limit gauges are labelled by installation ID, of which there are
+	// only as many as are configured.
+	rateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_proxy_github_rate_limit_remaining",
+		Help: "Requests remaining in GitHub's core rate limit, as last reported by GitHub, by installation.",
+	}, []string{"installation"})
+
+	rateLimitLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_proxy_github_rate_limit_limit",
+		Help: "Requests allowed per hour by GitHub's core rate limit, as last reported by GitHub, by installation.",
+	}, []string{"installation"})
+
+	rateLimitReset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_proxy_github_rate_limit_reset_seconds",
+		Help: "Unix time at which GitHub's core rate limit resets, as last reported by GitHub, by installation.",
+	}, []string{"installation"})
+)
+
+// tokenInstallations maps each current installation token to its installation
+// ID, so that rate limits reported for requests made with it can be attributed.
+var tokenInstallations sync.Map
+
+// registerMetrics registers the proxy's collectors, along with the standard Go
+// runtime and process collectors.
+func registerMetrics() {
+	metricsRegistry.MustRegister(
+		requestsTotal,
+		responsesTotal,
+		fileCacheHits,
+		fileCacheMisses,
+		fileCacheStale,
+		fileCacheEntries,
+		fileCacheSize,
+		tokenRenewals,
+		rateLimitRemaining,
+		rateLimitLimit,
+		rateLimitReset,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsHandler serves the registered metrics in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// newMetricsServer returns a server for addr serving the metrics at /metrics.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
+
+// observeRateLimit records GitHub's X-RateLimit-Remaining, X-RateLimit-Limit
+// and X-RateLimit-Reset response headers, if present, for the installation of
+// the token the request was made with.
+func observeRateLimit(resp *http.Response, token string) {
+	installation := installationForToken(token)
+	remaining, remainingErr := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if remainingErr == nil {
+		rateLimitRemaining.WithLabelValues(installation).Set(float64(remaining))
+	}
+
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		rateLimitLimit.WithLabelValues(installation).Set(float64(limit))
+	}
+
+	reset, resetErr := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if resetErr == nil {
+		rateLimitReset.WithLabelValues(installation).Set(float64(reset))
+	}
+
+	if remainingErr == nil && resetErr == nil {
+		recordRateLimit(installation, remaining, time.Unix(reset, 0))
+	}
+}
+
+// installationForToken returns the installation ID of an installation token,
+// or "unknown" if it isn't current.
+func installationForToken(token string) string {
+	if installation, ok := tokenInstallations.Load(token); ok {
+		return installation.(string)
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// scrapeMetrics fetches the metrics served at url, returning the value of
+// each series by its name and labels.
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metrics line %q", line)
+		}
+		series[line[:i]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return series
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.remaining = 4321
+	setForTest(t, &cacheTTL, 0)
+	setForTest(t, &metricsRegistry, prometheus.NewRegistry())
+	registerMetrics()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newMetricsServer(ln.Addr().String())
+	go server.Serve(ln)
+	defer server.Close()
+
+	url := "http://" + ln.Addr().String() + "/metrics"
+	before := scrapeMetrics(t, url)
+
+	// a download, a revalidated cache hit and a missing file
+	get(logAccess(handler), "/owner/repo/file.txt")
+	get(logAccess(handler), "/owner/repo/file.txt")
+	get(logAccess(handler), "/owner/repo/missing.txt")
+
+	after := scrapeMetrics(t, url)
+	for name, want := range map[string]float64{
+		"github_proxy_requests_total":                                   3,
+		`github_proxy_responses_total{code="200"}`:                      2,
+		`github_proxy_responses_total{code="404"}`:                      1,
+		"github_proxy_file_cache_hits_total":                            1,
+		"github_proxy_file_cache_misses_total":                          1,
+		`github_proxy_installation_token_renewals_total{app="default"}`: 1,
+	} {
+		got, ok := after[name]
+		if !ok {
+			t.Errorf("%s not served", name)
+		} else if got-before[name] != want {
+			t.Errorf("%s increased by %v, want %v", name, got-before[name], want)
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"github_proxy_file_cache_entries":                            1,
+		`github_proxy_github_rate_limit_remaining{installation="1"}`: 4321,
+		`github_proxy_github_rate_limit_limit{installation="1"}`:     5000,
+	} {
+		if got, ok := after[name]; !ok || got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	for _, name := range []string{`github_proxy_github_rate_limit_reset_seconds{installation="1"}`, "go_goroutines"} {
+		if _, ok := after[name]; !ok {
+			t.Errorf("%s not served", name)
+		}
+	}
+
+	// the metrics server serves nothing but the metrics
+	resp, err := http.Get("http://" + ln.Addr().String() + "/owner/repo/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("file request to the metrics server: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRateLimitMetricsPerInstallation(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.setFile("other", "repo", "file.txt", "content")
+
+	other := newTestApp(t, "other", "2", "other")
+	if err := registerApp(other); err != nil {
+		t.Fatal(err)
+	}
+	rateLimitRemaining.Reset()
+	rateLimitLimit.Reset()
+	rateLimitReset.Reset()
+
+	// each installation's requests report its own remaining rate limit
+	gh.remaining = 100
+	get(handler, "/owner/repo/file.txt")
+	gh.remaining = 200
+	get(handler, "/other/repo/file.txt")
+
+	for installation, want := range map[string]float64{"1": 100, "2": 200} {
+		if got := testutil.ToFloat64(rateLimitRemaining.WithLabelValues(installation)); got != want {
+			t.Errorf("installation %s: remaining = %v, want %v", installation, got, want)
+		}
+		if got := testutil.ToFloat64(rateLimitLimit.WithLabelValues(installation)); got != 5000 {
+			t.Errorf("installation %s: limit = %v, want 5000", installation, got)
+		}
+		if got := testutil.ToFloat64(rateLimitReset.WithLabelValues(installation)); got < float64(time.Now().Unix()) {
+			t.Errorf("installation %s: reset = %v, want a time to come", installation, got)
+		}
+	}
+
+	// series are only kept for installations, not for each token
+	if got := testutil.CollectAndCount(rateLimitRemaining); got != 2 {
+		t.Errorf("%d remaining series, want one for each installation", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// repoInfoCache holds the metadata of at most -max-tracked-repos repos.
+	repoInfoCache *lruMap[repoInfoEntry]
+	repoInfoMutex sync.Mutex
+
+	allowedRefs  map[string][]string
+	allowedRepos []string
+
+	// noSniffRepos are the repos whose content types are never sniffed.
+	noSniffRepos []string
+)
+
+// repoInfoEntry is cached repository metadata.
+type repoInfoEntry struct {
+	repo    *Repository
+	expires time.Time
+}
+
+// repoKey returns the key identifying a repository in caches and configuration.
+// GitHub owner and repo names are case-insensitive, so the key is lowercased.
+func repoKey(owner, repo string) string {
+	return strings.ToLower(owner + "/" + repo)
+}
+
+// getRepoInfo returns the metadata for a repository, from cache if fresh.
+// Without a token, only fresh cached metadata is returned.
+func getRepoInfo(ctx context.Context, owner, repo, token string) (*Repository, error) {
+	key := repoKey(owner, repo)
+
+	repoInfoMutex.Lock()
+	entry, ok := repoInfoCache.get(key)
+	repoInfoMutex.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.repo, nil
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("metadata for %s/%s isn't cached", owner, repo)
+	}
+
+	repository, err := GetRepository(ctx, owner, repo, token)
+	if err != nil {
+		return nil, err
+	}
+
+	repoInfoMutex.Lock()
+	repoInfoCache.put(key, repoInfoEntry{repo: repository, expires: time.Now().Add(*repoInfoTTL)})
+	repoInfoMutex.Unlock()
+
+	return repository, nil
+}
+
+// invalidateRepoInfo discards the cached metadata for a repository, so that
+// it is fetched again when next needed.
+func invalidateRepoInfo(owner, repo string) {
+	repoInfoMutex.Lock()
+	repoInfoCache.remove(repoKey(owner, repo))
+	repoInfoMutex.Unlock()
+}
+
+// checkRefAllowed returns an error if ref, or the default branch when ref is
+// empty, doesn't match the -allowed-refs patterns configured for the repo.
+// Repos without configured patterns allow every ref.
+func checkRefAllowed(ctx context.Context, owner, repo, ref, token string) error {
+	patterns, ok := allowedRefs[repoKey(owner, repo)]
+	if !ok {
+		return nil
+	}
+
+	if ref == "" {
+		repository, err := getRepoInfo(ctx, owner, repo, token)
+		if err != nil {
+			return fmt.Errorf("failed to resolve default branch: %w", err)
+		}
+		ref = repository.DefaultBranch
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ref %s is not allowed for %s/%s", ref, owner, repo)
+}
+
+// isArchived reports whether a repository is archived, using cached metadata.
+func isArchived(ctx context.Context, owner, repo, token string) (bool, error) {
+	repository, err := getRepoInfo(ctx, owner, repo, token)
+	if err != nil {
+		return false, fmt.Errorf("failed to get repository metadata: %w", err)
+	}
+
+	return repository.Archived, nil
+}
+
+// parseAllowedRefs parses a comma-separated list of owner/repo=pattern pairs.
+// A repo may be listed more than once to allow several patterns.
+func parseAllowedRefs(s string) (map[string][]string, error) {
+	refs := make(map[string][]string)
+	if s == "" {
+		return refs, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		repo, pattern, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || strings.Count(repo, "/") != 1 || pattern == "" {
+			return nil, fmt.Errorf("invalid allowed ref: %s", pair)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid allowed ref pattern %s: %w", pattern, err)
+		}
+
+		key := strings.ToLower(repo)
+		refs[key] = append(refs[key], pattern)
+	}
+
+	return refs, nil
+}
+
+// isRepoAllowed reports whether owner/repo matches one of the -allow-repos
+// patterns. Every repo is allowed if no patterns are configured.
+func isRepoAllowed(owner, repo string) bool {
+	if len(allowedRepos) == 0 {
+		return true
+	}
+
+	return matchesRepo(allowedRepos, owner, repo)
+}
+
+// isSniffingAllowed reports whether the content types of owner/repo files may
+// be sniffed from their content, i.e. it doesn't match a -no-sniff-repos pattern.
+func isSniffingAllowed(owner, repo string) bool {
+	return !matchesRepo(noSniffRepos, owner, repo)
+}
+
+// matchesRepo reports whether owner/repo matches one of patterns.
+func matchesRepo(patterns []string, owner, repo string) bool {
+	key := repoKey(owner, repo)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRepoPatterns parses a comma-separated list of owner/repo patterns, in
+// which '*' matches within a single segment, e.g. myorg/*.
+func parseRepoPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+
+		if strings.Count(pattern, "/") != 1 {
+			return nil, fmt.Errorf("invalid repo pattern: %s", pattern)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repo pattern %s: %w", pattern, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestParseAllowedRefs(t *testing.T) {
+	refs, err := parseAllowedRefs("Owner/Repo=main, owner/repo=release/*,other/repo=v*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refs["owner/repo"]; len(got) != 2 || got[0] != "main" || got[1] != "release/*" {
+		t.Errorf("owner/repo patterns = %q, want [main release/*]", got)
+	}
+	if got := refs["other/repo"]; len(got) != 1 || got[0] != "v*" {
+		t.Errorf("other/repo patterns = %q, want [v*]", got)
+	}
+
+	for _, s := range []string{"owner/repo", "owner=main", "owner/repo=", "owner/repo=[", "a/b/c=main"} {
+		if _, err := parseAllowedRefs(s); err == nil {
+			t.Errorf("parseAllowedRefs(%q): expected an error", s)
+		}
+	}
+}
+
+func TestAllowedRefs(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.setFile("owner", "open", "file.txt", "content")
+
+	refs, err := parseAllowedRefs("owner/repo=main,owner/repo=release/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &allowedRefs, refs)
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/owner/repo/file.txt?ref=main", http.StatusOK},
+		{"/owner/repo/file.txt?ref=refs/heads/main", http.StatusOK},
+		{"/owner/repo/file.txt?ref=release/1.0", http.StatusOK},
+		{"/owner/repo/file.txt", http.StatusOK}, // the default branch, main
+		{"/owner/repo/file.txt?ref=dev", http.StatusForbidden},
+		{"/owner/repo/file.txt?ref=release/1.0/hotfix", http.StatusForbidden},
+		{"/owner/repo/file.txt?ref=0123456789abcdef0123456789abcdef01234567", http.StatusForbidden},
+		{"/owner/open/file.txt?ref=dev", http.StatusOK}, // no patterns configured
+	}
+
+	for _, tt := range tests {
+		if resp := get(handler, tt.target); resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status = %d, want %d", tt.target, resp.StatusCode, tt.status)
+		}
+	}
+
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for _, req := range gh.requests {
+		if req.URL.Path == "/repos/owner/repo/contents/file.txt" && req.URL.Query().Get("ref") == "dev" {
+			t.Error("disallowed ref requested from GitHub")
+		}
+	}
+}
+
+func TestAllowedRefsRejectRefsInPath(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+
+	refs, err := parseAllowedRefs("owner/repo=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &allowedRefs, refs)
+
+	for _, target := range []string{
+		"/owner/repo/file.txt%3Fref=evil",
+		"/owner/repo/file.txt%3Fref%3Devil",
+		"/owner/repo/file.txt%3Fa=b%26ref=evil",
+	} {
+		if resp := get(handler, target); resp.StatusCode == http.StatusOK {
+			t.Errorf("GET %s: status = 200, want the smuggled ref rejected", target)
+		}
+	}
+
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for _, req := range gh.requests {
+		if ref := req.URL.Query().Get("ref"); ref != "" && ref != "main" {
+			t.Errorf("ref %q requested from GitHub", ref)
+		}
+	}
+}
+
+func TestAllowRepos(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "content")
+	gh.setFile("other", "repo", "file.txt", "content")
+
+	// every repo is served without an allowlist
+	for _, target := range []string{"/owner/repo/file.txt", "/other/repo/file.txt"} {
+		if resp := get(handler, target); resp.StatusCode != http.StatusOK {
+			t.Errorf("no allowlist: %s: status = %d, want 200", target, resp.StatusCode)
+		}
+	}
+
+	patterns, err := parseRepoPatterns("Owner/*, other/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &allowedRepos, patterns)
+
+	for _, tt := range []struct {
+		owner, repo string
+		allowed     bool
+	}{
+		{"owner", "repo", true},
+		{"OWNER", "Repo", true},
+		{"other", "docs", true},
+		{"other", "repo", false},
+		{"owner2", "repo", false},
+		{"other", "docs2", false},
+	} {
+		if got := isRepoAllowed(tt.owner, tt.repo); got != tt.allowed {
+			t.Errorf("isRepoAllowed(%s, %s) = %t, want %t", tt.owner, tt.repo, got, tt.allowed)
+		}
+	}
+
+	n := gh.count("/")
+	if resp := get(handler, "/other/repo/file.txt"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other/repo: status = %d, want 403", resp.StatusCode)
+	}
+	if got := gh.count("/"); got != n {
+		t.Errorf("%d requests sent to GitHub for a repo that isn't allowed", got-n)
+	}
+	if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("owner/repo: status = %d, want 200", resp.StatusCode)
+	}
+
+	for _, s := range []string{"owner", "owner/repo/dir", "owner/["} {
+		if _, err := parseRepoPatterns(s); err == nil {
+			t.Errorf("parseRepoPatterns(%q): expected an error", s)
+		}
+	}
+}
+
+func TestPerRepoStateIsCapped(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	setForTest(t, maxTrackedRepos, 3)
+	setForTest(t, &repoInfoCache, newLRUMap[repoInfoEntry](3))
+	setForTest(t, &sitemapCache, newLRUMap[sitemapEntry](3))
+	setForTest(t, &repoLimiters, newLRUMap[*clientLimiter](3))
+	setForTest(t, archivedBehavior, "block")
+	setForTest(t, sitemapEnabled, true)
+	setForTest(t, repoRate, 1000)
+
+	for i := 0; i < 10; i++ {
+		repo := fmt.Sprintf("repo%d", i)
+		gh.setFile("owner", repo, "index.html", "<html></html>")
+
+		for _, target := range []string{"/owner/" + repo + "/index.html", "/owner/" + repo + "/sitemap.xml"} {
+			if resp := get(handler, target); resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status = %d, want 200", target, resp.StatusCode)
+			}
+		}
+
+		repoInfoMutex.Lock()
+		infos := repoInfoCache.len()
+		repoInfoMutex.Unlock()
+		sitemapMutex.Lock()
+		sitemaps := sitemapCache.len()
+		sitemapMutex.Unlock()
+		limiterMutex.Lock()
+		limiters := repoLimiters.len()
+		limiterMutex.Unlock()
+
+		if want := min(i+1, 3); infos != want || sitemaps != want || limiters != want {
+			t.Fatalf("after %d repos: %d repo infos, %d sitemaps and %d limiters tracked, want %d of each", i+1, infos, sitemaps, limiters, want)
+		}
+	}
+}
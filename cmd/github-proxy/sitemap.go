@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// sitemapCache holds the sitemaps of at most -max-tracked-repos repos and refs.
+	sitemapCache *lruMap[sitemapEntry]
+	sitemapMutex sync.Mutex
+
+	// sitemapCacheBytes is the size of the paths held by sitemapCache.
+	sitemapCacheBytes int64
+)
+
+// sitemapEntry is a cached list of the HTML paths served for a repo and ref.
+type sitemapEntry struct {
+	paths   []string
+	expires time.Time
+}
+
+// size returns the bytes of the paths held by the entry.
+func (e sitemapEntry) size() int64 {
+	var n int64
+	for _, p := range e.paths {
+		n += int64(len(p))
+	}
+	return n
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// serveSitemap writes a sitemap listing every HTML file served for the repo,
+// with URLs in the scheme the sitemap was requested with (see requestScheme).
+func serveSitemap(w http.ResponseWriter, r *http.Request, owner, repo, ref, token string) {
+	paths, stale, err := sitemapPaths(r.Context(), owner, repo, ref, token)
+	if err != nil {
+		upstreamFailure(w, err)
+		return
+	}
+
+	if stale {
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+	}
+
+	scheme := requestScheme(r)
+
+	var query string
+	if ref != "" {
+		query = "?" + neturl.Values{"ref": {ref}}.Encode()
+	}
+
+	urlSet := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, p := range paths {
+		loc := neturl.URL{Scheme: scheme, Host: r.Host, Path: "/" + path.Join(owner, repo, p)}
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: loc.String() + query})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(urlSet); err != nil {
+		log.Printf("Error writing sitemap: %v\n", err)
+	}
+}
+
+// sitemapPaths returns the client-visible paths of the repo's HTML files,
+// generating them from the repo tree if there is no fresh cached copy. If
+// fetching the tree fails transiently, an expired copy is returned instead for
+// up to -serve-stale-on-error after it expired, reporting it as stale.
+func sitemapPaths(ctx context.Context, owner, repo, ref, token string) ([]string, bool, error) {
+	key := repoKey(owner, repo) + "@" + ref
+
+	sitemapMutex.Lock()
+	entry, ok := sitemapCache.get(key)
+	sitemapMutex.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.paths, false, nil
+	}
+
+	tree, err := GetTree(ctx, owner, repo, ref, token)
+	if err != nil {
+		if ok && isTransient(err) && time.Since(entry.expires) < *serveStaleOnError {
+			log.Printf("serving stale sitemap for %s, expired at %s: %v\n", key, entry.expires, err)
+			return entry.paths, true, nil
+		}
+
+		return nil, false, err
+	}
+
+	root := repoRootFor(owner, repo)
+
+	var paths []string
+	for _, e := range tree {
+		if e.Type != "blob" {
+			continue
+		}
+
+		ext := strings.ToLower(path.Ext(e.Path))
+		if ext != ".html" && ext != ".htm" {
+			continue
+		}
+
+		p := e.Path
+		if root != "" {
+			if !strings.HasPrefix(p, root+"/") {
+				continue
+			}
+			p = strings.TrimPrefix(p, root+"/")
+		}
+
+		if isHiddenPath(p) {
+			continue
+		}
+
+		paths = append(paths, p)
+	}
+
+	cacheSitemap(key, sitemapEntry{paths: paths, expires: time.Now().Add(*sitemapTTL)})
+
+	return paths, false, nil
+}
+
+// cacheSitemap stores entry for key, evicting the least recently used entries
+// to keep the cache within -max-tracked-repos entries and -cache-max-bytes. An
+// entry larger than that isn't cached at all.
+func cacheSitemap(key string, entry sitemapEntry) {
+	size := entry.size()
+	if *cacheMaxBytes > 0 && size > *cacheMaxBytes {
+		log.Printf("not caching sitemap for %s: %d bytes exceeds the cache limit of %d\n", key, size, *cacheMaxBytes)
+		return
+	}
+
+	sitemapMutex.Lock()
+	defer sitemapMutex.Unlock()
+
+	removeSitemap(key)
+	for sitemapCache.len() >= *maxTrackedRepos || *cacheMaxBytes > 0 && sitemapCacheBytes+size > *cacheMaxBytes {
+		evict, _, ok := sitemapCache.oldest()
+		if !ok {
+			break
+		}
+		removeSitemap(evict)
+	}
+
+	sitemapCache.put(key, entry)
+	sitemapCacheBytes += size
+
+	log.Printf("cached sitemap for %s (%d bytes); sitemap cache holds %d entries, %d bytes\n", key, size, sitemapCache.len(), sitemapCacheBytes)
+}
+
+// removeSitemap drops the cached sitemap for key, if any. The caller must hold
+// sitemapMutex.
+func removeSitemap(key string) {
+	if entry, ok := sitemapCache.get(key); ok {
+		sitemapCacheBytes -= entry.size()
+		sitemapCache.remove(key)
+	}
+}
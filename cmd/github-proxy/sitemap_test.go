@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSitemapScheme(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "index.html", "<html></html>")
+	gh.setFile("owner", "repo", "style.css", "")
+	setForTest(t, sitemapEnabled, true)
+
+	networks, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &trustedProxies, networks)
+
+	tests := []struct {
+		name  string
+		peer  string
+		proto string
+		tls   bool
+		want  string
+	}{
+		{name: "plain HTTP", peer: "203.0.113.5:1234", want: "http://files.example.com/owner/repo/index.html"},
+		{name: "TLS", peer: "203.0.113.5:1234", tls: true, want: "https://files.example.com/owner/repo/index.html"},
+		{name: "https forwarded by a trusted proxy", peer: "10.0.0.1:1234", proto: "https", want: "https://files.example.com/owner/repo/index.html"},
+		{name: "https spoofed by an untrusted client", peer: "203.0.113.5:1234", proto: "https", want: "http://files.example.com/owner/repo/index.html"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://files.example.com/owner/repo/sitemap.xml", nil)
+		req.RemoteAddr = tt.peer
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		resp := serve(handler, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tt.name, resp.StatusCode)
+		}
+
+		var urlSet sitemapURLSet
+		if err := xml.Unmarshal([]byte(body(t, resp)), &urlSet); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(urlSet.URLs) != 1 || urlSet.URLs[0].Loc != tt.want {
+			t.Errorf("%s: URLs = %+v, want %s", tt.name, urlSet.URLs, tt.want)
+		}
+	}
+}
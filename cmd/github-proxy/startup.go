@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// startupStep is one step of the proxy's startup, run in order by runStartup.
+type startupStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runStartup runs steps in order, stopping at the first that fails, so each
+// step can rely on every step before it having succeeded.
+func runStartup(ctx context.Context, steps []startupStep) error {
+	for _, step := range steps {
+		if err := step.run(ctx); err != nil {
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+
+	return nil
+}
+
+// startupSteps returns the steps that obtain the initial installation token
+// and start the background workers, ordered so that each step's dependencies
+// are in place before it runs.
+func startupSteps() []startupStep {
+	var token string
+
+	return []startupStep{
+		{"installation token", func(ctx context.Context) error {
+			var err error
+			token, err = getInstallationToken()
+			return err
+		}},
+		{"global rate limiter", func(ctx context.Context) error {
+			startGlobalLimiter(ctx, token)
+			return nil
+		}},
+		{"limiter cleanup", func(ctx context.Context) error {
+			goBackground(func() { cleanupStaleLimiters(ctx, 30*time.Minute) })
+			return nil
+		}},
+		{"clock jump watcher", func(ctx context.Context) error {
+			if *clockJumpThreshold > 0 {
+				goBackground(func() { watchClockJumps(ctx, time.Minute, *clockJumpThreshold) })
+			}
+			return nil
+		}},
+	}
+}
+
+// startGlobalLimiter initializes the global rate limiter from the rate limit of
+// token, falling back to the default limits, or rejecting requests if
+// -fail-closed is set, and retrying in the background if it can't be fetched.
+func startGlobalLimiter(ctx context.Context, token string) {
+	if err := initGlobalLimiter(ctx, token); err != nil {
+		log.Printf("Error initializing global rate limiter: %v", err)
+
+		if *failClosed {
+			log.Printf("global rate limit unknown; rejecting requests until it is fetched")
+		} else {
+			initDefaultGlobalLimiter()
+		}
+
+		goBackground(func() { retryGlobalLimiter(ctx, time.Minute) })
+	}
+}
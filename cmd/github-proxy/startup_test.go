@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStartupOrder(t *testing.T) {
+	var ran []string
+	step := func(name string, err error) startupStep {
+		return startupStep{name, func(ctx context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+
+	if err := runStartup(context.Background(), []startupStep{step("a", nil), step("b", nil), step("c", nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+
+	// a failing step stops those after it
+	ran = nil
+	failure := errors.New("failed")
+	err := runStartup(context.Background(), []startupStep{step("a", nil), step("b", failure), step("c", nil)})
+	if !errors.Is(err, failure) || !strings.HasPrefix(err.Error(), "b: ") {
+		t.Errorf("error = %v, want b's failure", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+}
+
+func TestStartupStepsOrder(t *testing.T) {
+	var names []string
+	for _, step := range startupSteps() {
+		names = append(names, step.name)
+	}
+
+	// the global rate limiter is sized with the installation token, and the
+	// background workers tend the limiters
+	want := []string{"installation token", "global rate limiter", "limiter cleanup", "clock jump watcher"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("startup steps = %q, want %q", names, want)
+	}
+}
+
+func TestStartup(t *testing.T) {
+	gh, _ := newTestProxy(t)
+	globalLimiter.Store(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		background.Wait()
+	}()
+
+	if err := runStartup(ctx, startupSteps()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !defaultApp.hasValidToken() {
+		t.Error("no installation token after startup")
+	}
+	if limiter := globalLimiter.Load(); limiter == nil || limiter.Burst() != 5000 {
+		t.Errorf("global limiter = %v, want one sized from GitHub's rate limit", limiter)
+	}
+	if n := gh.count("/rate_limit"); n != 1 {
+		t.Errorf("%d rate limit requests, want 1", n)
+	}
+}
+
+func TestStartupStopsWithoutToken(t *testing.T) {
+	gh, _ := newTestProxy(t)
+	setForTest(t, maxRetries, 0)
+	globalLimiter.Store(nil)
+	gh.setStatus(http.StatusInternalServerError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		background.Wait()
+	}()
+
+	err := runStartup(ctx, startupSteps())
+	if err == nil || !strings.HasPrefix(err.Error(), "installation token: ") {
+		t.Fatalf("error = %v, want the installation token step's failure", err)
+	}
+
+	// the steps after it never ran
+	if limiter := globalLimiter.Load(); limiter != nil {
+		t.Error("global limiter initialized without an installation token")
+	}
+	if n := gh.count("/rate_limit"); n != 0 {
+		t.Errorf("%d rate limit requests sent without an installation token", n)
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	for _, failClosedOn := range []bool{false, true} {
+		gh, handler := newTestProxy(t)
+		gh.setFile("owner", "repo", "file.txt", "content")
+		setForTest(t, failClosed, failClosedOn)
+		setForTest(t, maxRetries, 0)
+		globalLimiter.Store(nil)
+
+		token, err := getInstallationToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// GitHub's rate limit can't be fetched
+		ctx, cancel := context.WithCancel(context.Background())
+		gh.setStatus(http.StatusInternalServerError)
+		startGlobalLimiter(ctx, token)
+		gh.setStatus(0)
+
+		want := http.StatusOK
+		if failClosedOn {
+			want = http.StatusServiceUnavailable
+		}
+		if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != want {
+			t.Errorf("fail closed %t: status = %d, want %d while the rate limit is unknown", failClosedOn, resp.StatusCode, want)
+		}
+
+		// once it is fetched, requests are served either way
+		done := make(chan struct{})
+		go func() {
+			retryGlobalLimiter(ctx, time.Millisecond)
+			close(done)
+		}()
+		<-done
+		if resp := get(handler, "/owner/repo/file.txt"); resp.StatusCode != http.StatusOK {
+			t.Errorf("fail closed %t: status = %d, want 200 once the rate limit is known", failClosedOn, resp.StatusCode)
+		}
+		if limiter := globalLimiter.Load(); limiter == nil || limiter.Burst() != 5000 {
+			t.Errorf("fail closed %t: global limiter = %v, want one sized from GitHub's rate limit", failClosedOn, limiter)
+		}
+
+		cancel()
+		background.Wait()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// tlsVersions maps -tls-min-version values to TLS protocol versions. TLS 1.0
+// and 1.1 have no AEAD cipher suites, so can't be negotiated with the cipher
+// policy and aren't offered.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites is the curated TLS 1.2 cipher policy: forward secret AEAD
+// suites only. TLS 1.3 suites are not configurable and are always secure.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// newTLSConfig returns the server TLS configuration enforcing minVersion and the cipher policy.
+func newTLSConfig(minVersion string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version: %s", minVersion)
+	}
+
+	return &tls.Config{
+		MinVersion:   version,
+		CipherSuites: tlsCipherSuites,
+	}, nil
+}
+
+// redirectToTLS returns a handler redirecting every request with 301 Moved
+// Permanently to the same URL on the HTTPS server listening on bindAddr.
+func redirectToTLS(bindAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(bindAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// an IPv6 address needs its brackets even without a port
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
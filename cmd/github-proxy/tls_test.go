@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTLSConfigRejectsVersionsWithoutAEADSuites(t *testing.T) {
+	for _, version := range []string{"1.0", "1.1", "1.4", ""} {
+		if _, err := newTLSConfig(version); err == nil {
+			t.Errorf("newTLSConfig(%q): expected an error", version)
+		}
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	tests := []struct {
+		minVersion    string
+		clientVersion uint16
+		ok            bool
+	}{
+		{minVersion: "1.2", clientVersion: tls.VersionTLS11},
+		{minVersion: "1.2", clientVersion: tls.VersionTLS12, ok: true},
+		{minVersion: "1.2", clientVersion: tls.VersionTLS13, ok: true},
+		{minVersion: "1.3", clientVersion: tls.VersionTLS12},
+		{minVersion: "1.3", clientVersion: tls.VersionTLS13, ok: true},
+	}
+
+	for _, tt := range tests {
+		config, err := newTLSConfig(tt.minVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = config
+		server.StartTLS()
+
+		client := server.Client()
+		transport := client.Transport.(*http.Transport)
+		transport.TLSClientConfig.MinVersion = tt.clientVersion
+		transport.TLSClientConfig.MaxVersion = tt.clientVersion
+
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		server.Close()
+
+		if tt.ok && err != nil {
+			t.Errorf("min %s, client TLS %x: handshake failed: %v", tt.minVersion, tt.clientVersion, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("min %s, client TLS %x: handshake succeeded, want it rejected", tt.minVersion, tt.clientVersion)
+		}
+	}
+}
+
+func TestTLSHandshakeRestrictsTLS12CipherSuites(t *testing.T) {
+	config, err := newTLSConfig("1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.MaxVersion = tls.VersionTLS12
+	transport.TLSClientConfig.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}
+
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("handshake with a CBC cipher suite succeeded, want it rejected")
+	}
+}
+
+func TestServeFileOverTLS(t *testing.T) {
+	gh, handler := newTestProxy(t)
+	gh.setFile("owner", "repo", "file.txt", "secure")
+
+	config, err := newTLSConfig("1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/owner/repo/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Fatalf("status = %d over TLS %v, want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+	if got := body(t, resp); got != "secure" {
+		t.Errorf("body = %q, want secure", got)
+	}
+}
+
+func TestRedirectToTLS(t *testing.T) {
+	tests := []struct {
+		bindAddr string
+		target   string
+		want     string
+	}{
+		{":8443", "http://files.example.com/owner/repo/file.txt?ref=main", "https://files.example.com:8443/owner/repo/file.txt?ref=main"},
+		{":8443", "http://files.example.com:8080/owner/repo/", "https://files.example.com:8443/owner/repo/"},
+		{"0.0.0.0:443", "http://files.example.com:8080/owner/repo/file.txt", "https://files.example.com/owner/repo/file.txt"},
+		{":443", "http://[2001:db8::1]:8080/owner/repo/file.txt", "https://[2001:db8::1]/owner/repo/file.txt"},
+		{":8443", "http://[2001:db8::1]:8080/owner/repo/file.txt", "https://[2001:db8::1]:8443/owner/repo/file.txt"},
+	}
+
+	for _, tt := range tests {
+		resp := get(redirectToTLS(tt.bindAddr), tt.target)
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("%s on %s: status = %d, want 301", tt.target, tt.bindAddr, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Location"); got != tt.want {
+			t.Errorf("%s on %s: Location = %q, want %q", tt.target, tt.bindAddr, got, tt.want)
+		}
+	}
+}
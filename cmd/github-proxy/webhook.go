@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxWebhookBody caps the size of webhook payloads that are read.
+const maxWebhookBody = 1 << 20
+
+// webhookHandler receives GitHub webhook deliveries signed with -webhook-secret.
+// repository events, such as a change of default branch or the repo being
+// archived, invalidate the repo's cached metadata.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if *webhookSecret == "" {
+		httpError(w, http.StatusNotFound, "Not Found", errors.New("webhooks require a webhook secret to be configured"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, http.StatusMethodNotAllowed, "Method Not Allowed", errors.New("invalid request method"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("failed to read webhook: %w", err))
+		return
+	}
+
+	if !validWebhookSignature(body, r.Header.Get("X-Hub-Signature-256")) {
+		httpError(w, http.StatusUnauthorized, "Unauthorized", errors.New("invalid webhook signature"))
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event != "repository" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var payload struct {
+		Action     string `json:"action"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		httpError(w, http.StatusBadRequest, "Bad Request", fmt.Errorf("failed to parse webhook: %w", err))
+		return
+	}
+
+	if owner, repo, ok := strings.Cut(payload.Repository.FullName, "/"); ok {
+		invalidateRepoInfo(owner, repo)
+		log.Printf("repository %s event for %s; cached metadata invalidated\n", payload.Action, payload.Repository.FullName)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validWebhookSignature reports whether signature, the X-Hub-Signature-256
+// header of a webhook delivery, is the HMAC-SHA256 of body keyed by the
+// webhook secret.
+func validWebhookSignature(body []byte, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(*webhookSecret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}